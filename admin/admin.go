@@ -0,0 +1,287 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"mini-gateway/metrics"
+	"mini-gateway/middleware"
+	"mini-gateway/proxy"
+	"mini-gateway/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 请求体最大 4MB
+const maxBodySize = 4 << 20
+
+// NewHandler 创建管理接口，提供端点及全局中间件的查询和增删改
+//
+//	GET    /config
+//	GET    /endpoints
+//	POST   /endpoints
+//	GET    /endpoints/{id}
+//	PUT    /endpoints/{id}
+//	DELETE /endpoints/{id}
+//	GET    /middlewares
+//	PUT    /middlewares
+//	GET    /metrics
+func NewHandler(p *proxy.Proxy, c *config.Admin) http.Handler {
+	a := &admin{proxy: p}
+	if c != nil {
+		a.token = c.Token
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", a.handleConfig)
+	mux.HandleFunc("/endpoints", a.handleEndpoints)
+	mux.HandleFunc("/endpoints/", a.handleEndpoint)
+	mux.HandleFunc("/middlewares", a.handleMiddlewares)
+	mux.Handle("/metrics", metrics.Handler())
+	a.mux = mux
+	return a
+}
+
+type admin struct {
+	proxy *proxy.Proxy
+	token string
+	mux   *http.ServeMux
+	// 保证读取-修改-写入的原子性
+	lock sync.Mutex
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *admin) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, &config.Http{
+		Middlewares: a.proxy.Middlewares(),
+		Endpoints:   redactEndpoints(a.proxy.Endpoints()),
+	})
+}
+
+func (a *admin) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, redactEndpoints(a.proxy.Endpoints()))
+	case http.MethodPost:
+		var e *config.Endpoint
+		if err := readJSON(r, &e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateEndpoint(e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if _, ok := a.proxy.Endpoint(e.ID); ok {
+			writeError(w, http.StatusConflict, fmt.Errorf("endpoint already exists,id:%s", e.ID))
+			return
+		}
+		err := a.proxy.UpdateEndpoint(a.proxy.Middlewares(), e)
+		metrics.ConfigReloads.WithLabelValues("admin", metrics.ReloadResult(err)).Inc()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		slog.Info("admin created endpoint %s", e.ID)
+		writeJSON(w, http.StatusCreated, redactEndpoint(e))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (a *admin) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/endpoints/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		e, ok := a.proxy.Endpoint(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("endpoint not found,id:%s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, redactEndpoint(e))
+	case http.MethodPut:
+		var e *config.Endpoint
+		if err := readJSON(r, &e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if e != nil && e.ID == "" {
+			e.ID = id
+		}
+		if e != nil && e.ID != id {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("endpoint id %s does not match path id %s", e.ID, id))
+			return
+		}
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		old, ok := a.proxy.Endpoint(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("endpoint not found,id:%s", id))
+			return
+		}
+		// 查询接口返回的 discovery 已脱敏，原样提交时沿用原来的配置
+		if e != nil && e.Discovery != "" && e.Discovery != old.Discovery && e.Discovery == discovery.Redact(old.Discovery) {
+			e.Discovery = old.Discovery
+		}
+		if err := validateEndpoint(e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err := a.proxy.UpdateEndpoint(a.proxy.Middlewares(), e)
+		metrics.ConfigReloads.WithLabelValues("admin", metrics.ReloadResult(err)).Inc()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		slog.Info("admin updated endpoint %s", id)
+		writeJSON(w, http.StatusOK, redactEndpoint(e))
+	case http.MethodDelete:
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if _, ok := a.proxy.Endpoint(id); !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("endpoint not found,id:%s", id))
+			return
+		}
+		a.proxy.RemoveEndpoint(id)
+		metrics.ConfigReloads.WithLabelValues("admin", metrics.ReloadResult(nil)).Inc()
+		slog.Info("admin removed endpoint %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (a *admin) handleMiddlewares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.proxy.Middlewares())
+	case http.MethodPut:
+		var ms []*config.Middleware
+		if err := readJSON(r, &ms); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateMiddlewares(ms); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		// 全局中间件更新需要重新生成所有端点
+		err := a.proxy.UpdateEndpoints(ms, a.proxy.Endpoints())
+		metrics.ConfigReloads.WithLabelValues("admin", metrics.ReloadResult(err)).Inc()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		slog.Info("admin updated global middlewares")
+		writeJSON(w, http.StatusOK, ms)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func validateEndpoint(e *config.Endpoint) error {
+	if e == nil {
+		return errors.New("endpoint cannot be null")
+	}
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	if e.LoadBalance != "" {
+		if _, ok := loadbalance.GetPicker(e.LoadBalance); !ok {
+			return fmt.Errorf("load balancer picker %s not found,id:%s", e.LoadBalance, e.ID)
+		}
+	}
+	if d := strings.TrimSpace(e.Discovery); d != "" {
+		u, err := url.Parse(d)
+		if err != nil {
+			return fmt.Errorf("discovery %s is invalid,id:%s", discovery.Redact(e.Discovery), e.ID)
+		}
+		if _, ok := discovery.GetResolver(u.Scheme); !ok {
+			return fmt.Errorf("discovery resolver for scheme %s not found,id:%s", u.Scheme, e.ID)
+		}
+	}
+	if err := validateMiddlewares(e.Middlewares); err != nil {
+		return fmt.Errorf("%s,id:%s", err.Error(), e.ID)
+	}
+	return nil
+}
+
+func validateMiddlewares(ms []*config.Middleware) error {
+	for _, m := range ms {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+		if _, ok := middleware.Get(m); !ok {
+			return fmt.Errorf("%s middleware not found", m.Name)
+		}
+	}
+	return nil
+}
+
+// redactEndpoint 返回 discovery 脱敏后的副本，不修改生效中的配置
+func redactEndpoint(e *config.Endpoint) *config.Endpoint {
+	if e == nil || e.Discovery == "" {
+		return e
+	}
+	c := *e
+	c.Discovery = discovery.Redact(e.Discovery)
+	return &c
+}
+
+func redactEndpoints(es []*config.Endpoint) []*config.Endpoint {
+	rs := make([]*config.Endpoint, 0, len(es))
+	for _, e := range es {
+		rs = append(rs, redactEndpoint(e))
+	}
+	return rs
+}
+
+func readJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid json body,error:%s", err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
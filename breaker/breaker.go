@@ -0,0 +1,254 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"mini-gateway/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// NewBreaker 创建节点熔断器，熔断器包装 picker，处于打开状态的节点不会被 picker 选中。
+func NewBreaker(ctx context.Context, c *config.CircuitBreaker, picker loadbalance.Picker) *Breaker {
+	b := &Breaker{
+		ctx:                ctx,
+		picker:             picker,
+		consecutive5xx:     5,
+		consecutiveErrors:  5,
+		baseEjectionTime:   30 * time.Second,
+		maxEjectionTime:    300 * time.Second,
+		maxEjectionPercent: 50,
+		circuits:           make(map[string]*circuit),
+	}
+	if c.Consecutive5xx > 0 {
+		b.consecutive5xx = c.Consecutive5xx
+	}
+	if c.ConsecutiveErrors > 0 {
+		b.consecutiveErrors = c.ConsecutiveErrors
+	}
+	if c.BaseEjectionTime > 0 {
+		b.baseEjectionTime = time.Duration(c.BaseEjectionTime) * time.Millisecond
+	}
+	if c.MaxEjectionTime > 0 {
+		b.maxEjectionTime = time.Duration(c.MaxEjectionTime) * time.Millisecond
+	}
+	if b.maxEjectionTime < b.baseEjectionTime {
+		b.maxEjectionTime = b.baseEjectionTime
+	}
+	if c.MaxEjectionPercent > 0 {
+		b.maxEjectionPercent = c.MaxEjectionPercent
+	}
+	go func() {
+		<-ctx.Done()
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		for _, c := range b.circuits {
+			c.stopTimer()
+		}
+	}()
+	return b
+}
+
+type Breaker struct {
+	ctx                context.Context
+	picker             loadbalance.Picker
+	consecutive5xx     int
+	consecutiveErrors  int
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+
+	mux      sync.Mutex
+	nodes    []discovery.Node
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	uri        string
+	state      State
+	fails5xx   int
+	failsErr   int
+	ejections  int
+	ejectTimer *time.Timer
+}
+
+func (c *circuit) stopTimer() {
+	if c.ejectTimer != nil {
+		c.ejectTimer.Stop()
+		c.ejectTimer = nil
+	}
+}
+
+func (b *Breaker) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	return b.picker.Next(ctx)
+}
+
+// Apply 更新节点，已存在节点保留熔断状态
+func (b *Breaker) Apply(nodes []discovery.Node) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	circuits := make(map[string]*circuit)
+	for _, n := range nodes {
+		if c, ok := b.circuits[n.Uri()]; ok {
+			circuits[n.Uri()] = c
+			delete(b.circuits, n.Uri())
+			continue
+		}
+		if _, ok := circuits[n.Uri()]; !ok {
+			circuits[n.Uri()] = &circuit{uri: n.Uri()}
+		}
+	}
+	for _, c := range b.circuits {
+		c.stopTimer()
+	}
+	b.circuits = circuits
+	b.nodes = nodes
+	b.applyAvailable()
+}
+
+// State 返回节点当前的熔断状态
+func (b *Breaker) State(uri string) (State, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	c, ok := b.circuits[uri]
+	if !ok {
+		return StateClosed, false
+	}
+	return c.state, true
+}
+
+// States 返回所有节点的熔断状态
+func (b *Breaker) States() map[string]State {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	states := make(map[string]State, len(b.circuits))
+	for uri, c := range b.circuits {
+		states[uri] = c.state
+	}
+	return states
+}
+
+// Report 上报节点的请求结果，err 为传输层错误，statusCode 为上游响应状态码
+func (b *Breaker) Report(uri string, err error, statusCode int) {
+	// 客户端主动取消的请求不计入节点失败
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	c, ok := b.circuits[uri]
+	if !ok || c.state == StateOpen {
+		return
+	}
+
+	failed := false
+	switch {
+	case err != nil:
+		c.failsErr++
+		c.fails5xx = 0
+		failed = c.failsErr >= b.consecutiveErrors
+	case statusCode >= http.StatusInternalServerError:
+		c.fails5xx++
+		c.failsErr = 0
+		failed = c.fails5xx >= b.consecutive5xx
+	default:
+		c.fails5xx = 0
+		c.failsErr = 0
+		if c.state == StateHalfOpen {
+			c.ejections = 0
+			b.transition(c, StateClosed)
+		}
+		return
+	}
+
+	// 半开状态下任何失败都会重新打开
+	if c.state == StateHalfOpen || failed {
+		b.eject(c)
+	}
+}
+
+// eject 打开熔断，调用方需持有锁
+func (b *Breaker) eject(c *circuit) {
+	if c.state != StateHalfOpen && !b.canEject() {
+		slog.Warn("circuit breaker node %s reached failure threshold,but max ejection percent %d%% was reached", c.uri, b.maxEjectionPercent)
+		return
+	}
+	c.ejections++
+	c.fails5xx = 0
+	c.failsErr = 0
+	d := b.baseEjectionTime * time.Duration(c.ejections)
+	if d > b.maxEjectionTime || d <= 0 {
+		d = b.maxEjectionTime
+	}
+	c.stopTimer()
+	c.ejectTimer = time.AfterFunc(d, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if b.ctx.Err() != nil || b.circuits[c.uri] != c || c.state != StateOpen {
+			return
+		}
+		c.ejectTimer = nil
+		b.transition(c, StateHalfOpen)
+		b.applyAvailable()
+	})
+	b.transition(c, StateOpen)
+	slog.Warn("circuit breaker node %s ejected for %s", c.uri, d)
+	b.applyAvailable()
+}
+
+func (b *Breaker) canEject() bool {
+	ejected := 0
+	for _, c := range b.circuits {
+		if c.state == StateOpen {
+			ejected++
+		}
+	}
+	allowed := len(b.circuits) * b.maxEjectionPercent / 100
+	if allowed == 0 && len(b.circuits) > 1 {
+		allowed = 1
+	}
+	return ejected < allowed
+}
+
+func (b *Breaker) transition(c *circuit, state State) {
+	if c.state == state {
+		return
+	}
+	slog.Info("circuit breaker node %s state %s -> %s", c.uri, c.state, state)
+	c.state = state
+}
+
+// applyAvailable 把未熔断的节点应用给 picker，调用方需持有锁
+func (b *Breaker) applyAvailable() {
+	ns := make([]discovery.Node, 0, len(b.nodes))
+	for _, n := range b.nodes {
+		if c, ok := b.circuits[n.Uri()]; ok && c.state != StateOpen {
+			ns = append(ns, n)
+		}
+	}
+	b.picker.Apply(ns)
+}
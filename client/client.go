@@ -1,34 +1,271 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mini-gateway/breaker"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
 	"mini-gateway/loadbalance"
+	"mini-gateway/metrics"
+	"mini-gateway/reqcontext"
+	"mini-gateway/retry"
+	"mini-gateway/slog"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
-func newClient(s loadbalance.Picker, c *http.Client) *client {
-	return &client{picker: s, httpClient: c}
+// 重试时为避开已尝试过的节点，最多向 picker 请求的次数
+const maxPickAttempts = 3
+
+func newClient(endpoint *config.Endpoint, s loadbalance.Picker, b *breaker.Breaker, r *retry.Policy, c *http.Client) *client {
+	return &client{endpointID: endpoint.ID, hashOn: endpoint.HashOn, picker: s, breaker: b, retry: r, httpClient: c}
 }
 
 type client struct {
+	endpointID string
+	hashOn     string
 	picker     loadbalance.Picker
+	breaker    *breaker.Breaker
+	retry      *retry.Policy
 	httpClient *http.Client
 }
 
-func (c *client) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	node, err := c.picker.Next(req.Context())
+func (c *client) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.hashOn != "" {
+		if key := hashKey(c.hashOn, req); key != "" {
+			req = req.WithContext(reqcontext.WithHashKey(req.Context(), key))
+		}
+	}
+	// 协议升级的请求不做重试和单次超时控制
+	if c.retry == nil || req.Header.Get("Upgrade") != "" {
+		resp, _, err := c.try(req, nil)
+		return resp, err
+	}
+
+	retry.DefaultBudget().Deposit()
+	attempts := 1
+	// 请求体无法重放时不重试
+	if c.retry.AllowMethod(req.Method) && (req.Body == nil || req.GetBody != nil) {
+		attempts = c.retry.Attempts()
+	}
+
+	ctx := req.Context()
+	tried := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		tryReq := req
+		var cancel context.CancelFunc
+		if c.retry.PerTryTimeout() > 0 {
+			var tryCtx context.Context
+			tryCtx, cancel = context.WithTimeout(ctx, c.retry.PerTryTimeout())
+			tryReq = req.WithContext(tryCtx)
+		}
+		resp, node, err := c.try(tryReq, tried)
+		timedOut := cancel != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded)
+
+		// 读取客户端请求体失败时重试也无法成功
+		if attempt >= attempts || ctx.Err() != nil || IsRequestBodyError(err) ||
+			!c.retry.ShouldRetry(resp, err, timedOut) || !retry.DefaultBudget().Withdraw() {
+			if cancel != nil {
+				if resp == nil {
+					cancel()
+				} else {
+					resp.Body = onClose(resp.Body, cancel)
+				}
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if cancel != nil {
+			cancel()
+		}
+		metrics.Retries.WithLabelValues(c.endpointID).Inc()
+		if node != nil {
+			tried[node.Uri()] = true
+			if err != nil {
+				slog.Warn("retry request %s,attempt:%d,node:%s,error:%s", req.URL.Path, attempt, node.Uri(), err.Error())
+			} else {
+				slog.Warn("retry request %s,attempt:%d,node:%s,status:%d", req.URL.Path, attempt, node.Uri(), resp.StatusCode)
+			}
+		}
+
+		timer := time.NewTimer(c.retry.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *client) try(req *http.Request, tried map[string]bool) (*http.Response, discovery.Node, error) {
+	node, done, err := c.pick(req.Context(), tried)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	u, err := url.Parse(node.Uri())
 	if err != nil {
-		return nil, err
+		if done != nil {
+			done(loadbalance.DoneInfo{Err: err})
+		}
+		return nil, node, err
 	}
 	req.RequestURI = ""
 	req.URL.Host = u.Host
 	req.URL.Scheme = u.Scheme
+	var body *requestBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &requestBody{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	latency := time.Since(start)
+	if err != nil && body != nil {
+		if bodyErr := body.readErr(); bodyErr != nil {
+			// 客户端的请求体有问题，不计入节点的失败和延迟
+			err = &RequestBodyError{Err: bodyErr}
+			if done != nil {
+				done(loadbalance.DoneInfo{Err: loadbalance.ErrIgnored})
+			}
+			return nil, node, err
+		}
+	}
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	metrics.UpstreamRequests.WithLabelValues(c.endpointID, node.Uri(), metrics.CodeClass(statusCode)).Inc()
+	metrics.UpstreamDuration.WithLabelValues(c.endpointID, node.Uri()).Observe(latency.Seconds())
+	if c.breaker != nil {
+		c.breaker.Report(node.Uri(), err, statusCode)
+	}
+	if done != nil {
+		info := loadbalance.DoneInfo{Err: err, StatusCode: statusCode, Latency: latency}
+		if resp == nil {
+			done(info)
+		} else {
+			// 响应体读完关闭后请求才算结束
+			resp.Body = onClose(resp.Body, func() { done(info) })
+		}
+	}
+	return resp, node, err
+}
+
+// 重试时为避开已尝试过的节点而放弃的节点
+var errNodeSkipped = fmt.Errorf("node skipped,%w", loadbalance.ErrIgnored)
 
-	resp, err = c.httpClient.Do(req)
-	return
+// pick 选择节点，尽量避开已经尝试过的节点
+func (c *client) pick(ctx context.Context, tried map[string]bool) (discovery.Node, loadbalance.DoneFunc, error) {
+	if len(tried) > 0 {
+		ctx = reqcontext.WithTried(ctx, tried)
+	}
+	var node discovery.Node
+	var done loadbalance.DoneFunc
+	for i := 0; i < maxPickAttempts; i++ {
+		n, d, err := c.picker.Next(ctx)
+		if err != nil {
+			if node != nil {
+				return node, done, nil
+			}
+			return nil, nil, err
+		}
+		if done != nil {
+			done(loadbalance.DoneInfo{Err: errNodeSkipped})
+		}
+		node, done = n, d
+		if !tried[n.Uri()] {
+			break
+		}
+	}
+	return node, done, nil
+}
+
+// RequestBodyError 读取客户端请求体失败，比如超过 maxBodySize 或客户端中断上传
+type RequestBodyError struct {
+	Err error
+}
+
+func (e *RequestBodyError) Error() string {
+	return "read request body error:" + e.Err.Error()
+}
+
+func (e *RequestBodyError) Unwrap() error {
+	return e.Err
+}
+
+func IsRequestBodyError(err error) bool {
+	var bodyErr *RequestBodyError
+	return errors.As(err, &bodyErr)
+}
+
+// requestBody 记录读取请求体时的错误，传输层在其他协程中读取请求体
+type requestBody struct {
+	io.ReadCloser
+	mux sync.Mutex
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mux.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mux.Unlock()
+	}
+	return n, err
+}
+
+func (b *requestBody) readErr() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.err
+}
+
+// closeBody 响应体关闭时执行 onClose，比如取消单次尝试的超时上下文、通知 picker 请求结束
+type closeBody struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (b *closeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
+
+// writeCloseBody 101 响应的响应体是可写的连接，包装后仍然可写
+type writeCloseBody struct {
+	*closeBody
+	io.Writer
+}
+
+func onClose(body io.ReadCloser, fn func()) io.ReadCloser {
+	b := &closeBody{ReadCloser: body, onClose: fn}
+	if w, ok := body.(io.Writer); ok {
+		return &writeCloseBody{closeBody: b, Writer: w}
+	}
+	return b
 }
@@ -2,17 +2,20 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
-	"golang.org/x/net/http2"
+	"mini-gateway/breaker"
 	"mini-gateway/config"
 	"mini-gateway/discovery"
+	"mini-gateway/health"
 	"mini-gateway/loadbalance"
 	"mini-gateway/loadbalance/rotation"
+	"mini-gateway/metrics"
+	"mini-gateway/retry"
 	"mini-gateway/slog"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,9 +23,9 @@ type Factory func(ctx context.Context, endpoint *config.Endpoint) (http.RoundTri
 
 func NewFactory(resolver discovery.Resolver) Factory {
 	return func(ctx context.Context, endpoint *config.Endpoint) (http.RoundTripper, error) {
-		c := defaultHttpClient
-		if strings.ToLower(endpoint.Protocol) == "grpc" {
-			c = defaultHttp2Client
+		c, err := newHttpClient(ctx, endpoint, endpoint.Protocol)
+		if err != nil {
+			return nil, err
 		}
 
 		f, ok := loadbalance.GetPicker(endpoint.LoadBalance)
@@ -30,17 +33,88 @@ func NewFactory(resolver discovery.Resolver) Factory {
 			slog.Warn("could not find load balancer picker %s,rotation is used by default", endpoint.LoadBalance)
 			f = rotation.Factor
 		}
-		s := f()
+		var slowStart func(picker loadbalance.Picker)
+		if endpoint.SlowStart != nil && endpoint.SlowStart.Window > 0 {
+			if _, ok := f().(loadbalance.SlowStarter); ok {
+				slowStart = func(picker loadbalance.Picker) {
+					picker.(loadbalance.SlowStarter).SetSlowStart(time.Duration(endpoint.SlowStart.Window)*time.Millisecond, endpoint.SlowStart.MinWeightPercent)
+				}
+			} else {
+				slog.Warn("load balancer picker %s does not support slow start,id:%s", endpoint.LoadBalance, endpoint.ID)
+			}
+		}
+		var tags []string
+		var fallback map[string][]string
+		var policy string
+		if endpoint.TagRouting != nil {
+			tags, fallback, policy = endpoint.TagRouting.Tags, endpoint.TagRouting.Fallback, endpoint.TagRouting.Policy
+		}
+		picker := loadbalance.NewTagPicker(func() loadbalance.Picker {
+			picker := f()
+			if slowStart != nil {
+				slowStart(picker)
+			}
+			return picker
+		}, tags, fallback, policy)
+		cp := &countingPicker{Picker: picker}
+		metrics.PickerNodes.Register(ctx, func(emit func(value float64, labelValues ...string)) {
+			emit(float64(cp.count.Load()), endpoint.ID)
+		})
+		var discovered atomic.Int64
+		metrics.DiscoveredNodes.Register(ctx, func(emit func(value float64, labelValues ...string)) {
+			emit(float64(discovered.Load()), endpoint.ID)
+		})
+		var s loadbalance.Picker = cp
+		var b *breaker.Breaker
+		if endpoint.CircuitBreaker != nil {
+			b = breaker.NewBreaker(ctx, endpoint.CircuitBreaker, s)
+			s = b
+			metrics.CircuitBreakerState.Register(ctx, func(emit func(value float64, labelValues ...string)) {
+				for uri, state := range b.States() {
+					emit(float64(state), endpoint.ID, uri)
+				}
+			})
+		}
+		if endpoint.HealthCheck != nil {
+			hc := c
+			if strings.ToLower(endpoint.HealthCheck.Type) == health.TypeGrpc && strings.ToLower(endpoint.Protocol) != protocolGrpc {
+				hc, err = newHttpClient(ctx, endpoint, protocolGrpc)
+				if err != nil {
+					return nil, err
+				}
+			}
+			checker := health.NewChecker(ctx, endpoint.HealthCheck, hc, s)
+			s = checker
+			metrics.NodeHealthy.Register(ctx, func(emit func(value float64, labelValues ...string)) {
+				for uri, healthy := range checker.Statuses() {
+					v := 0.0
+					if healthy {
+						v = 1
+					}
+					emit(v, endpoint.ID, uri)
+				}
+			})
+		}
 
+		// 在最外层记录发现的节点，熔断或不健康的节点仍然保留指标
+		apply := func(nodes []discovery.Node) {
+			discovered.Store(int64(len(nodes)))
+			s.Apply(nodes)
+			uris := make([]string, 0, len(nodes))
+			for _, n := range nodes {
+				uris = append(uris, n.Uri())
+			}
+			metrics.SetNodes(endpoint.ID, uris)
+		}
 		if resolver != nil && len(strings.TrimSpace(endpoint.Discovery)) > 0 {
 			result, err := resolver.Resolve(context.Background(), endpoint.Discovery)
 			if err != nil {
 				return nil, err
 			}
-			s.Apply(result.Nodes)
+			apply(result.Nodes)
 
 			err = resolver.Watch(ctx, endpoint.Discovery, func(result *discovery.Result) {
-				s.Apply(result.Nodes)
+				apply(result.Nodes)
 			})
 			if err != nil {
 				return nil, err
@@ -50,39 +124,25 @@ func NewFactory(resolver discovery.Resolver) Factory {
 			for _, target := range endpoint.Targets {
 				ns = append(ns, discovery.NewNode(target.Uri, target.Weight, target.Tags))
 			}
-			s.Apply(ns)
+			apply(ns)
+		}
+		var r *retry.Policy
+		if endpoint.Retry != nil {
+			r = retry.NewPolicy(endpoint.Retry)
 		}
-		return newClient(s, c), nil
+		return newClient(endpoint, s, b, r, c), nil
 	}
 }
 
-var defaultHttpClient = &http.Client{
-	CheckRedirect: defaultCheckRedirect,
-	Transport: &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: defaultTransportDialContext(&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}),
-		MaxIdleConns:          0,
-		MaxIdleConnsPerHost:   10000,
-		MaxConnsPerHost:       10000,
-		DisableCompression:    true,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	},
+// countingPicker 记录经过熔断和健康检查过滤后应用给 picker 的节点数
+type countingPicker struct {
+	loadbalance.Picker
+	count atomic.Int64
 }
 
-var defaultHttp2Client = &http.Client{
-	CheckRedirect: defaultCheckRedirect,
-	Transport: &http2.Transport{
-		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.DialTimeout(network, addr, 30*time.Millisecond)
-		},
-		DisableCompression: true,
-		AllowHTTP:          true,
-	},
+func (p *countingPicker) Apply(nodes []discovery.Node) {
+	p.count.Store(int64(len(nodes)))
+	p.Picker.Apply(nodes)
 }
 
 // https://github.com/golang/go/blob/bc21d6a4fcf2c957a3f279fa8725e16df6586864/src/net/http/client.go#LL690C36-L690C36
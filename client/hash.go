@@ -0,0 +1,30 @@
+package client
+
+import (
+	"mini-gateway/clientip"
+	"mini-gateway/reqcontext"
+	"net/http"
+	"strings"
+)
+
+// hashKey 按端点的 hashOn 配置取一致性哈希的 key，取不到值时返回空
+func hashKey(hashOn string, req *http.Request) string {
+	kind, name, _ := strings.Cut(hashOn, ":")
+	switch kind {
+	case "ip":
+		return clientip.Get(req)
+	case "header":
+		return req.Header.Get(name)
+	case "cookie":
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value
+		}
+	case "query":
+		return req.URL.Query().Get(name)
+	case "param":
+		if params, ok := reqcontext.Params(req.Context()); ok {
+			return params[name]
+		}
+	}
+	return ""
+}
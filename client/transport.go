@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"mini-gateway/config"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const protocolGrpc = "grpc"
+
+// newHttpClient 为端点创建独立的 http 客户端，ctx 取消后关闭连接
+func newHttpClient(ctx context.Context, endpoint *config.Endpoint, protocol string) (*http.Client, error) {
+	tlsConfig, err := buildTLSConfig(endpoint.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("%s,id:%s", err.Error(), endpoint.ID)
+	}
+	opts := newTransportOptions(endpoint.Transport)
+
+	var transport http.RoundTripper
+	if strings.ToLower(protocol) == protocolGrpc {
+		transport = newGrpcTransport(tlsConfig, opts)
+	} else {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: defaultTransportDialContext(&net.Dialer{
+				Timeout:   opts.dialTimeout,
+				KeepAlive: opts.keepAlive,
+			}),
+			TLSClientConfig:       tlsConfig,
+			MaxIdleConns:          opts.maxIdleConns,
+			MaxIdleConnsPerHost:   opts.maxIdleConnsPerHost,
+			MaxConnsPerHost:       opts.maxConnsPerHost,
+			DisableCompression:    true,
+			IdleConnTimeout:       opts.idleConnTimeout,
+			TLSHandshakeTimeout:   opts.tlsHandshakeTimeout,
+			ResponseHeaderTimeout: opts.responseHeaderTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+			ReadBufferSize:        opts.readBufferSize,
+			WriteBufferSize:       opts.writeBufferSize,
+		}
+	}
+
+	grace := closeGracePeriod
+	if endpoint.Timeout > 0 {
+		grace = time.Duration(endpoint.Timeout) * time.Millisecond
+	}
+	go func() {
+		<-ctx.Done()
+		t, ok := transport.(interface{ CloseIdleConnections() })
+		if !ok {
+			return
+		}
+		t.CloseIdleConnections()
+		// 端点被替换时仍在处理的请求结束后连接才会回到连接池，等待请求结束后再次关闭
+		time.Sleep(grace)
+		t.CloseIdleConnections()
+	}()
+
+	return &http.Client{
+		CheckRedirect: defaultCheckRedirect,
+		Transport:     transport,
+	}, nil
+}
+
+// 端点没有配置超时时间时，等待处理中请求结束的时间
+const closeGracePeriod = 60 * time.Second
+
+type transportOptions struct {
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConns          int
+	maxIdleConnsPerHost   int
+	maxConnsPerHost       int
+	readBufferSize        int
+	writeBufferSize       int
+	pingInterval          time.Duration
+	pingTimeout           time.Duration
+}
+
+func newTransportOptions(c *config.Transport) *transportOptions {
+	opts := &transportOptions{
+		dialTimeout:         30 * time.Second,
+		keepAlive:           30 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+		idleConnTimeout:     90 * time.Second,
+		maxIdleConnsPerHost: 10000,
+		maxConnsPerHost:     10000,
+		pingTimeout:         15 * time.Second,
+	}
+	if c == nil {
+		return opts
+	}
+	millis := func(v int, d *time.Duration) {
+		if v > 0 {
+			*d = time.Duration(v) * time.Millisecond
+		}
+	}
+	millis(c.DialTimeout, &opts.dialTimeout)
+	millis(c.KeepAlive, &opts.keepAlive)
+	millis(c.TLSHandshakeTimeout, &opts.tlsHandshakeTimeout)
+	millis(c.ResponseHeaderTimeout, &opts.responseHeaderTimeout)
+	millis(c.IdleConnTimeout, &opts.idleConnTimeout)
+	millis(c.PingInterval, &opts.pingInterval)
+	millis(c.PingTimeout, &opts.pingTimeout)
+	if c.MaxIdleConns > 0 {
+		opts.maxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		opts.maxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost > 0 {
+		opts.maxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.ReadBufferSize > 0 {
+		opts.readBufferSize = c.ReadBufferSize
+	}
+	if c.WriteBufferSize > 0 {
+		opts.writeBufferSize = c.WriteBufferSize
+	}
+	return opts
+}
+
+func buildTLSConfig(c *config.UpstreamTLS) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c == nil {
+		return cfg, nil
+	}
+	if c.CaFile != "" {
+		pem, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream ca file failed,error:%s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificate found in upstream ca file " + c.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate failed,error:%s", err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	cfg.ServerName = c.ServerName
+	cfg.InsecureSkipVerify = c.InsecureSkipVerify
+	return cfg, nil
+}
+
+// newGrpcTransport http:// 的节点使用明文 HTTP/2，https:// 的节点使用 TLS
+func newGrpcTransport(tlsConfig *tls.Config, opts *transportOptions) *grpcTransport {
+	dialer := &net.Dialer{
+		Timeout:   opts.dialTimeout,
+		KeepAlive: opts.keepAlive,
+	}
+	return &grpcTransport{
+		h2c: &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			DisableCompression: true,
+			AllowHTTP:          true,
+			ReadIdleTimeout:    opts.pingInterval,
+			PingTimeout:        opts.pingTimeout,
+		},
+		h2: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				tlsDialer := &tls.Dialer{NetDialer: dialer, Config: cfg}
+				if opts.tlsHandshakeTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, opts.dialTimeout+opts.tlsHandshakeTimeout)
+					defer cancel()
+				}
+				return tlsDialer.DialContext(ctx, network, addr)
+			},
+			DisableCompression: true,
+			ReadIdleTimeout:    opts.pingInterval,
+			PingTimeout:        opts.pingTimeout,
+		},
+	}
+}
+
+type grpcTransport struct {
+	h2c *http2.Transport
+	h2  *http2.Transport
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.h2.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+func (t *grpcTransport) CloseIdleConnections() {
+	t.h2c.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+}
@@ -0,0 +1,171 @@
+package clientip
+
+import (
+	"fmt"
+	"mini-gateway/reqcontext"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// 可信代理写入客户端地址的请求头
+const (
+	HeaderXFF       = "xff"
+	HeaderForwarded = "forwarded"
+)
+
+var defaultTrusted atomic.Pointer[Trusted]
+
+func init() {
+	defaultTrusted.Store(&Trusted{})
+}
+
+// InitTrusted 替换全局可信代理
+func InitTrusted(t *Trusted) {
+	defaultTrusted.Store(t)
+}
+
+func DefaultTrusted() *Trusted {
+	return defaultTrusted.Load()
+}
+
+// Trusted 可信代理的地址段，只有直连地址是可信代理时才使用 header 对应的请求头中的地址
+type Trusted struct {
+	prefixes []netip.Prefix
+	header   string
+}
+
+// NewTrusted cidrs 为 CIDR 或 IP，header 为 xff 或 forwarded，为空时使用 xff
+func NewTrusted(cidrs []string, header string) (*Trusted, error) {
+	t := &Trusted{header: strings.ToLower(strings.TrimSpace(header))}
+	switch t.header {
+	case "":
+		t.header = HeaderXFF
+	case HeaderXFF, HeaderForwarded:
+	default:
+		return nil, fmt.Errorf("client ip header %s is invalid,must be %s or %s", header, HeaderXFF, HeaderForwarded)
+	}
+	for _, v := range cidrs {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %s is invalid,error:%s", v, err.Error())
+			}
+			t.prefixes = append(t.prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s is invalid,error:%s", v, err.Error())
+		}
+		addr = addr.Unmap()
+		t.prefixes = append(t.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return t, nil
+}
+
+func (t *Trusted) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrusted 请求的直连地址是否是可信代理
+func (t *Trusted) IsTrusted(req *http.Request) bool {
+	addr, err := ParseAddr(req.RemoteAddr)
+	return err == nil && t.Contains(addr)
+}
+
+// ClientIP 从右往左跳过可信代理，第一个不可信的地址即客户端地址，全部可信时取最左边的地址，
+// 遇到 unknown、_ 开头的混淆标识等无法解析的地址时停止，取最后一个可信代理的地址
+func (t *Trusted) ClientIP(req *http.Request) string {
+	remote, err := ParseAddr(req.RemoteAddr)
+	if err != nil {
+		return host(req.RemoteAddr)
+	}
+	if !t.Contains(remote) {
+		return remote.String()
+	}
+	chain := t.forwardedFor(req.Header)
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, err := ParseAddr(chain[i])
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !t.Contains(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor 只读取配置的请求头，另一个请求头可能由客户端伪造且没有被可信代理覆盖
+func (t *Trusted) forwardedFor(h http.Header) []string {
+	chain := make([]string, 0)
+	if t.header == HeaderForwarded {
+		for _, line := range h.Values("Forwarded") {
+			for _, elem := range strings.Split(line, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(strings.TrimSpace(k), "for") {
+						chain = append(chain, strings.Trim(strings.TrimSpace(v), `"`))
+					}
+				}
+			}
+		}
+		return chain
+	}
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				chain = append(chain, v)
+			}
+		}
+	}
+	return chain
+}
+
+// ParseAddr 解析 ip、ip:port、[ipv6]:port 形式的地址
+func ParseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr.Unmap(), nil
+	}
+	h, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(h)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// Get 返回代理计算的客户端地址，没有时返回直连地址
+func Get(req *http.Request) string {
+	if ip, ok := reqcontext.ClientIP(req.Context()); ok && ip != "" {
+		return ip
+	}
+	return host(req.RemoteAddr)
+}
+
+func host(remoteAddr string) string {
+	h, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return h
+}
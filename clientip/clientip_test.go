@@ -0,0 +1,60 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func clientIP(t *testing.T, header string, h http.Header) string {
+	trusted, err := NewTrusted([]string{"10.0.0.0/8"}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{RemoteAddr: "10.0.0.1:5000", Header: h}
+	return trusted.ClientIP(req)
+}
+
+// 可信代理只覆盖了 X-Forwarded-For 时，客户端伪造的 Forwarded 不能生效
+func TestClientIPIgnoresUnconfiguredHeader(t *testing.T) {
+	h := http.Header{
+		"X-Forwarded-For": {"203.0.113.9"},
+		"Forwarded":       {"for=198.51.100.66"},
+	}
+	if ip := clientIP(t, "", h); ip != "203.0.113.9" {
+		t.Fatalf("xff mode expected 203.0.113.9,got %s", ip)
+	}
+	if ip := clientIP(t, HeaderForwarded, h); ip != "198.51.100.66" {
+		t.Fatalf("forwarded mode expected 198.51.100.66,got %s", ip)
+	}
+	if ip := clientIP(t, HeaderForwarded, http.Header{"X-Forwarded-For": {"203.0.113.9"}}); ip != "10.0.0.1" {
+		t.Fatalf("forwarded mode should not read X-Forwarded-For,got %s", ip)
+	}
+}
+
+func TestClientIPForwardedValues(t *testing.T) {
+	cases := map[string]string{
+		`for=192.0.2.43, for=10.0.0.2`:                         "192.0.2.43",
+		`for="[2001:db8:cafe::17]:4711";proto=https`:           "2001:db8:cafe::17",
+		`For="192.0.2.60:8080";by=10.0.0.2`:                    "192.0.2.60",
+		`for=unknown, for=10.0.0.2`:                            "10.0.0.2",
+		`for="_gazonk", for=10.0.0.2`:                          "10.0.0.2",
+		`for=198.51.100.1, for=_hidden, for=10.0.0.2`:          "10.0.0.2",
+		`for=198.51.100.1;proto=http, for="[::ffff:10.0.0.3]"`: "198.51.100.1",
+	}
+	for forwarded, want := range cases {
+		if ip := clientIP(t, HeaderForwarded, http.Header{"Forwarded": {forwarded}}); ip != want {
+			t.Errorf("Forwarded %q expected %s,got %s", forwarded, want, ip)
+		}
+	}
+}
+
+func TestClientIPUntrustedRemote(t *testing.T) {
+	trusted, _ := NewTrusted([]string{"10.0.0.0/8"}, HeaderXFF)
+	req := &http.Request{RemoteAddr: "203.0.113.5:5000", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}}
+	if ip := trusted.ClientIP(req); ip != "203.0.113.5" {
+		t.Fatalf("untrusted remote expected 203.0.113.5,got %s", ip)
+	}
+	if _, err := NewTrusted(nil, "x-real-ip"); err == nil {
+		t.Fatal("unknown client ip header should be rejected")
+	}
+}
@@ -5,9 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"mini-gateway/admin"
 	"mini-gateway/client"
+	"mini-gateway/clientip"
 	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/metrics"
 	"mini-gateway/proxy"
+	"mini-gateway/retry"
 	"mini-gateway/router"
 	"mini-gateway/server"
 	"mini-gateway/slog"
@@ -15,16 +20,31 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	_ "mini-gateway/discovery/consul"
+	_ "mini-gateway/discovery/dns"
+	_ "mini-gateway/discovery/etcd"
+	_ "mini-gateway/discovery/file"
+	_ "mini-gateway/discovery/kubernetes"
+	_ "mini-gateway/loadbalance/consistenthash"
+	_ "mini-gateway/loadbalance/ewma"
+	_ "mini-gateway/loadbalance/leastrequest"
 	_ "mini-gateway/loadbalance/rotation"
 	_ "mini-gateway/loadbalance/weight"
+	_ "mini-gateway/middleware/apikey"
+	_ "mini-gateway/middleware/basicauth"
 	_ "mini-gateway/middleware/color"
 	_ "mini-gateway/middleware/cors"
+	_ "mini-gateway/middleware/forwardauth"
 	_ "mini-gateway/middleware/forwarding"
+	_ "mini-gateway/middleware/ipfilter"
 	_ "mini-gateway/middleware/jwt"
 	_ "mini-gateway/middleware/logging"
+	_ "mini-gateway/middleware/oidc"
+	_ "mini-gateway/middleware/ratelimit"
 	_ "mini-gateway/middleware/stripprefix"
 )
 
@@ -56,21 +76,38 @@ func main() {
 		return
 	}
 
+	retry.InitBudget(retry.NewBudget(c.Http.RetryBudget))
+	trusted, err := clientip.NewTrusted(c.Http.TrustedProxies, c.Http.ClientIPHeader)
+	if err != nil {
+		slog.Fatal(err.Error())
+		return
+	}
+	clientip.InitTrusted(trusted)
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Http.Port))
 	if err != nil {
 		slog.Fatal(err.Error())
 		return
 	}
 
-	p := proxy.NewProxy(client.NewFactory(nil), router.NewDefaultRouter())
+	p := proxy.NewProxy(client.NewFactory(discovery.NewSchemeResolver()), router.NewDefaultRouter())
 	err = p.UpdateEndpoints(c.Http.Middlewares, c.Http.Endpoints)
 	if err != nil {
 		slog.Fatal(err.Error())
 		return
 	}
 
-	slog.Info(" Listening and serving HTTP on %s", listener.Addr().String())
-	serv := server.NewHttpServer(p)
+	opts := make([]server.Option, 0)
+	if c.Http.TLS != nil {
+		opts = append(opts, server.WithTLS(c.Http.TLS))
+		slog.Info(" Listening and serving HTTPS on %s", listener.Addr().String())
+	} else {
+		slog.Info(" Listening and serving HTTP on %s", listener.Addr().String())
+	}
+	if c.Http.H2c {
+		opts = append(opts, server.WithH2C())
+	}
+	serv := server.NewHttpServer(p, opts...)
 	go func() {
 		err := serv.Run(listener)
 		if err != nil && err != http.ErrServerClosed {
@@ -79,6 +116,56 @@ func main() {
 		}
 	}()
 
+	var adminServ *server.HttpServer
+	if c.Admin != nil && c.Admin.Port > 0 {
+		host := c.Admin.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if c.Admin.Token == "" && !isLoopback(host) {
+			slog.Fatal("admin token cannot be empty when admin listens on %s", host)
+			return
+		}
+		adminListener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(c.Admin.Port)))
+		if err != nil {
+			slog.Fatal(err.Error())
+			return
+		}
+		slog.Info(" Listening and serving admin HTTP on %s", adminListener.Addr().String())
+		adminServ = server.NewHttpServer(admin.NewHandler(p, c.Admin))
+		go func() {
+			err := adminServ.Run(adminListener)
+			if err != nil && err != http.ErrServerClosed {
+				slog.Fatal(err.Error())
+				return
+			}
+		}()
+	}
+
+	var metricsServ *server.HttpServer
+	if c.Metrics != nil && c.Metrics.Port > 0 {
+		metricsListener, err := net.Listen("tcp", net.JoinHostPort(c.Metrics.Host, strconv.Itoa(c.Metrics.Port)))
+		if err != nil {
+			slog.Fatal(err.Error())
+			return
+		}
+		path := c.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, metrics.Handler())
+		slog.Info(" Listening and serving metrics HTTP on %s", metricsListener.Addr().String())
+		metricsServ = server.NewHttpServer(mux)
+		go func() {
+			err := metricsServ.Run(metricsListener)
+			if err != nil && err != http.ErrServerClosed {
+				slog.Fatal(err.Error())
+				return
+			}
+		}()
+	}
+
 	go func() {
 		fileInfo, err := os.Stat(configFile)
 		if err != nil {
@@ -100,30 +187,60 @@ func main() {
 				fileBytes, err := os.ReadFile(configFile)
 				if err != nil {
 					slog.Error(err.Error())
+					metrics.ConfigReloads.WithLabelValues("file", metrics.ReloadResult(err)).Inc()
 					continue
 				}
 				c = &config.Gateway{}
 				err = yaml.Unmarshal(fileBytes, &c)
 				if err != nil {
 					slog.Error("Error parsing YAML:", err)
+					metrics.ConfigReloads.WithLabelValues("file", metrics.ReloadResult(err)).Inc()
+					continue
+				}
+				trusted, err := clientip.NewTrusted(c.Http.TrustedProxies, c.Http.ClientIPHeader)
+				if err != nil {
+					slog.Error(err.Error())
+					metrics.ConfigReloads.WithLabelValues("file", metrics.ReloadResult(err)).Inc()
 					continue
 				}
 				err = p.UpdateEndpoints(c.Http.Middlewares, c.Http.Endpoints)
+				metrics.ConfigReloads.WithLabelValues("file", metrics.ReloadResult(err)).Inc()
 				if err != nil {
 					slog.Error(err.Error())
-					return
+					continue
 				}
+				retry.InitBudget(retry.NewBudget(c.Http.RetryBudget))
+				clientip.InitTrusted(trusted)
 			}
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	<-quit
 	slog.Info("Shutdown Server ...")
+	if adminServ != nil {
+		if err := adminServ.Shutdown(context.Background()); err != nil {
+			slog.Error("Admin Server Shutdown: %s", err.Error())
+		}
+	}
+	if metricsServ != nil {
+		if err := metricsServ.Shutdown(context.Background()); err != nil {
+			slog.Error("Metrics Server Shutdown: %s", err.Error())
+		}
+	}
 	if err := serv.Shutdown(context.Background()); err != nil {
 		slog.Fatal("Server Shutdown:", err)
 	}
 
 	slog.Info("Server exiting")
 }
+
+// isLoopback 监听地址是否只能本机访问
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
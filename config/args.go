@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// ArgKind 中间件参数的类型，与工厂方法中的类型断言对应
+type ArgKind int
+
+const (
+	ArgString ArgKind = iota + 1
+	ArgInt
+	ArgBool
+	// ArgStringMap 值为字符串的 map
+	ArgStringMap
+	ArgList
+)
+
+func (k ArgKind) String() string {
+	switch k {
+	case ArgString:
+		return "string"
+	case ArgInt:
+		return "integer"
+	case ArgBool:
+		return "bool"
+	case ArgStringMap:
+		return "map of string"
+	case ArgList:
+		return "list"
+	}
+	return "unknown"
+}
+
+var argKinds = sync.Map{}
+
+// RegisterArgs 注册中间件参数的类型，Validate 时校验，避免错误的参数类型导致工厂方法 panic
+func RegisterArgs(name string, kinds map[string]ArgKind) {
+	argKinds.Store(name, kinds)
+}
+
+// validateArgs 只校验已注册的参数，未注册的中间件或参数不校验
+func (m *Middleware) validateArgs() error {
+	v, ok := argKinds.Load(m.Name)
+	if !ok {
+		return nil
+	}
+	kinds := v.(map[string]ArgKind)
+	for name, arg := range m.Args {
+		kind, ok := kinds[name]
+		if !ok {
+			continue
+		}
+		valid := false
+		switch kind {
+		case ArgString:
+			_, valid = arg.(string)
+		case ArgInt:
+			_, valid = arg.(int)
+		case ArgBool:
+			_, valid = arg.(bool)
+		case ArgList:
+			_, valid = arg.([]interface{})
+		case ArgStringMap:
+			var mv map[string]interface{}
+			if mv, valid = arg.(map[string]interface{}); valid {
+				for _, v := range mv {
+					if _, ok := v.(string); !ok {
+						valid = false
+						break
+					}
+				}
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%s middleware arg %s must be %s", m.Name, name, kind.String())
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML yaml 解析出的嵌套 map 为 map[interface{}]interface{}，统一转换为 map[string]interface{}
+func (m *Middleware) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type middleware Middleware
+	var c middleware
+	if err := unmarshal(&c); err != nil {
+		return err
+	}
+	c.Args = normalizeArgs(c.Args)
+	*m = Middleware(c)
+	return nil
+}
+
+// UnmarshalJSON json 解析出的数字为 float64，整数统一转换为 int 与 yaml 保持一致
+func (m *Middleware) UnmarshalJSON(data []byte) error {
+	type middleware Middleware
+	var c middleware
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	c.Args = normalizeArgs(c.Args)
+	*m = Middleware(c)
+	return nil
+}
+
+// UnmarshalYAML 断言条件的值可以是嵌套 map，与中间件参数一样统一转换
+func (p *Predicates) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type predicates Predicates
+	var c predicates
+	if err := unmarshal(&c); err != nil {
+		return err
+	}
+	c.Headers = normalizeArgs(c.Headers)
+	c.Query = normalizeArgs(c.Query)
+	c.Cookies = normalizeArgs(c.Cookies)
+	*p = Predicates(c)
+	return nil
+}
+
+func normalizeArgs(args map[string]interface{}) map[string]interface{} {
+	if args == nil {
+		return nil
+	}
+	for k, v := range args {
+		args[k] = normalizeValue(v)
+	}
+	return args
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[fmt.Sprint(k)] = normalizeValue(v)
+		}
+		return m
+	case map[string]interface{}:
+		return normalizeArgs(val)
+	case []interface{}:
+		for i := range val {
+			val[i] = normalizeValue(val[i])
+		}
+		return val
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) <= math.MaxInt32 {
+			return int(val)
+		}
+	}
+	return v
+}
@@ -1,40 +1,208 @@
 package config
 
 type Gateway struct {
-	Http *Http `yaml:"http"`
+	Http    *Http    `yaml:"http" json:"http,omitempty"`
+	Admin   *Admin   `yaml:"admin" json:"admin,omitempty"`
+	Metrics *Metrics `yaml:"metrics" json:"metrics,omitempty"`
+}
+
+// Metrics 独立的指标端口，不需要 token，path 默认 /metrics
+type Metrics struct {
+	Host string `yaml:"host" json:"host,omitempty"`
+	Port int    `yaml:"port" json:"port,omitempty"`
+	Path string `yaml:"path" json:"path,omitempty"`
+}
+
+// Admin 管理接口配置，token 不为空时请求需要携带 Authorization: Bearer <token>
+//
+//	host 监听地址，默认 127.0.0.1，token 为空时只允许监听回环地址
+type Admin struct {
+	Host  string `yaml:"host" json:"host,omitempty"`
+	Port  int    `yaml:"port" json:"port,omitempty"`
+	Token string `yaml:"token" json:"-"`
 }
 
 type Http struct {
-	Port        int           `yaml:"port"`
-	Middlewares []*Middleware `yaml:"middlewares"`
-	Endpoints   []*Endpoint   `yaml:"endpoints"`
+	Port        int          `yaml:"port" json:"port,omitempty"`
+	TLS         *TLS         `yaml:"tls" json:"tls,omitempty"`
+	H2c         bool         `yaml:"h2c" json:"h2c,omitempty"`
+	RetryBudget *RetryBudget `yaml:"retryBudget" json:"retryBudget,omitempty"`
+	// TrustedProxies 可信代理的 CIDR 或 IP，直连地址在其中时才从 ClientIPHeader 取客户端地址
+	TrustedProxies []string `yaml:"trustedProxies" json:"trustedProxies,omitempty"`
+	// ClientIPHeader 可信代理写入客户端地址的请求头：xff（默认）使用 X-Forwarded-For，forwarded 使用 Forwarded，只读取其中一个
+	ClientIPHeader string        `yaml:"clientIPHeader" json:"clientIPHeader,omitempty"`
+	Middlewares    []*Middleware `yaml:"middlewares" json:"middlewares,omitempty"`
+	Endpoints      []*Endpoint   `yaml:"endpoints" json:"endpoints,omitempty"`
+}
+
+// TLS 监听端口的 TLS 配置，按 SNI 选择证书，证书文件变化后自动重新加载
+type TLS struct {
+	Certificates []*Certificate `yaml:"certificates" json:"certificates,omitempty"`
+	MinVersion   string         `yaml:"minVersion" json:"minVersion,omitempty"`
+	CipherSuites []string       `yaml:"cipherSuites" json:"cipherSuites,omitempty"`
+	Alpn         []string       `yaml:"alpn" json:"alpn,omitempty"`
+}
+
+type Certificate struct {
+	CertFile string `yaml:"certFile" json:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile,omitempty"`
 }
 
 type Endpoint struct {
-	ID          string        `yaml:"id"`
-	Targets     []*Target     `yaml:"targets"`
-	Discovery   string        `yaml:"discovery"`
-	Protocol    string        `yaml:"protocol"`
-	Timeout     int           `yaml:"timeout"`
-	LoadBalance string        `yaml:"loadBalance"`
-	Predicates  *Predicates   `yaml:"predicates"`
-	Middlewares []*Middleware `yaml:"middlewares"`
+	ID          string    `yaml:"id" json:"id,omitempty"`
+	Targets     []*Target `yaml:"targets" json:"targets,omitempty"`
+	Discovery   string    `yaml:"discovery" json:"discovery,omitempty"`
+	Protocol    string    `yaml:"protocol" json:"protocol,omitempty"`
+	Timeout     int       `yaml:"timeout" json:"timeout,omitempty"`
+	LoadBalance string    `yaml:"loadBalance" json:"loadBalance,omitempty"`
+	// HashOn 一致性哈希的 key：ip | header:<name> | cookie:<name> | query:<name> | param:<name>
+	HashOn string `yaml:"hashOn" json:"hashOn,omitempty"`
+	// SlowStart 新加入节点的慢启动，只有 weight 负载均衡支持
+	SlowStart *SlowStart `yaml:"slowStart" json:"slowStart,omitempty"`
+	// TagRouting 按节点标签选择节点，没有配置时按 color 标签
+	TagRouting *TagRouting `yaml:"tagRouting" json:"tagRouting,omitempty"`
+	// Mirror 流量镜像
+	Mirror     *Mirror     `yaml:"mirror" json:"mirror,omitempty"`
+	Predicates *Predicates `yaml:"predicates" json:"predicates,omitempty"`
+	// Priority 同一路径下有多个端点时优先级大的先匹配，相同时按 id 排序
+	Priority       int             `yaml:"priority" json:"priority,omitempty"`
+	Middlewares    []*Middleware   `yaml:"middlewares" json:"middlewares,omitempty"`
+	HealthCheck    *HealthCheck    `yaml:"healthCheck" json:"healthCheck,omitempty"`
+	CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker" json:"circuitBreaker,omitempty"`
+	Retry          *Retry          `yaml:"retry" json:"retry,omitempty"`
+	TLS            *UpstreamTLS    `yaml:"tls" json:"tls,omitempty"`
+	Transport      *Transport      `yaml:"transport" json:"transport,omitempty"`
+	// MaxBodySize 请求体最大字节数，超过返回 413，0 表示不限制
+	MaxBodySize int64 `yaml:"maxBodySize" json:"maxBodySize,omitempty"`
+	// MaxBufferSize 需要重放请求体时最多缓存的字节数，超过后退化为流式转发
+	MaxBufferSize int64 `yaml:"maxBufferSize" json:"maxBufferSize,omitempty"`
+}
+
+// SlowStart 新节点的权重在 Window 毫秒内从 MinWeightPercent% 线性增加到配置的权重
+type SlowStart struct {
+	Window           int `yaml:"window" json:"window,omitempty"`
+	MinWeightPercent int `yaml:"minWeightPercent" json:"minWeightPercent,omitempty"`
+}
+
+// TagRouting 节点按 Tags 的值划分分区，请求的标签没有节点时按 Fallback 依次尝试其他分区，
+// 多个标签的值按顺序用逗号连接作为分区的 key。
+// Policy 为都没有节点时的处理：fail 返回错误（默认），fallback 使用没有标签的节点，any 使用所有节点
+type TagRouting struct {
+	Tags     []string            `yaml:"tags" json:"tags,omitempty"`
+	Fallback map[string][]string `yaml:"fallback" json:"fallback,omitempty"`
+	Policy   string              `yaml:"policy" json:"policy,omitempty"`
+}
+
+// Mirror 按百分比复制请求异步发送到另一个端点或一组节点，丢弃响应，不影响原请求。
+// 请求体超过 MaxBufferSize 时不镜像
+type Mirror struct {
+	// Endpoint 镜像到的端点 id，与 Targets 二选一，使用该端点的节点和负载均衡，不经过其中间件
+	Endpoint string    `yaml:"endpoint" json:"endpoint,omitempty"`
+	Targets  []*Target `yaml:"targets" json:"targets,omitempty"`
+	// Percentage 镜像的请求百分比，默认 100
+	Percentage *float64 `yaml:"percentage" json:"percentage,omitempty"`
+	// Timeout 镜像请求的超时时间，单位毫秒，默认 5000
+	Timeout int `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// UpstreamTLS 连接上游时的 TLS 配置，配置客户端证书即为双向认证
+type UpstreamTLS struct {
+	CaFile             string `yaml:"caFile" json:"caFile,omitempty"`
+	CertFile           string `yaml:"certFile" json:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile" json:"keyFile,omitempty"`
+	ServerName         string `yaml:"serverName" json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" json:"insecureSkipVerify,omitempty"`
+}
+
+// Transport 端点独立的上游连接池配置，时间单位为毫秒
+type Transport struct {
+	DialTimeout           int `yaml:"dialTimeout" json:"dialTimeout,omitempty"`
+	KeepAlive             int `yaml:"keepAlive" json:"keepAlive,omitempty"`
+	TLSHandshakeTimeout   int `yaml:"tlsHandshakeTimeout" json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout int `yaml:"responseHeaderTimeout" json:"responseHeaderTimeout,omitempty"`
+	IdleConnTimeout       int `yaml:"idleConnTimeout" json:"idleConnTimeout,omitempty"`
+	MaxIdleConns          int `yaml:"maxIdleConns" json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost   int `yaml:"maxIdleConnsPerHost" json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost       int `yaml:"maxConnsPerHost" json:"maxConnsPerHost,omitempty"`
+	ReadBufferSize        int `yaml:"readBufferSize" json:"readBufferSize,omitempty"`
+	WriteBufferSize       int `yaml:"writeBufferSize" json:"writeBufferSize,omitempty"`
+	PingInterval          int `yaml:"pingInterval" json:"pingInterval,omitempty"`
+	PingTimeout           int `yaml:"pingTimeout" json:"pingTimeout,omitempty"`
 }
 
 type Target struct {
-	Uri    string            `yaml:"uri"`
-	Weight int               `yaml:"weight"`
-	Tags   map[string]string `yaml:"tags"`
+	Uri    string            `yaml:"uri" json:"uri,omitempty"`
+	Weight int               `yaml:"weight" json:"weight,omitempty"`
+	Tags   map[string]string `yaml:"tags" json:"tags,omitempty"`
 }
 
+// Predicates 路由断言，所有条件都满足时才匹配。
+// header、query、cookie 的值为字符串时精确匹配，为布尔值时只检查是否存在，
+// 也可以是 {exact: x, regex: x, present: true} 的形式
 type Predicates struct {
-	Path    string                 `yaml:"path"`
-	Method  string                 `yaml:"method"`
-	Headers map[string]interface{} `yaml:"header"`
+	Path    string                 `yaml:"path" json:"path,omitempty"`
+	Method  string                 `yaml:"method" json:"method,omitempty"`
+	Headers map[string]interface{} `yaml:"header" json:"header,omitempty"`
+	// Host 多个用逗号分隔，支持 *.example.com 形式的通配
+	Host string `yaml:"host" json:"host,omitempty"`
+	// Sni TLS 握手时的服务器名称，格式同 Host
+	Sni     string                 `yaml:"sni" json:"sni,omitempty"`
+	Query   map[string]interface{} `yaml:"query" json:"query,omitempty"`
+	Cookies map[string]interface{} `yaml:"cookie" json:"cookie,omitempty"`
+	// RemoteAddr 多个 CIDR 或 IP 用逗号分隔
+	RemoteAddr string `yaml:"remoteAddr" json:"remoteAddr,omitempty"`
+	// After、Before RFC3339 格式的时间，只在时间窗口内匹配
+	After  string           `yaml:"after" json:"after,omitempty"`
+	Before string           `yaml:"before" json:"before,omitempty"`
+	Weight *WeightPredicate `yaml:"weight" json:"weight,omitempty"`
+}
+
+// WeightPredicate 同一分组的路由按权重比例分配请求，用于灰度发布
+type WeightPredicate struct {
+	Group  string `yaml:"group" json:"group,omitempty"`
+	Weight int    `yaml:"weight" json:"weight,omitempty"`
 }
 
 type Middleware struct {
-	Name  string                 `yaml:"name"`
-	Order int                    `yaml:"order"`
-	Args  map[string]interface{} `yaml:"args"`
+	Name  string                 `yaml:"name" json:"name,omitempty"`
+	Order int                    `yaml:"order" json:"order,omitempty"`
+	Args  map[string]interface{} `yaml:"args" json:"args,omitempty"`
+}
+
+// HealthCheck 主动健康检查配置，时间单位为毫秒
+type HealthCheck struct {
+	Type               string `yaml:"type" json:"type,omitempty"`
+	Path               string `yaml:"path" json:"path,omitempty"`
+	Service            string `yaml:"service" json:"service,omitempty"`
+	Interval           int    `yaml:"interval" json:"interval,omitempty"`
+	Timeout            int    `yaml:"timeout" json:"timeout,omitempty"`
+	HealthyThreshold   int    `yaml:"healthyThreshold" json:"healthyThreshold,omitempty"`
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold" json:"unhealthyThreshold,omitempty"`
+}
+
+// CircuitBreaker 被动异常检测及熔断配置，时间单位为毫秒
+type CircuitBreaker struct {
+	Consecutive5xx     int `yaml:"consecutive5xx" json:"consecutive5xx,omitempty"`
+	ConsecutiveErrors  int `yaml:"consecutiveErrors" json:"consecutiveErrors,omitempty"`
+	BaseEjectionTime   int `yaml:"baseEjectionTime" json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime    int `yaml:"maxEjectionTime" json:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent int `yaml:"maxEjectionPercent" json:"maxEjectionPercent,omitempty"`
+}
+
+// Retry 端点重试策略，时间单位为毫秒
+type Retry struct {
+	Attempts      int      `yaml:"attempts" json:"attempts,omitempty"`
+	PerTryTimeout int      `yaml:"perTryTimeout" json:"perTryTimeout,omitempty"`
+	RetryOn       []string `yaml:"retryOn" json:"retryOn,omitempty"`
+	StatusCodes   []int    `yaml:"statusCodes" json:"statusCodes,omitempty"`
+	Methods       []string `yaml:"methods" json:"methods,omitempty"`
+	BaseInterval  int      `yaml:"baseInterval" json:"baseInterval,omitempty"`
+	MaxInterval   int      `yaml:"maxInterval" json:"maxInterval,omitempty"`
+}
+
+// RetryBudget 全局重试预算，限制重试请求占总请求的比例
+type RetryBudget struct {
+	Ratio               float64 `yaml:"ratio" json:"ratio,omitempty"`
+	MinRetriesPerSecond int     `yaml:"minRetriesPerSecond" json:"minRetriesPerSecond,omitempty"`
+	Window              int     `yaml:"window" json:"window,omitempty"`
 }
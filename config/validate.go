@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"mini-gateway/router/trie"
+	"net/url"
+	"strings"
+)
+
+// Validate 校验端点配置，只做结构上的检查
+func (e *Endpoint) Validate() error {
+	if strings.TrimSpace(e.ID) == "" {
+		return errors.New("endpoint id cannot be empty")
+	}
+	if e.Predicates == nil || strings.TrimSpace(e.Predicates.Path) == "" {
+		return fmt.Errorf("endpoint predicates path cannot be empty,id:%s", e.ID)
+	}
+	for _, p := range trie.SplitPaths(e.Predicates.Path) {
+		if err := trie.ValidatePath(p); err != nil {
+			return fmt.Errorf("%s,id:%s", err.Error(), e.ID)
+		}
+	}
+	if len(e.Targets) == 0 && strings.TrimSpace(e.Discovery) == "" {
+		return fmt.Errorf("endpoint targets and discovery cannot both be empty,id:%s", e.ID)
+	}
+	for _, t := range e.Targets {
+		if t == nil {
+			return fmt.Errorf("endpoint target cannot be null,id:%s", e.ID)
+		}
+		u, err := url.Parse(t.Uri)
+		if err != nil {
+			return fmt.Errorf("endpoint target uri %s is invalid,id:%s,error:%s", t.Uri, e.ID, err.Error())
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("endpoint target uri %s must contain scheme and host,id:%s", t.Uri, e.ID)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("endpoint target weight cannot be negative,id:%s", e.ID)
+		}
+	}
+	switch strings.ToLower(e.Protocol) {
+	case "", "http", "grpc":
+	default:
+		return fmt.Errorf("endpoint protocol %s is not supported,id:%s", e.Protocol, e.ID)
+	}
+	if e.Timeout < 0 {
+		return fmt.Errorf("endpoint timeout cannot be negative,id:%s", e.ID)
+	}
+	if e.HealthCheck != nil {
+		switch strings.ToLower(e.HealthCheck.Type) {
+		case "", "http", "grpc", "tcp":
+		default:
+			return fmt.Errorf("endpoint health check type %s is not supported,id:%s", e.HealthCheck.Type, e.ID)
+		}
+	}
+	if e.HashOn != "" {
+		kind, name, _ := strings.Cut(e.HashOn, ":")
+		switch kind {
+		case "ip":
+		case "header", "cookie", "query", "param":
+			if name == "" {
+				return fmt.Errorf("endpoint hashOn %s must contain a name,id:%s", e.HashOn, e.ID)
+			}
+		default:
+			return fmt.Errorf("endpoint hashOn %s is not supported,id:%s", e.HashOn, e.ID)
+		}
+	}
+	if e.TagRouting != nil {
+		switch e.TagRouting.Policy {
+		case "", "fail", "fallback", "any":
+		default:
+			return fmt.Errorf("endpoint tag routing policy %s is not supported,id:%s", e.TagRouting.Policy, e.ID)
+		}
+	}
+	if e.Mirror != nil {
+		if (e.Mirror.Endpoint == "") == (len(e.Mirror.Targets) == 0) {
+			return fmt.Errorf("endpoint mirror must contain either endpoint or targets,id:%s", e.ID)
+		}
+		if e.Mirror.Endpoint == e.ID {
+			return fmt.Errorf("endpoint cannot mirror to itself,id:%s", e.ID)
+		}
+		if pct := e.Mirror.Percentage; pct != nil && (*pct < 0 || *pct > 100) {
+			return fmt.Errorf("endpoint mirror percentage must be between 0 and 100,id:%s", e.ID)
+		}
+	}
+	for _, m := range e.Middlewares {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("%s,id:%s", err.Error(), e.ID)
+		}
+	}
+	return nil
+}
+
+func (m *Middleware) Validate() error {
+	if m == nil {
+		return errors.New("middleware cannot be null")
+	}
+	if strings.TrimSpace(m.Name) == "" {
+		return errors.New("middleware name cannot be empty")
+	}
+	return m.validateArgs()
+}
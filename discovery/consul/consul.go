@@ -0,0 +1,196 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mini-gateway/discovery"
+	"mini-gateway/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCHEME consul://127.0.0.1:8500/api-service?dc=dc1&tag=v1&token=xxx
+//
+// 通过 /v1/health/service 的阻塞查询监听健康的服务实例，实例的 Meta 和 key=value 形式的 Tags 作为节点标签。
+// 参数 scheme 为节点的协议，默认 http；tls=true 时使用 https 访问 consul；wait 为阻塞查询的最长时间，单位毫秒
+const SCHEME = "consul"
+
+// 默认阻塞查询的最长时间
+const defaultWait = 5 * time.Minute
+
+func init() {
+	discovery.Register(SCHEME, &resolver{client: &http.Client{}})
+}
+
+type resolver struct {
+	client *http.Client
+}
+
+type target struct {
+	api     string
+	service string
+	query   url.Values
+	token   string
+	scheme  string
+	wait    time.Duration
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (r *resolver) Resolve(ctx context.Context, desc string) (*discovery.Result, error) {
+	t, err := parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	result, _, err := r.fetch(ctx, t, 0)
+	return result, err
+}
+
+func (r *resolver) Watch(ctx context.Context, desc string, callBack func(*discovery.Result)) error {
+	t, err := parse(desc)
+	if err != nil {
+		return err
+	}
+	last, index, err := r.fetch(ctx, t, 0)
+	if err != nil {
+		return err
+	}
+	go func() {
+		failures := 0
+		for ctx.Err() == nil {
+			result, newIndex, err := r.fetch(ctx, t, index)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failures++
+				slog.Error("discovery %s watch failed,error:%s", discovery.Redact(desc), err.Error())
+				discovery.Sleep(ctx, discovery.RetryDelay(failures))
+				continue
+			}
+			failures = 0
+			// 索引回退时重新开始阻塞查询
+			if newIndex < index {
+				newIndex = 0
+			}
+			index = newIndex
+			if discovery.Equal(last, result) {
+				continue
+			}
+			last = result
+			callBack(result)
+		}
+	}()
+	return nil
+}
+
+func parse(desc string) (*target, error) {
+	u, err := url.Parse(desc)
+	if err != nil {
+		return nil, discovery.InvalidError(desc, err)
+	}
+	q := u.Query()
+	t := &target{
+		service: strings.Trim(u.Path, "/"),
+		token:   q.Get("token"),
+		scheme:  q.Get("scheme"),
+		wait:    discovery.Millis(q, "wait", defaultWait),
+		query:   url.Values{"passing": []string{"true"}},
+	}
+	if u.Host == "" || t.service == "" {
+		return nil, fmt.Errorf("discovery %s must contain consul address and service name", discovery.Redact(desc))
+	}
+	api := "http"
+	if q.Get("tls") == "true" {
+		api = "https"
+	}
+	t.api = fmt.Sprintf("%s://%s/v1/health/service/%s", api, u.Host, url.PathEscape(t.service))
+	if t.scheme == "" {
+		t.scheme = "http"
+	}
+	for _, k := range []string{"dc", "tag", "near", "node-meta"} {
+		for _, v := range q[k] {
+			t.query.Add(k, v)
+		}
+	}
+	return t, nil
+}
+
+// fetch index 大于 0 时为阻塞查询，直到服务有变化或超过 wait
+func (r *resolver) fetch(ctx context.Context, t *target, index uint64) (*discovery.Result, uint64, error) {
+	q := url.Values{}
+	for k, v := range t.query {
+		q[k] = v
+	}
+	timeout := 10 * time.Second
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", fmt.Sprintf("%dms", t.wait.Milliseconds()))
+		// consul 会在 wait 的基础上增加随机的抖动
+		timeout += t.wait + t.wait/16
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.api+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if t.token != "" {
+		req.Header.Set("X-Consul-Token", t.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul responded with status %d", resp.StatusCode)
+	}
+	var entries []*serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	nodes := make([]discovery.Node, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		weight := e.Service.Weights.Passing
+		if weight <= 0 {
+			weight = 1
+		}
+		tags := make(map[string]string, len(e.Service.Meta)+len(e.Service.Tags))
+		for _, tag := range e.Service.Tags {
+			if k, v, ok := strings.Cut(tag, "="); ok {
+				tags[k] = v
+			}
+		}
+		for k, v := range e.Service.Meta {
+			tags[k] = v
+		}
+		uri := fmt.Sprintf("%s://%s", t.scheme, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+		nodes = append(nodes, discovery.NewNode(uri, weight, tags))
+	}
+	return &discovery.Result{Nodes: nodes}, newIndex, nil
+}
@@ -2,13 +2,106 @@ package discovery
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 )
 
+const redacted = "xxxxx"
+
+// secretParams desc 中需要脱敏的参数，比如 consul 的 token、etcd 的 username 和 password
+var secretParams = map[string]bool{"token": true, "username": true, "password": true, "secret": true}
+
+var resolvers = sync.Map{}
+
+// Resolver desc 为端点的 discovery 配置，Watch 不阻塞，ctx 取消后停止监听
 type Resolver interface {
 	Resolve(ctx context.Context, desc string) (*Result, error)
 	Watch(ctx context.Context, desc string, callBack func(*Result)) error
 }
 
+// Register 按 scheme 注册 Resolver，比如 dns、file、consul
+func Register(scheme string, r Resolver) {
+	resolvers.Store(strings.ToLower(scheme), r)
+}
+
+func GetResolver(scheme string) (r Resolver, ok bool) {
+	v, ok := resolvers.Load(strings.ToLower(scheme))
+	if !ok {
+		return nil, ok
+	}
+	return v.(Resolver), ok
+}
+
+// NewSchemeResolver 根据 desc 的 scheme 选择已注册的 Resolver
+func NewSchemeResolver() Resolver {
+	return schemeResolver{}
+}
+
+type schemeResolver struct{}
+
+func (schemeResolver) Resolve(ctx context.Context, desc string) (*Result, error) {
+	r, err := lookup(desc)
+	if err != nil {
+		return nil, err
+	}
+	return r.Resolve(ctx, desc)
+}
+
+func (schemeResolver) Watch(ctx context.Context, desc string, callBack func(*Result)) error {
+	r, err := lookup(desc)
+	if err != nil {
+		return err
+	}
+	return r.Watch(ctx, desc, callBack)
+}
+
+func lookup(desc string) (Resolver, error) {
+	u, err := url.Parse(strings.TrimSpace(desc))
+	if err != nil {
+		return nil, InvalidError(desc, err)
+	}
+	r, ok := GetResolver(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("discovery resolver for scheme %s not found", u.Scheme)
+	}
+	return r, nil
+}
+
+// Redact 隐藏 desc 中的用户信息和敏感参数，desc 出现在日志、错误和管理接口时使用
+func Redact(desc string) string {
+	u, err := url.Parse(strings.TrimSpace(desc))
+	if err != nil {
+		return "invalid discovery"
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	q := u.Query()
+	changed := false
+	for k := range q {
+		if secretParams[strings.ToLower(k)] {
+			q.Set(k, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// InvalidError desc 解析失败的错误，url.Parse 的错误中包含原始 desc，只保留原因
+func InvalidError(desc string, err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return fmt.Errorf("discovery %s is invalid,error:%s", Redact(desc), err.Error())
+}
+
 type Result struct {
 	Nodes []Node
 }
@@ -17,6 +110,7 @@ type Node interface {
 	Uri() string
 	Weight() int
 	Tag(key string) (value string, exist bool)
+	Tags() map[string]string
 }
 
 func NewNode(uri string, weight int, tags map[string]string) Node {
@@ -45,3 +139,7 @@ func (n *node) Tag(key string) (value string, exist bool) {
 	value, exist = n.tags[key]
 	return
 }
+
+func (n *node) Tags() map[string]string {
+	return n.tags
+}
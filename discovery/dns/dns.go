@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"mini-gateway/discovery"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCHEME 支持两种形式，authority 为空时使用系统的 DNS 服务器：
+//
+//	dns://[server:port]/_http._tcp.api.service.local  查询 SRV 记录，只使用优先级最高的一组记录
+//	dns://[server:port]/api.service.local:8080        查询 A/AAAA 记录，端口必须配置
+//
+// 参数 scheme 为节点的协议，默认 http；interval 为重新解析的间隔，单位毫秒
+const SCHEME = "dns"
+
+// 默认重新解析的间隔
+const defaultInterval = 30 * time.Second
+
+func init() {
+	discovery.Register(SCHEME, &resolver{})
+}
+
+type resolver struct{}
+
+type target struct {
+	server   string
+	name     string
+	port     string
+	scheme   string
+	interval time.Duration
+}
+
+func (r *resolver) Resolve(ctx context.Context, desc string) (*discovery.Result, error) {
+	t, err := parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	return t.resolve(ctx)
+}
+
+func (r *resolver) Watch(ctx context.Context, desc string, callBack func(*discovery.Result)) error {
+	t, err := parse(desc)
+	if err != nil {
+		return err
+	}
+	last, err := t.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	go discovery.Poll(ctx, desc, t.interval, last, t.resolve, callBack)
+	return nil
+}
+
+func parse(desc string) (*target, error) {
+	u, err := url.Parse(desc)
+	if err != nil {
+		return nil, discovery.InvalidError(desc, err)
+	}
+	t := &target{
+		server:   u.Host,
+		name:     strings.TrimPrefix(u.Path, "/"),
+		scheme:   u.Query().Get("scheme"),
+		interval: discovery.Millis(u.Query(), "interval", defaultInterval),
+	}
+	if t.scheme == "" {
+		t.scheme = "http"
+	}
+	if t.name == "" {
+		return nil, fmt.Errorf("discovery %s dns name cannot be empty", discovery.Redact(desc))
+	}
+	if !strings.HasPrefix(t.name, "_") {
+		host, port, err := net.SplitHostPort(t.name)
+		if err != nil {
+			return nil, fmt.Errorf("discovery %s must contain port or use a srv name", discovery.Redact(desc))
+		}
+		t.name, t.port = host, port
+	}
+	return t, nil
+}
+
+func (t *target) netResolver() *net.Resolver {
+	if t.server == "" {
+		return net.DefaultResolver
+	}
+	server := t.server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (t *target) resolve(ctx context.Context) (*discovery.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if t.port == "" {
+		return t.resolveSRV(ctx)
+	}
+	ips, err := t.netResolver().LookupIPAddr(ctx, t.name)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]discovery.Node, 0, len(ips))
+	for _, ip := range ips {
+		uri := fmt.Sprintf("%s://%s", t.scheme, net.JoinHostPort(ip.IP.String(), t.port))
+		nodes = append(nodes, discovery.NewNode(uri, 1, nil))
+	}
+	return &discovery.Result{Nodes: nodes}, nil
+}
+
+func (t *target) resolveSRV(ctx context.Context) (*discovery.Result, error) {
+	_, srvs, err := t.netResolver().LookupSRV(ctx, "", "", t.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(srvs) == 0 {
+		return &discovery.Result{}, nil
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+	nodes := make([]discovery.Node, 0, len(srvs))
+	for _, srv := range srvs {
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		weight := int(srv.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		uri := fmt.Sprintf("%s://%s", t.scheme, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		nodes = append(nodes, discovery.NewNode(uri, weight, nil))
+	}
+	return &discovery.Result{Nodes: nodes}, nil
+}
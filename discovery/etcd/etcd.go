@@ -0,0 +1,334 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCHEME etcd://127.0.0.1:2379/services/api-service/?scheme=http
+//
+// 通过 etcd v3 的 HTTP 网关读取并监听前缀下的所有 key，value 为 {"uri":"http://10.0.0.1:8080","weight":10,"tags":{}}
+// 形式的 json，也可以直接是 uri 或 host:port。
+// 参数 scheme 为 host:port 形式节点的协议，默认 http；tls=true 时使用 https 访问 etcd；
+// username 和 password 用于开启了认证的 etcd
+const SCHEME = "etcd"
+
+func init() {
+	discovery.Register(SCHEME, &resolver{client: &http.Client{}})
+}
+
+type resolver struct {
+	client *http.Client
+}
+
+type target struct {
+	api      string
+	prefix   string
+	rangeEnd string
+	scheme   string
+	username string
+	password string
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type responseHeader struct {
+	Revision string `json:"revision"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []*keyValue    `json:"kvs"`
+}
+
+type watchResponse struct {
+	Result *struct {
+		Header          responseHeader `json:"header"`
+		Canceled        bool           `json:"canceled"`
+		CompactRevision string         `json:"compact_revision"`
+		CancelReason    string         `json:"cancel_reason"`
+		Events          []*struct {
+			Type string    `json:"type"`
+			Kv   *keyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (r *resolver) Resolve(ctx context.Context, desc string) (*discovery.Result, error) {
+	t, err := parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	token, err := r.authenticate(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	kvs, _, err := r.list(ctx, t, token)
+	if err != nil {
+		return nil, err
+	}
+	return t.result(kvs), nil
+}
+
+func (r *resolver) Watch(ctx context.Context, desc string, callBack func(*discovery.Result)) error {
+	t, err := parse(desc)
+	if err != nil {
+		return err
+	}
+	token, err := r.authenticate(ctx, t)
+	if err != nil {
+		return err
+	}
+	kvs, revision, err := r.list(ctx, t, token)
+	if err != nil {
+		return err
+	}
+	go func() {
+		last := t.result(kvs)
+		failures := 0
+		for {
+			err := r.watch(ctx, t, token, revision+1, kvs, func() {
+				failures = 0
+				result := t.result(kvs)
+				if discovery.Equal(last, result) {
+					return
+				}
+				last = result
+				callBack(result)
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			slog.Error("discovery %s watch failed,error:%s", discovery.Redact(desc), err.Error())
+			if !discovery.Sleep(ctx, discovery.RetryDelay(failures)) {
+				return
+			}
+			// 重连后重新读取全部 key，避免遗漏断开期间的变化
+			if token, err = r.authenticate(ctx, t); err != nil {
+				continue
+			}
+			newKvs, newRevision, err := r.list(ctx, t, token)
+			if err != nil {
+				continue
+			}
+			kvs, revision = newKvs, newRevision
+			if result := t.result(kvs); !discovery.Equal(last, result) {
+				last = result
+				callBack(result)
+			}
+		}
+	}()
+	return nil
+}
+
+func parse(desc string) (*target, error) {
+	u, err := url.Parse(desc)
+	if err != nil {
+		return nil, discovery.InvalidError(desc, err)
+	}
+	q := u.Query()
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return nil, fmt.Errorf("discovery %s must contain etcd address and key prefix", discovery.Redact(desc))
+	}
+	api := "http"
+	if q.Get("tls") == "true" {
+		api = "https"
+	}
+	t := &target{
+		api:      fmt.Sprintf("%s://%s", api, u.Host),
+		prefix:   u.Path,
+		scheme:   q.Get("scheme"),
+		username: q.Get("username"),
+		password: q.Get("password"),
+	}
+	if t.scheme == "" {
+		t.scheme = "http"
+	}
+	t.rangeEnd = prefixRangeEnd(t.prefix)
+	return t, nil
+}
+
+// prefixRangeEnd 前缀的范围结束，最后一个不是 0xff 的字节加一并去掉之后的字节，全部是 0xff 时为 \x00 表示到末尾
+func prefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+func (r *resolver) post(ctx context.Context, t *target, path, token string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd responded with status %d,%s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (r *resolver) authenticate(ctx context.Context, t *target) (string, error) {
+	if t.username == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := r.post(ctx, t, "/v3/auth/authenticate", "", map[string]string{
+		"name":     t.username,
+		"password": t.password,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+	return auth.Token, nil
+}
+
+func (r *resolver) list(ctx context.Context, t *target, token string) (map[string]string, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := r.post(ctx, t, "/v3/kv/range", token, map[string]string{
+		"key":       encode(t.prefix),
+		"range_end": encode(t.rangeEnd),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var rr rangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return nil, 0, err
+	}
+	kvs := make(map[string]string, len(rr.Kvs))
+	for _, kv := range rr.Kvs {
+		kvs[decode(kv.Key)] = decode(kv.Value)
+	}
+	revision, _ := strconv.ParseInt(rr.Header.Revision, 10, 64)
+	return kvs, revision, nil
+}
+
+// watch 从 revision 开始监听前缀下的变化并更新 kvs，每批事件处理完后调用 changed，连接断开后返回
+func (r *resolver) watch(ctx context.Context, t *target, token string, revision int64, kvs map[string]string, changed func()) error {
+	resp, err := r.post(ctx, t, "/v3/watch", token, map[string]any{
+		"create_request": map[string]string{
+			"key":            encode(t.prefix),
+			"range_end":      encode(t.rangeEnd),
+			"start_revision": strconv.FormatInt(revision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var wr watchResponse
+		if err := decoder.Decode(&wr); err != nil {
+			return err
+		}
+		if wr.Error != nil {
+			return fmt.Errorf("etcd watch error,%s", wr.Error.Message)
+		}
+		if wr.Result == nil {
+			continue
+		}
+		if wr.Result.Canceled || wr.Result.CompactRevision != "" && wr.Result.CompactRevision != "0" {
+			return fmt.Errorf("etcd watch canceled,compact revision:%s,%s", wr.Result.CompactRevision, wr.Result.CancelReason)
+		}
+		if len(wr.Result.Events) == 0 {
+			continue
+		}
+		for _, e := range wr.Result.Events {
+			if e.Kv == nil {
+				continue
+			}
+			if e.Type == "DELETE" {
+				delete(kvs, decode(e.Kv.Key))
+			} else {
+				kvs[decode(e.Kv.Key)] = decode(e.Kv.Value)
+			}
+		}
+		changed()
+	}
+}
+
+func (t *target) result(kvs map[string]string) *discovery.Result {
+	nodes := make([]discovery.Node, 0, len(kvs))
+	for key, value := range kvs {
+		value = strings.TrimSpace(value)
+		target := &config.Target{}
+		if strings.HasPrefix(value, "{") {
+			if err := json.Unmarshal([]byte(value), target); err != nil {
+				slog.Warn("etcd key %s has invalid value,error:%s", key, err.Error())
+				continue
+			}
+		} else if strings.Contains(value, "://") {
+			target.Uri = value
+		} else {
+			target.Uri = t.scheme + "://" + value
+		}
+		if target.Uri == "" {
+			continue
+		}
+		if target.Weight <= 0 {
+			target.Weight = 1
+		}
+		nodes = append(nodes, discovery.NewNode(target.Uri, target.Weight, target.Tags))
+	}
+	return &discovery.Result{Nodes: nodes}
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func decode(s string) string {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
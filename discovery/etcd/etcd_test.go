@@ -0,0 +1,178 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"mini-gateway/discovery"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd etcd v3 HTTP 网关的替身，支持认证、range 和 watch
+type fakeEtcd struct {
+	t      *testing.T
+	mux    sync.Mutex
+	kvs    map[string]string
+	events chan string
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *httptest.Server) {
+	f := &fakeEtcd{t: t, kvs: make(map[string]string), events: make(chan string, 16)}
+	s := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(s.Close)
+	return f, s
+}
+
+func (f *fakeEtcd) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	if r.URL.Path == "/v3/auth/authenticate" {
+		if body["name"] != "root" || body["password"] != "pass" {
+			http.Error(w, `{"error":"authentication failed"}`, http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "tok"})
+		return
+	}
+	if r.Header.Get("Authorization") != "tok" {
+		http.Error(w, `{"error":"invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		key, end := decode(body["key"].(string)), decode(body["range_end"].(string))
+		f.mux.Lock()
+		kvs := make([]*keyValue, 0)
+		for k, v := range f.kvs {
+			if k >= key && (end == "\x00" || k < end) {
+				kvs = append(kvs, &keyValue{Key: encode(k), Value: encode(v)})
+			}
+		}
+		f.mux.Unlock()
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		_ = json.NewEncoder(w).Encode(map[string]any{"header": map[string]string{"revision": "7"}, "kvs": kvs})
+	case "/v3/watch":
+		create := body["create_request"].(map[string]any)
+		if create["start_revision"] != "8" {
+			f.t.Errorf("watch should start after the listed revision,got %v", create["start_revision"])
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-f.events:
+				_, _ = w.Write([]byte(e + "\n"))
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.mux.Lock()
+	f.kvs[key] = value
+	f.mux.Unlock()
+}
+
+func event(typ, key, value string) string {
+	b, _ := json.Marshal(map[string]any{"result": map[string]any{
+		"header": map[string]string{"revision": "8"},
+		"events": []map[string]any{{"type": typ, "kv": map[string]string{"key": encode(key), "value": encode(value)}}},
+	}})
+	return string(b)
+}
+
+func uris(r *discovery.Result) []string {
+	us := make([]string, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		us = append(us, n.Uri())
+	}
+	sort.Strings(us)
+	return us
+}
+
+func TestResolveAndWatch(t *testing.T) {
+	f, s := newFakeEtcd(t)
+	f.put("/services/api/1", `{"uri":"http://10.0.0.1:8080","weight":5,"tags":{"color":"blue"}}`)
+	f.put("/services/api/2", "10.0.0.2:8080")
+	f.put("/services/other/1", "10.0.0.9:8080")
+	desc := "etcd://" + strings.TrimPrefix(s.URL, "http://") + "/services/api/?username=root&password=pass"
+	r := &resolver{client: s.Client()}
+
+	result, err := r.Resolve(context.Background(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(uris(result), ","); got != "http://10.0.0.1:8080,http://10.0.0.2:8080" {
+		t.Fatalf("unexpected nodes %s", got)
+	}
+	for _, n := range result.Nodes {
+		if n.Uri() == "http://10.0.0.1:8080" {
+			if color, _ := n.Tag("color"); color != "blue" || n.Weight() != 5 {
+				t.Fatalf("unexpected node weight %d tags %v", n.Weight(), n.Tags())
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan *discovery.Result, 4)
+	if err := r.Watch(ctx, desc, func(r *discovery.Result) { results <- r }); err != nil {
+		t.Fatal(err)
+	}
+	f.events <- event("PUT", "/services/api/3", "http://10.0.0.3:8080")
+	f.events <- event("DELETE", "/services/api/2", "")
+	want := []string{
+		"http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.0.3:8080",
+		"http://10.0.0.1:8080,http://10.0.0.3:8080",
+	}
+	for _, w := range want {
+		select {
+		case r := <-results:
+			if got := strings.Join(uris(r), ","); got != w {
+				t.Fatalf("expected %s,got %s", w, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch result")
+		}
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	_, s := newFakeEtcd(t)
+	desc := "etcd://" + strings.TrimPrefix(s.URL, "http://") + "/services/api/?username=root&password=wrong"
+	r := &resolver{client: s.Client()}
+	_, err := r.Resolve(context.Background(), desc)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected authentication error,got %v", err)
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	cases := map[string]string{
+		"/services/api/": "/services/api0",
+		"a\xff":          "b",
+		"a\xff\xff":      "b",
+		"\xff\xff":       "\x00",
+	}
+	for prefix, want := range cases {
+		if got := prefixRangeEnd(prefix); got != want {
+			t.Errorf("prefixRangeEnd(%q) = %q,want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestInvalidDescIsRedacted(t *testing.T) {
+	_, err := parse("etcd://127.0.0.1:2379/?username=root&password=secret")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("expected redacted error,got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"net/url"
+	"os"
+	"time"
+)
+
+// SCHEME file:///etc/gateway/nodes.yaml?interval=5000
+//
+// 文件内容为节点列表，格式与端点的 targets 相同，json 也可以解析
+const SCHEME = "file"
+
+// 默认检查文件变化的间隔
+const defaultInterval = 5 * time.Second
+
+func init() {
+	discovery.Register(SCHEME, &resolver{})
+}
+
+type resolver struct{}
+
+func (r *resolver) Resolve(ctx context.Context, desc string) (*discovery.Result, error) {
+	path, _, err := parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	return load(path)
+}
+
+func (r *resolver) Watch(ctx context.Context, desc string, callBack func(*discovery.Result)) error {
+	path, interval, err := parse(desc)
+	if err != nil {
+		return err
+	}
+	last, err := load(path)
+	if err != nil {
+		return err
+	}
+	go discovery.Poll(ctx, desc, interval, last, func(ctx context.Context) (*discovery.Result, error) {
+		return load(path)
+	}, callBack)
+	return nil
+}
+
+func parse(desc string) (string, time.Duration, error) {
+	u, err := url.Parse(desc)
+	if err != nil {
+		return "", 0, discovery.InvalidError(desc, err)
+	}
+	// file://nodes.yaml 这种相对路径会被解析为 host
+	path := u.Host + u.Path
+	if path == "" {
+		return "", 0, fmt.Errorf("discovery %s file path cannot be empty", discovery.Redact(desc))
+	}
+	return path, discovery.Millis(u.Query(), "interval", defaultInterval), nil
+}
+
+func load(path string) (*discovery.Result, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*config.Target
+	if err := yaml.Unmarshal(b, &targets); err != nil {
+		return nil, fmt.Errorf("parse discovery file %s failed,error:%s", path, err.Error())
+	}
+	nodes := make([]discovery.Node, 0, len(targets))
+	for _, t := range targets {
+		if t == nil || t.Uri == "" {
+			continue
+		}
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		nodes = append(nodes, discovery.NewNode(t.Uri, weight, t.Tags))
+	}
+	return &discovery.Result{Nodes: nodes}, nil
+}
@@ -0,0 +1,562 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mini-gateway/discovery"
+	"mini-gateway/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SCHEME k8s://[apiserver]/namespace/service?port=http
+//
+// 通过 API server 监听服务的 EndpointSlice，只使用就绪的地址，Pod 的标签、zone 和 nodeName 作为节点标签。
+// authority 为空时使用集群内的 API server 和 ServiceAccount 的凭证。
+// 参数 port 为端口名或端口号，服务只有一个端口时可以不配置；scheme 为节点的协议，默认 http；
+// tls=false 时使用 http 访问 API server；tokenFile 和 caFile 覆盖默认的凭证文件。
+// Pod 的标签按服务的 selector 监听，需要 services 的 get 权限和 pods 的 list、watch 权限；服务没有 selector 时不读取 Pod 的标签，
+// 每次重新获取 Pod 列表时重新读取 selector
+const SCHEME = "k8s"
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// 单次监听的最长时间，到期后 API server 会关闭连接，从上次的 resourceVersion 继续监听
+	watchTimeoutSeconds = 300
+)
+
+// relistInterval 没有需要监听的对象时重新获取列表的间隔，比如服务还没有 selector
+var relistInterval = 30 * time.Second
+
+func init() {
+	discovery.Register(SCHEME, &resolver{})
+	discovery.Register("kubernetes", &resolver{})
+}
+
+type resolver struct{}
+
+type target struct {
+	api       string
+	namespace string
+	service   string
+	port      string
+	scheme    string
+	tokenFile string
+	client    *http.Client
+
+	mux         sync.Mutex
+	slices      map[string]*endpointSlice
+	pods        map[string]map[string]string
+	podSelector string
+
+	// notifyMux 保证回调按顺序执行
+	notifyMux sync.Mutex
+	last      *discovery.Result
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+}
+
+type endpointSlice struct {
+	Metadata    objectMeta `json:"metadata"`
+	AddressType string     `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"targetRef"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+}
+
+type service struct {
+	Spec struct {
+		Selector map[string]string `json:"selector"`
+	} `json:"spec"`
+}
+
+type objectList struct {
+	Metadata objectMeta        `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errGone resourceVersion 已过期，需要重新获取列表
+var errGone = errors.New("resource version is too old")
+
+func (r *resolver) Resolve(ctx context.Context, desc string) (*discovery.Result, error) {
+	t, err := parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.listSlices(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := t.listPods(ctx); err != nil {
+		slog.Warn("discovery %s list pods failed,error:%s", discovery.Redact(desc), err.Error())
+	}
+	return t.result(), nil
+}
+
+func (r *resolver) Watch(ctx context.Context, desc string, callBack func(*discovery.Result)) error {
+	t, err := parse(desc)
+	if err != nil {
+		return err
+	}
+	sliceVersion, err := t.listSlices(ctx)
+	if err != nil {
+		return err
+	}
+	// Pod 列表读取失败时先返回没有 Pod 标签的节点，监听中重试
+	podVersion, err := t.listPods(ctx)
+	if err != nil {
+		slog.Warn("discovery %s list pods failed,error:%s", discovery.Redact(desc), err.Error())
+	}
+	t.last = t.result()
+	changed := func() { t.notify(callBack) }
+	go t.loop(ctx, desc, "endpointslices", sliceVersion, t.listSlices, changed, func(ctx context.Context, version *string) error {
+		return t.watch(ctx, t.slicesPath(), t.sliceSelector(), version, t.applySlice, changed)
+	})
+	// Pod 的监听正常结束后重新获取列表，以便读取服务最新的 selector
+	go t.loop(ctx, desc, "pods", podVersion, t.listPods, changed, func(ctx context.Context, version *string) error {
+		err := t.watch(ctx, t.podsPath(), t.selector(), version, t.applyPod, changed)
+		if err == nil {
+			*version = ""
+		}
+		return err
+	})
+	return nil
+}
+
+// loop 持续监听一种资源，服务端正常关闭连接时从上次的 resourceVersion 继续，resourceVersion 过期或为空时重新获取列表，
+// 重新获取的列表没有 resourceVersion 时没有需要监听的对象，比如服务没有 selector，间隔 relistInterval 后再重新获取
+func (t *target) loop(ctx context.Context, desc, kind, version string, list func(context.Context) (string, error), changed func(), watch func(context.Context, *string) error) {
+	failures := 0
+	for {
+		var err error
+		if version == "" {
+			version, err = list(ctx)
+			if err == nil {
+				changed()
+				if version == "" && !discovery.Sleep(ctx, relistInterval) {
+					return
+				}
+			}
+		} else {
+			err = watch(ctx, &version)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if err == errGone {
+			version = ""
+			continue
+		}
+		failures++
+		slog.Error("discovery %s watch %s failed,error:%s", discovery.Redact(desc), kind, err.Error())
+		if !discovery.Sleep(ctx, discovery.RetryDelay(failures)) {
+			return
+		}
+	}
+}
+
+func parse(desc string) (*target, error) {
+	u, err := url.Parse(desc)
+	if err != nil {
+		return nil, discovery.InvalidError(desc, err)
+	}
+	q := u.Query()
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("discovery %s must be in the form k8s://[apiserver]/namespace/service", discovery.Redact(desc))
+	}
+	t := &target{
+		namespace: parts[0],
+		service:   parts[1],
+		port:      q.Get("port"),
+		scheme:    q.Get("scheme"),
+		tokenFile: q.Get("tokenFile"),
+		slices:    make(map[string]*endpointSlice),
+		pods:      make(map[string]map[string]string),
+	}
+	if t.scheme == "" {
+		t.scheme = "http"
+	}
+
+	host := u.Host
+	if host == "" {
+		h, p := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if h == "" || p == "" {
+			return nil, fmt.Errorf("discovery %s has no api server and is not running in a cluster", discovery.Redact(desc))
+		}
+		host = net.JoinHostPort(h, p)
+		if t.tokenFile == "" {
+			t.tokenFile = serviceAccountDir + "/token"
+		}
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := q.Get("caFile")
+	if caFile == "" && u.Host == "" {
+		caFile = serviceAccountDir + "/ca.crt"
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read kubernetes ca file failed,error:%s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		tlsConfig.RootCAs = pool
+	}
+	apiScheme := "https"
+	if q.Get("tls") == "false" {
+		apiScheme = "http"
+	}
+	t.api = fmt.Sprintf("%s://%s", apiScheme, host)
+	t.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	return t, nil
+}
+
+func (t *target) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.api+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if t.tokenFile != "" {
+		// 绑定的 ServiceAccount token 会定期轮换，每次请求都重新读取
+		token, err := os.ReadFile(t.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("kubernetes api server responded with status %d,%s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (t *target) slicesPath() string {
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(t.namespace))
+}
+
+func (t *target) podsPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(t.namespace))
+}
+
+func (t *target) sliceSelector() string {
+	return "kubernetes.io/service-name=" + t.service
+}
+
+// selector 服务的 Pod selector，为空时不监听 Pod
+func (t *target) selector() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.podSelector
+}
+
+// list 获取 selector 选中的对象列表和列表的 resourceVersion
+func (t *target) list(ctx context.Context, path, selector string) (*objectList, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := t.get(ctx, path, url.Values{"labelSelector": []string{selector}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list objectList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (t *target) listSlices(ctx context.Context) (string, error) {
+	list, err := t.list(ctx, t.slicesPath(), t.sliceSelector())
+	if err != nil {
+		return "", err
+	}
+	slices := make(map[string]*endpointSlice, len(list.Items))
+	for _, item := range list.Items {
+		var s endpointSlice
+		if err := json.Unmarshal(item, &s); err != nil {
+			return "", err
+		}
+		slices[s.Metadata.Name] = &s
+	}
+	t.mux.Lock()
+	t.slices = slices
+	t.mux.Unlock()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// listPods 按服务当前的 selector 获取 Pod 的标签，每次重新获取列表时也重新读取 selector
+func (t *target) listPods(ctx context.Context) (string, error) {
+	getCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := t.get(getCtx, fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(t.namespace), url.PathEscape(t.service)), url.Values{})
+	if err != nil {
+		return "", err
+	}
+	var svc service
+	err = json.NewDecoder(resp.Body).Decode(&svc)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(svc.Spec.Selector))
+	for k := range svc.Spec.Selector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	terms := make([]string, 0, len(keys))
+	for _, k := range keys {
+		terms = append(terms, k+"="+svc.Spec.Selector[k])
+	}
+	selector := strings.Join(terms, ",")
+
+	pods := make(map[string]map[string]string)
+	version := ""
+	if selector != "" {
+		list, err := t.list(ctx, t.podsPath(), selector)
+		if err != nil {
+			return "", err
+		}
+		for _, item := range list.Items {
+			var p pod
+			if err := json.Unmarshal(item, &p); err != nil {
+				return "", err
+			}
+			pods[p.Metadata.Name] = p.Metadata.Labels
+		}
+		version = list.Metadata.ResourceVersion
+	}
+	t.mux.Lock()
+	t.pods, t.podSelector = pods, selector
+	t.mux.Unlock()
+	return version, nil
+}
+
+func (t *target) applySlice(typ string, object json.RawMessage) (string, error) {
+	var s endpointSlice
+	if err := json.Unmarshal(object, &s); err != nil {
+		return "", err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	switch typ {
+	case "ADDED", "MODIFIED":
+		t.slices[s.Metadata.Name] = &s
+	case "DELETED":
+		delete(t.slices, s.Metadata.Name)
+	}
+	return s.Metadata.ResourceVersion, nil
+}
+
+func (t *target) applyPod(typ string, object json.RawMessage) (string, error) {
+	var p pod
+	if err := json.Unmarshal(object, &p); err != nil {
+		return "", err
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	switch typ {
+	case "ADDED", "MODIFIED":
+		t.pods[p.Metadata.Name] = p.Metadata.Labels
+	case "DELETED":
+		delete(t.pods, p.Metadata.Name)
+	}
+	return p.Metadata.ResourceVersion, nil
+}
+
+// watch 从 version 开始监听并用 apply 更新对象，每个事件处理完后调用 changed，服务端正常关闭连接时返回 nil
+func (t *target) watch(ctx context.Context, path, selector string, version *string, apply func(string, json.RawMessage) (string, error), changed func()) error {
+	q := url.Values{}
+	q.Set("labelSelector", selector)
+	q.Set("watch", "true")
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("resourceVersion", *version)
+	q.Set("timeoutSeconds", strconv.Itoa(watchTimeoutSeconds))
+	resp, err := t.get(ctx, path, q)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e watchEvent
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if e.Type == "ERROR" {
+			var s status
+			_ = json.Unmarshal(e.Object, &s)
+			if s.Code == http.StatusGone {
+				return errGone
+			}
+			return fmt.Errorf("kubernetes watch error,code:%d,%s", s.Code, s.Message)
+		}
+		if e.Type == "BOOKMARK" {
+			var o struct {
+				Metadata objectMeta `json:"metadata"`
+			}
+			if err := json.Unmarshal(e.Object, &o); err != nil {
+				return err
+			}
+			if o.Metadata.ResourceVersion != "" {
+				*version = o.Metadata.ResourceVersion
+			}
+			continue
+		}
+		v, err := apply(e.Type, e.Object)
+		if err != nil {
+			return err
+		}
+		if v != "" {
+			*version = v
+		}
+		changed()
+	}
+}
+
+// notify 节点有变化时调用 callBack
+func (t *target) notify(callBack func(*discovery.Result)) {
+	t.notifyMux.Lock()
+	defer t.notifyMux.Unlock()
+	result := t.result()
+	if discovery.Equal(t.last, result) {
+		return
+	}
+	t.last = result
+	callBack(result)
+}
+
+func (t *target) result() *discovery.Result {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	names := make([]string, 0, len(t.slices))
+	for name := range t.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodes := make([]discovery.Node, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		s := t.slices[name]
+		port, ok := t.selectPort(s)
+		if !ok {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			// ready 为空时视为就绪
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			if e.Conditions.Terminating != nil && *e.Conditions.Terminating {
+				continue
+			}
+			tags := make(map[string]string)
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				for k, v := range t.pods[e.TargetRef.Name] {
+					tags[k] = v
+				}
+			}
+			if e.Zone != "" {
+				tags["zone"] = e.Zone
+			}
+			if e.NodeName != "" {
+				tags["nodeName"] = e.NodeName
+			}
+			for _, addr := range e.Addresses {
+				uri := fmt.Sprintf("%s://%s", t.scheme, net.JoinHostPort(addr, strconv.Itoa(port)))
+				if seen[uri] {
+					continue
+				}
+				seen[uri] = true
+				nodes = append(nodes, discovery.NewNode(uri, 1, tags))
+			}
+		}
+	}
+	return &discovery.Result{Nodes: nodes}
+}
+
+func (t *target) selectPort(s *endpointSlice) (int, bool) {
+	if t.port == "" {
+		if len(s.Ports) == 1 && s.Ports[0].Port != nil {
+			return *s.Ports[0].Port, true
+		}
+		return 0, false
+	}
+	for _, p := range s.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if p.Name != nil && *p.Name == t.port || strconv.Itoa(*p.Port) == t.port {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
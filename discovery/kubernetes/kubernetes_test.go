@@ -0,0 +1,209 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"mini-gateway/discovery"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer API server 的替身，支持 EndpointSlice、Service 和 Pod 的 list 与 watch
+type fakeAPIServer struct {
+	t           *testing.T
+	sliceEvents chan string
+	podEvents   chan string
+	podGets     int32
+	// noSelector 为 true 时服务没有 selector
+	noSelector atomic.Bool
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, *httptest.Server) {
+	f := &fakeAPIServer{t: t, sliceEvents: make(chan string, 16), podEvents: make(chan string, 16)}
+	s := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(s.Close)
+	return f, s
+}
+
+func (f *fakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices":
+		if q.Get("labelSelector") != "kubernetes.io/service-name=api" {
+			f.t.Errorf("unexpected endpointslice selector %s", q.Get("labelSelector"))
+		}
+		if q.Get("watch") == "true" {
+			f.stream(w, r, f.sliceEvents)
+			return
+		}
+		writeList(w, "10", slice("api-1", "10.0.0.1", "pod-1"))
+	case "/api/v1/namespaces/default/services/api":
+		if f.noSelector.Load() {
+			_, _ = w.Write([]byte(`{"spec":{}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"spec":{"selector":{"app":"api","tier":"web"}}}`))
+	case "/api/v1/namespaces/default/pods":
+		if q.Get("labelSelector") != "app=api,tier=web" {
+			f.t.Errorf("unexpected pod selector %s", q.Get("labelSelector"))
+		}
+		if q.Get("watch") == "true" {
+			f.stream(w, r, f.podEvents)
+			return
+		}
+		writeList(w, "20", podJSON("pod-1", "blue"), podJSON("pod-2", "green"))
+	default:
+		if strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/default/pods/") {
+			atomic.AddInt32(&f.podGets, 1)
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAPIServer) stream(w http.ResponseWriter, r *http.Request, events chan string) {
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			_, _ = w.Write([]byte(e + "\n"))
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func writeList(w http.ResponseWriter, version string, items ...string) {
+	raws := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		raws = append(raws, json.RawMessage(item))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"metadata": map[string]string{"resourceVersion": version}, "items": raws})
+}
+
+func slice(name string, addrPods ...string) string {
+	endpoints := make([]map[string]any, 0)
+	for i := 0; i+1 < len(addrPods); i += 2 {
+		endpoints = append(endpoints, map[string]any{
+			"addresses":  []string{addrPods[i]},
+			"conditions": map[string]bool{"ready": true},
+			"targetRef":  map[string]string{"kind": "Pod", "name": addrPods[i+1], "namespace": "default"},
+		})
+	}
+	b, _ := json.Marshal(map[string]any{
+		"metadata":  map[string]string{"name": name, "resourceVersion": "11"},
+		"endpoints": endpoints,
+		"ports":     []map[string]any{{"name": "http", "port": 8080}},
+	})
+	return string(b)
+}
+
+func podJSON(name, color string) string {
+	b, _ := json.Marshal(map[string]any{"metadata": map[string]any{
+		"name": name, "resourceVersion": "21", "labels": map[string]string{"app": "api", "color": color},
+	}})
+	return string(b)
+}
+
+func event(typ, object string) string {
+	return `{"type":"` + typ + `","object":` + object + `}`
+}
+
+func colors(r *discovery.Result) string {
+	cs := make([]string, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		color, _ := n.Tag("color")
+		cs = append(cs, n.Uri()+"="+color)
+	}
+	sort.Strings(cs)
+	return strings.Join(cs, ",")
+}
+
+func TestResolveAndWatch(t *testing.T) {
+	f, s := newFakeAPIServer(t)
+	desc := "k8s://" + strings.TrimPrefix(s.URL, "http://") + "/default/api?tls=false&port=http"
+	r := &resolver{}
+
+	result, err := r.Resolve(context.Background(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := colors(result); got != "http://10.0.0.1:8080=blue" {
+		t.Fatalf("unexpected nodes %s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan *discovery.Result, 4)
+	if err := r.Watch(ctx, desc, func(r *discovery.Result) { results <- r }); err != nil {
+		t.Fatal(err)
+	}
+	next := func(want string) {
+		select {
+		case r := <-results:
+			if got := colors(r); got != want {
+				t.Fatalf("expected %s,got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch result")
+		}
+	}
+	f.sliceEvents <- event("MODIFIED", slice("api-1", "10.0.0.1", "pod-1", "10.0.0.2", "pod-2"))
+	next("http://10.0.0.1:8080=blue,http://10.0.0.2:8080=green")
+	// Pod 重新打标签后节点的标签随之变化
+	f.podEvents <- event("MODIFIED", podJSON("pod-1", "green"))
+	next("http://10.0.0.1:8080=green,http://10.0.0.2:8080=green")
+	f.podEvents <- event("BOOKMARK", `{"metadata":{"resourceVersion":"30"}}`)
+	f.podEvents <- event("DELETED", podJSON("pod-2", "green"))
+	next("http://10.0.0.1:8080=green,http://10.0.0.2:8080=")
+
+	if n := atomic.LoadInt32(&f.podGets); n != 0 {
+		t.Fatalf("pod labels should come from the list and watch,got %d single pod requests", n)
+	}
+}
+
+// 服务开始没有 selector，之后添加的 selector 在重新获取列表时生效
+func TestWatchSelectorAddedLater(t *testing.T) {
+	defer func(d time.Duration) { relistInterval = d }(relistInterval)
+	relistInterval = 10 * time.Millisecond
+	f, s := newFakeAPIServer(t)
+	f.noSelector.Store(true)
+	desc := "k8s://" + strings.TrimPrefix(s.URL, "http://") + "/default/api?tls=false&port=http"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan *discovery.Result, 4)
+	if err := (&resolver{}).Watch(ctx, desc, func(r *discovery.Result) { results <- r }); err != nil {
+		t.Fatal(err)
+	}
+	f.noSelector.Store(false)
+	select {
+	case r := <-results:
+		if got := colors(r); got != "http://10.0.0.1:8080=blue" {
+			t.Fatalf("expected pod labels after the selector is added,got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pod labels")
+	}
+	f.podEvents <- event("MODIFIED", podJSON("pod-1", "green"))
+	select {
+	case r := <-results:
+		if got := colors(r); got != "http://10.0.0.1:8080=green" {
+			t.Fatalf("expected relabelled pod,got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pod watch")
+	}
+}
+
+func TestInvalidDescIsRedacted(t *testing.T) {
+	_, err := parse("k8s://127.0.0.1:6443/default?tls=false&token=secret")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("expected redacted error,got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"mini-gateway/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Poll 定期调用 resolve，结果有变化时回调，出错时保留上次的结果，ctx 取消后返回
+func Poll(ctx context.Context, desc string, interval time.Duration, last *Result, resolve func(ctx context.Context) (*Result, error), callBack func(*Result)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		result, err := resolve(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("discovery %s resolve failed,error:%s", Redact(desc), err.Error())
+			}
+			continue
+		}
+		if last != nil && Equal(last, result) {
+			continue
+		}
+		last = result
+		callBack(result)
+	}
+}
+
+// Equal 两次解析的节点是否相同，不考虑顺序
+func Equal(a, b *Result) bool {
+	return fingerprint(a) == fingerprint(b)
+}
+
+func fingerprint(r *Result) string {
+	ss := make([]string, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		tags := n.Tags()
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s|%d", n.Uri(), n.Weight())
+		for _, k := range keys {
+			fmt.Fprintf(&b, "|%s=%s", k, tags[k])
+		}
+		ss = append(ss, b.String())
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, "\n")
+}
+
+// RetryDelay 监听断开后第 n 次重连前等待的时间，从 1s 开始翻倍，最多 30s
+func RetryDelay(n int) time.Duration {
+	d := time.Second
+	for i := 1; i < n && d < 30*time.Second; i++ {
+		d *= 2
+	}
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+// Sleep 等待 d，ctx 取消时返回 false
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Millis 读取 desc 中以毫秒为单位的参数，没有配置或不合法时返回 def
+func Millis(q url.Values, key string, def time.Duration) time.Duration {
+	v, err := strconv.Atoi(q.Get(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return time.Duration(v) * time.Millisecond
+}
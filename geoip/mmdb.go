@@ -0,0 +1,364 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxMind DB 格式 https://maxmind.github.io/MaxMind-DB/
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// 嵌套和指针跳转的最大深度，防止损坏的文件导致死循环
+const maxDepth = 64
+
+// 最多缓存的国家代码数，国家库只有几百条记录，城市库的记录多时不再缓存新的记录
+const maxCachedCountries = 1 << 16
+
+// Reader 只读的 MaxMind DB，整个文件读入内存
+type Reader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	data       []byte
+	ipv4Start  uint
+	Metadata   map[string]interface{}
+
+	// countries 按数据偏移缓存国家代码，同一条记录只解码一次
+	countries sync.Map
+	cached    atomic.Int64
+}
+
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+func New(buf []byte) (*Reader, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, errors.New("invalid mmdb file,metadata marker not found")
+	}
+	metaBuf := buf[start+len(metadataMarker):]
+	v, _, err := decode(metaBuf, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata,error:%s", err.Error())
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata")
+	}
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  metaUint(meta, "node_count"),
+		recordSize: metaUint(meta, "record_size"),
+		ipVersion:  metaUint(meta, "ip_version"),
+		Metadata:   meta,
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported mmdb record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported mmdb ip version %d", r.ipVersion)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	// 搜索树和数据段之间有 16 字节的分隔
+	if r.treeSize+16 > uint(start) {
+		return nil, errors.New("invalid mmdb file,search tree is truncated")
+	}
+	r.data = buf[r.treeSize+16 : start]
+
+	// IPv6 的库中 IPv4 地址位于 ::/96 之下
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func metaUint(meta map[string]interface{}, key string) uint {
+	switch v := meta[key].(type) {
+	case uint64:
+		return uint(v)
+	case int32:
+		return uint(v)
+	}
+	return 0
+}
+
+// record 读取节点的左(bit=0)或右(bit=1)记录
+func (r *Reader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		off := node * 6
+		b := r.buf[off+bit*3 : off+bit*3+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			b := r.buf[off : off+4]
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		b := r.buf[off+3 : off+7]
+		return uint(b[0]&0x0F)<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[off : off+4]))
+	}
+}
+
+// Lookup 返回地址所在网段的数据，没有数据时返回 nil
+func (r *Reader) Lookup(addr netip.Addr) (interface{}, error) {
+	offset, ok, err := r.dataOffset(addr)
+	if err != nil || !ok {
+		return nil, err
+	}
+	v, _, err := decode(r.data, offset, 0)
+	return v, err
+}
+
+// dataOffset 返回地址所在网段的数据在数据段中的偏移，没有数据时 ok 为 false
+func (r *Reader) dataOffset(addr netip.Addr) (offset uint, ok bool, err error) {
+	addr = addr.Unmap()
+	if addr.Is6() && r.ipVersion == 4 {
+		return 0, false, nil
+	}
+	node := uint(0)
+	bits := addr.AsSlice()
+	if addr.Is4() && r.ipVersion == 6 {
+		node = r.ipv4Start
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return 0, false, nil
+	}
+	if node < r.nodeCount {
+		return 0, false, errors.New("invalid mmdb search tree")
+	}
+	offset = node - r.nodeCount - 16
+	if node < r.nodeCount+16 || offset >= uint(len(r.data)) {
+		return 0, false, errors.New("invalid mmdb data pointer")
+	}
+	return offset, true, nil
+}
+
+// Country 返回国家的 ISO 代码，没有 country 时使用 registered_country
+func (r *Reader) Country(addr netip.Addr) (string, error) {
+	offset, ok, err := r.dataOffset(addr)
+	if err != nil || !ok {
+		return "", err
+	}
+	if code, ok := r.countries.Load(offset); ok {
+		return code.(string), nil
+	}
+	v, _, err := decode(r.data, offset, 0)
+	if err != nil {
+		return "", err
+	}
+	code := ""
+	record, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]interface{}); ok {
+			if iso, ok := c["iso_code"].(string); ok {
+				code = iso
+				break
+			}
+		}
+	}
+	if r.cached.Add(1) <= maxCachedCountries {
+		r.countries.Store(offset, code)
+	}
+	return code, nil
+}
+
+// decode 解码 offset 处的数据，返回值和下一个数据的偏移
+func decode(buf []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("mmdb data is nested too deeply")
+	}
+	if offset >= uint(len(buf)) {
+		return nil, 0, errors.New("mmdb data offset out of range")
+	}
+	ctrl := buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := pointer(buf, ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := decode(buf, ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(buf)) {
+			return nil, 0, errors.New("mmdb data offset out of range")
+		}
+		typ = 7 + int(buf[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(buf)) {
+			return nil, 0, errors.New("mmdb data offset out of range")
+		}
+		extra := uint(0)
+		for _, b := range buf[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := decode(buf, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("mmdb map key is not a string")
+			}
+			v, next, err := decode(buf, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := decode(buf, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeEndMarker, typeContainer:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(buf)) {
+		return nil, 0, errors.New("mmdb data offset out of range")
+	}
+	b := buf[offset : offset+size]
+	next := offset + size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid mmdb double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid mmdb float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid mmdb unsigned integer size")
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid mmdb int32 size")
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.New("invalid mmdb uint128 size")
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported mmdb data type %d", typ)
+}
+
+// pointer 指针的目标偏移相对数据段开始位置
+func pointer(buf []byte, ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	n := ss + 1
+	if offset+n > uint(len(buf)) {
+		return 0, 0, errors.New("mmdb pointer out of range")
+	}
+	b := buf[offset : offset+n]
+	v := uint(0)
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	switch ss {
+	case 0:
+		v = vvv<<8 | v
+	case 1:
+		v = (vvv<<16 | v) + 2048
+	case 2:
+		v = (vvv<<24 | v) + 526336
+	}
+	return v, offset + n, nil
+}
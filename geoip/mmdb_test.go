@@ -0,0 +1,260 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// dataWriter 按 MaxMind DB 格式编码数据段
+type dataWriter struct {
+	buf []byte
+}
+
+func (w *dataWriter) ctrl(typ int, size int) {
+	if typ > 7 {
+		w.buf = append(w.buf, byte(size), byte(typ-7))
+		return
+	}
+	w.buf = append(w.buf, byte(typ<<5|size))
+}
+
+func (w *dataWriter) string(s string) {
+	w.ctrl(typeString, len(s))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *dataWriter) uint32(v uint32) {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	w.ctrl(typeUint32, 4)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *dataWriter) mapHeader(size int) {
+	w.ctrl(typeMap, size)
+}
+
+// pointer 只支持 11 位的偏移
+func (w *dataWriter) pointer(offset int) {
+	w.buf = append(w.buf, byte(typePointer<<5|offset>>8), byte(offset))
+}
+
+// network 网段和数据在数据段中的偏移
+type network struct {
+	prefix netip.Prefix
+	offset uint
+}
+
+// buildTree 生成 IPv6 搜索树，IPv4 网段放在 ::/96 之下
+func buildTree(recordSize uint, networks []network) ([]byte, uint) {
+	const empty, data = -1, -2
+	type node struct {
+		records [2]int
+		offsets [2]uint
+	}
+	nodes := []*node{{records: [2]int{empty, empty}}}
+	for _, n := range networks {
+		addr := n.prefix.Addr()
+		bitLen := n.prefix.Bits()
+		if addr.Is4() {
+			var b [16]byte
+			copy(b[12:], addr.AsSlice())
+			addr = netip.AddrFrom16(b)
+			bitLen += 96
+		}
+		bits := addr.As16()
+		current := 0
+		for i := 0; i < bitLen; i++ {
+			bit := int(bits[i/8]>>(7-i%8)) & 1
+			if i == bitLen-1 {
+				nodes[current].records[bit] = data
+				nodes[current].offsets[bit] = n.offset
+				break
+			}
+			if nodes[current].records[bit] == empty {
+				nodes = append(nodes, &node{records: [2]int{empty, empty}})
+				nodes[current].records[bit] = len(nodes) - 1
+			}
+			current = nodes[current].records[bit]
+		}
+	}
+	count := uint(len(nodes))
+	tree := make([]byte, 0)
+	for _, n := range nodes {
+		var values [2]uint
+		for i, r := range n.records {
+			switch r {
+			case empty:
+				values[i] = count
+			case data:
+				values[i] = count + 16 + n.offsets[i]
+			default:
+				values[i] = uint(r)
+			}
+		}
+		switch recordSize {
+		case 24:
+			for _, v := range values {
+				tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+			}
+		case 28:
+			l, r := values[0], values[1]
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>24&0x0F)<<4|byte(r>>24&0x0F), byte(r>>16), byte(r>>8), byte(r))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, uint32(values[0]))
+			tree = binary.BigEndian.AppendUint32(tree, uint32(values[1]))
+		}
+	}
+	return tree, count
+}
+
+func metadata(nodeCount, recordSize uint) []byte {
+	w := &dataWriter{}
+	w.mapHeader(4)
+	w.string("node_count")
+	w.uint32(uint32(nodeCount))
+	w.string("record_size")
+	w.ctrl(typeUint16, 1)
+	w.buf = append(w.buf, byte(recordSize))
+	w.string("ip_version")
+	w.ctrl(typeUint16, 1)
+	w.buf = append(w.buf, 6)
+	w.string("database_type")
+	w.string("Test-Country")
+	return w.buf
+}
+
+func buildDB(recordSize uint, networks []network, data []byte) []byte {
+	tree, count := buildTree(recordSize, networks)
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	return append(db, metadata(count, recordSize)...)
+}
+
+// testData 返回数据段和各记录的偏移，pointer 记录的 country 是指向 US 记录中 country 的指针
+func testData() ([]byte, map[string]uint) {
+	w := &dataWriter{}
+	offsets := make(map[string]uint)
+
+	offsets["US"] = uint(len(w.buf))
+	w.mapHeader(1)
+	w.string("country")
+	country := len(w.buf)
+	w.mapHeader(2)
+	w.string("iso_code")
+	w.string("US")
+	w.string("names")
+	w.mapHeader(1)
+	w.string("en")
+	w.string("United States")
+
+	offsets["pointer"] = uint(len(w.buf))
+	w.mapHeader(1)
+	w.string("country")
+	w.pointer(country)
+
+	offsets["registered"] = uint(len(w.buf))
+	w.mapHeader(1)
+	w.string("registered_country")
+	w.mapHeader(1)
+	w.string("iso_code")
+	w.string("JP")
+
+	offsets["badPointer"] = uint(len(w.buf))
+	w.mapHeader(1)
+	w.string("country")
+	w.pointer(2000)
+	return w.buf, offsets
+}
+
+func TestCountryLookup(t *testing.T) {
+	data, offsets := testData()
+	networks := []network{
+		{netip.MustParsePrefix("192.0.2.0/24"), offsets["US"]},
+		{netip.MustParsePrefix("198.51.100.0/24"), offsets["registered"]},
+		{netip.MustParsePrefix("2001:db8::/32"), offsets["pointer"]},
+	}
+	for _, size := range []uint{24, 28, 32} {
+		r, err := New(buildDB(size, networks, data))
+		if err != nil {
+			t.Fatalf("record size %d: %v", size, err)
+		}
+		cases := map[string]string{
+			"192.0.2.1":          "US",
+			"::ffff:192.0.2.200": "US",
+			"198.51.100.7":       "JP",
+			"2001:db8::1":        "US",
+			"203.0.113.1":        "",
+			"2001:db9::1":        "",
+		}
+		for ip, want := range cases {
+			for i := 0; i < 2; i++ {
+				got, err := r.Country(netip.MustParseAddr(ip))
+				if err != nil || got != want {
+					t.Errorf("record size %d: Country(%s) = %q,%v,expected %s", size, ip, got, err, want)
+				}
+			}
+		}
+		v, err := r.Lookup(netip.MustParseAddr("2001:db8::1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := v.(map[string]interface{})["country"].(map[string]interface{})["names"].(map[string]interface{})
+		if names["en"] != "United States" {
+			t.Errorf("record size %d: unexpected record %v", size, v)
+		}
+	}
+}
+
+// 损坏的文件返回错误而不是 panic
+func TestCorruptDatabase(t *testing.T) {
+	data, offsets := testData()
+	networks := []network{
+		{netip.MustParsePrefix("192.0.2.0/24"), offsets["badPointer"]},
+		{netip.MustParsePrefix("198.51.100.0/24"), uint(len(data)) + 100},
+	}
+	r, err := New(buildDB(24, networks, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1"} {
+		if _, err := r.Country(netip.MustParseAddr(ip)); err == nil {
+			t.Errorf("Country(%s) should fail on corrupt offsets", ip)
+		}
+	}
+
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Error("database without metadata should be rejected")
+	}
+	db := buildDB(24, networks, data)
+	truncated := db[strings.Index(string(db), string(metadataMarker))-20:]
+	if _, err := New(truncated); err == nil {
+		t.Error("truncated search tree should be rejected")
+	}
+	for _, b := range [][]byte{{0x20}, {0x38, 0x01}, {0xE2, 0x42}} {
+		if _, _, err := decode(b, 0, 0); err == nil {
+			t.Errorf("decode(% x) should fail", b)
+		}
+	}
+}
+
+// 不同长度指针的偏移，https://maxmind.github.io/MaxMind-DB/#pointer---1
+func TestPointerSizes(t *testing.T) {
+	cases := []struct {
+		b    []byte
+		want uint
+	}{
+		{[]byte{0x21, 0x02}, 0x102},
+		{[]byte{0x29, 0x02, 0x03}, 0x10203 + 2048},
+		{[]byte{0x31, 0x02, 0x03, 0x04}, 0x1020304 + 526336},
+		{[]byte{0x3F, 0x01, 0x02, 0x03, 0x04}, 0x01020304},
+	}
+	for _, c := range cases {
+		got, next, err := pointer(c.b, c.b[0], 1)
+		if err != nil || got != c.want || next != uint(len(c.b)) {
+			t.Errorf("pointer(% x) = %d,%d,%v,expected %d", c.b, got, next, err, c.want)
+		}
+	}
+}
@@ -4,10 +4,12 @@ go 1.20
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.0.0
+	golang.org/x/crypto v0.9.0
 	golang.org/x/net v0.10.0
 )
 
 require (
+	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,203 @@
+package health
+
+import (
+	"context"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"mini-gateway/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeHttp = "http"
+	TypeGrpc = "grpc"
+	TypeTcp  = "tcp"
+)
+
+// NewChecker 创建健康检查器，检查器包装 picker，只把健康的节点应用给 picker。
+// ctx 取消后所有探测协程退出。
+func NewChecker(ctx context.Context, c *config.HealthCheck, client *http.Client, picker loadbalance.Picker) *Checker {
+	checker := &Checker{
+		ctx:                ctx,
+		picker:             picker,
+		probe:              newProbe(c, client),
+		interval:           10 * time.Second,
+		timeout:            time.Second,
+		healthyThreshold:   2,
+		unhealthyThreshold: 3,
+		targets:            make(map[string]*target),
+	}
+	if c.Interval > 0 {
+		checker.interval = time.Duration(c.Interval) * time.Millisecond
+	}
+	if c.Timeout > 0 {
+		checker.timeout = time.Duration(c.Timeout) * time.Millisecond
+	}
+	if c.HealthyThreshold > 0 {
+		checker.healthyThreshold = c.HealthyThreshold
+	}
+	if c.UnhealthyThreshold > 0 {
+		checker.unhealthyThreshold = c.UnhealthyThreshold
+	}
+	return checker
+}
+
+type Checker struct {
+	ctx                context.Context
+	picker             loadbalance.Picker
+	probe              probe
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	mux     sync.Mutex
+	nodes   []discovery.Node
+	targets map[string]*target
+	// fallback 没有健康节点时使用全部节点
+	fallback bool
+}
+
+type target struct {
+	node      discovery.Node
+	healthy   bool
+	successes int
+	failures  int
+	cancel    context.CancelFunc
+}
+
+func (c *Checker) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	return c.picker.Next(ctx)
+}
+
+// Apply 更新需要检查的节点，已存在的节点保留原有健康状态，新节点默认健康。
+func (c *Checker) Apply(nodes []discovery.Node) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	targets := make(map[string]*target)
+	for _, n := range nodes {
+		if t, ok := c.targets[n.Uri()]; ok {
+			t.node = n
+			targets[n.Uri()] = t
+			delete(c.targets, n.Uri())
+			continue
+		}
+		if _, ok := targets[n.Uri()]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		t := &target{node: n, healthy: true, cancel: cancel}
+		targets[n.Uri()] = t
+		go c.watch(ctx, t)
+	}
+	// 停止已移除节点的探测
+	for _, t := range c.targets {
+		t.cancel()
+	}
+	c.targets = targets
+	c.nodes = nodes
+	c.applyHealthy()
+}
+
+// Healthy 返回节点当前的健康状态
+func (c *Checker) Healthy(uri string) (healthy bool, exist bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t, ok := c.targets[uri]
+	if !ok {
+		return false, false
+	}
+	return t.healthy, true
+}
+
+// Statuses 返回所有节点的健康状态
+func (c *Checker) Statuses() map[string]bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	statuses := make(map[string]bool, len(c.targets))
+	for uri, t := range c.targets {
+		statuses[uri] = t.healthy
+	}
+	return statuses
+}
+
+func (c *Checker) watch(ctx context.Context, t *target) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx, t)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) check(ctx context.Context, t *target) {
+	// Apply 会在锁内替换节点
+	c.mux.Lock()
+	node := t.node
+	c.mux.Unlock()
+	probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	err := c.probe(probeCtx, node)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err != nil {
+		t.successes = 0
+		t.failures++
+		if t.healthy && t.failures >= c.unhealthyThreshold {
+			t.healthy = false
+			slog.Warn("health check node %s is unhealthy,error:%s", t.node.Uri(), err.Error())
+			c.applyHealthy()
+		}
+		return
+	}
+	t.failures = 0
+	t.successes++
+	if !t.healthy && t.successes >= c.healthyThreshold {
+		t.healthy = true
+		slog.Info("health check node %s is healthy", t.node.Uri())
+		c.applyHealthy()
+	}
+}
+
+// applyHealthy 按原有顺序把健康节点应用给 picker，没有健康节点时使用全部节点，调用方需持有锁
+func (c *Checker) applyHealthy() {
+	ns := make([]discovery.Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if t, ok := c.targets[n.Uri()]; ok && t.healthy {
+			ns = append(ns, n)
+		}
+	}
+	fallback := len(ns) == 0 && len(c.nodes) > 0
+	if fallback != c.fallback {
+		if fallback {
+			slog.Error("health check found no healthy node,all %d nodes are used", len(c.nodes))
+		} else {
+			slog.Info("health check found healthy nodes again")
+		}
+		c.fallback = fallback
+	}
+	if fallback {
+		ns = c.nodes
+	}
+	c.picker.Apply(ns)
+}
+
+func normalizeType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if t == "" {
+		return TypeHttp
+	}
+	return t
+}
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordPicker 记录最后一次应用的节点
+type recordPicker struct {
+	mux   sync.Mutex
+	nodes []discovery.Node
+}
+
+func (p *recordPicker) Next(context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	return nil, nil, nil
+}
+
+func (p *recordPicker) Apply(nodes []discovery.Node) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.nodes = nodes
+}
+
+func (p *recordPicker) uris() string {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	us := make([]string, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		us = append(us, n.Uri())
+	}
+	sort.Strings(us)
+	return strings.Join(us, ",")
+}
+
+// fakeProbe 按 uri 返回配置的探测结果
+type fakeProbe struct {
+	mux    sync.Mutex
+	failed map[string]bool
+}
+
+func (f *fakeProbe) set(uri string, failed bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.failed[uri] = failed
+}
+
+func (f *fakeProbe) probe(_ context.Context, node discovery.Node) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.failed[node.Uri()] {
+		return errors.New("probe failed")
+	}
+	return nil
+}
+
+func newTestChecker(ctx context.Context, interval int) (*Checker, *recordPicker, *fakeProbe) {
+	picker := &recordPicker{}
+	f := &fakeProbe{failed: make(map[string]bool)}
+	c := NewChecker(ctx, &config.HealthCheck{Interval: interval, HealthyThreshold: 2, UnhealthyThreshold: 3}, nil, picker)
+	c.probe = f.probe
+	return c, picker, f
+}
+
+func nodes(uris ...string) []discovery.Node {
+	ns := make([]discovery.Node, 0, len(uris))
+	for _, uri := range uris {
+		ns = append(ns, discovery.NewNode(uri, 1, nil))
+	}
+	return ns
+}
+
+// 按阈值在健康和不健康之间切换，没有健康节点时使用全部节点
+func TestCheckerThresholdsAndFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 不启动探测协程，手动触发探测
+	c, picker, f := newTestChecker(ctx, 0)
+	ta, tb := &target{healthy: true}, &target{healthy: true}
+	c.nodes = nodes("http://a", "http://b")
+	ta.node, tb.node = c.nodes[0], c.nodes[1]
+	c.targets = map[string]*target{"http://a": ta, "http://b": tb}
+	c.applyHealthy()
+
+	f.set("http://a", true)
+	for i := 0; i < 2; i++ {
+		c.check(ctx, ta)
+	}
+	if got := picker.uris(); got != "http://a,http://b" {
+		t.Fatalf("node should stay healthy below the unhealthy threshold,got %s", got)
+	}
+	c.check(ctx, ta)
+	if got := picker.uris(); got != "http://b" {
+		t.Fatalf("expected only http://b,got %s", got)
+	}
+
+	f.set("http://b", true)
+	for i := 0; i < 3; i++ {
+		c.check(ctx, tb)
+	}
+	if got := picker.uris(); got != "http://a,http://b" {
+		t.Fatalf("all nodes should be used when none is healthy,got %s", got)
+	}
+	if healthy, _ := c.Healthy("http://b"); healthy {
+		t.Fatal("http://b should be reported unhealthy")
+	}
+
+	f.set("http://a", false)
+	c.check(ctx, ta)
+	if got := picker.uris(); got != "http://a,http://b" {
+		t.Fatalf("node should stay unhealthy below the healthy threshold,got %s", got)
+	}
+	c.check(ctx, ta)
+	if got := picker.uris(); got != "http://a" {
+		t.Fatalf("expected only http://a after recovery,got %s", got)
+	}
+}
+
+// 节点替换时保留健康状态，移除的节点停止探测，和探测协程并发时没有数据竞争
+func TestCheckerNodeReplacement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, picker, f := newTestChecker(ctx, 1)
+	f.set("http://b", true)
+	c.Apply(nodes("http://a", "http://b"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for picker.uris() != "http://a" {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for http://b to become unhealthy,got %s", picker.uris())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		c.Apply(nodes("http://a", "http://b"))
+		time.Sleep(100 * time.Microsecond)
+	}
+	if healthy, _ := c.Healthy("http://b"); healthy {
+		t.Fatal("replacing a node should keep its health state")
+	}
+
+	c.Apply(nodes("http://a", "http://c"))
+	if _, exist := c.Healthy("http://b"); exist {
+		t.Fatal("removed node should not be tracked")
+	}
+	if got := picker.uris(); got != "http://a,http://c" {
+		t.Fatalf("expected http://a,http://c,got %s", got)
+	}
+}
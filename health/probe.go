@@ -0,0 +1,161 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	"mini-gateway/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type probe func(ctx context.Context, node discovery.Node) error
+
+func newProbe(c *config.HealthCheck, client *http.Client) probe {
+	switch normalizeType(c.Type) {
+	case TypeTcp:
+		return tcpProbe
+	case TypeGrpc:
+		return grpcProbe(client, c.Service)
+	case TypeHttp:
+	default:
+		slog.Warn("unknown health check type %s,http is used by default", c.Type)
+	}
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	return httpProbe(client, path)
+}
+
+func httpProbe(client *http.Client, path string) probe {
+	return func(ctx context.Context, node discovery.Node) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(node.Uri(), "/")+"/"+strings.TrimLeft(path, "/"), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func tcpProbe(ctx context.Context, node discovery.Node) error {
+	u, err := url.Parse(node.Uri())
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpc 健康检查协议 https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+func grpcProbe(client *http.Client, service string) probe {
+	// HealthCheckRequest{service = 1}
+	msg := make([]byte, 0, len(service)+2)
+	if service != "" {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	body := make([]byte, len(msg)+5)
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	copy(body[5:], msg)
+
+	return func(ctx context.Context, node discovery.Node) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(node.Uri(), "/")+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		grpcStatus := resp.Trailer.Get("Grpc-Status")
+		if grpcStatus == "" {
+			grpcStatus = resp.Header.Get("Grpc-Status")
+		}
+		if grpcStatus != "0" {
+			return fmt.Errorf("grpc status %s,message:%s", grpcStatus, resp.Trailer.Get("Grpc-Message"))
+		}
+		if len(data) < 5 {
+			return errors.New("grpc health check response is empty")
+		}
+		// HealthCheckResponse{status = 1}，SERVING = 1
+		status, err := readStatus(data[5:])
+		if err != nil {
+			return err
+		}
+		if status != 1 {
+			return fmt.Errorf("grpc serving status %d", status)
+		}
+		return nil
+	}
+}
+
+func readStatus(msg []byte) (uint64, error) {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("invalid grpc health check response")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("invalid grpc health check response")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				return v, nil
+			}
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("invalid grpc health check response")
+			}
+			msg = msg[uint64(n)+l:]
+		default:
+			return 0, errors.New("invalid grpc health check response")
+		}
+	}
+	// 默认值 UNKNOWN 不会被编码
+	return 0, nil
+}
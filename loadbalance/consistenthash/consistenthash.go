@@ -0,0 +1,228 @@
+package consistenthash
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"mini-gateway/reqcontext"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// 相同 key 的请求总是选择同一个节点，key 由端点的 hashOn 配置决定，没有 key 时随机选择节点
+const (
+	// NAME 等同于 RING
+	NAME = "consistentHash"
+	// RING 环形哈希，节点增减时只影响相邻区间的 key
+	RING = "ringHash"
+	// MAGLEV 查找表固定大小，选择节点的开销为常数，节点增减时重新映射的 key 略多于环形哈希
+	MAGLEV = "maglev"
+)
+
+const (
+	// 每单位权重的虚拟节点数，节点增减时其他节点的虚拟节点不变
+	replicasPerWeight = 160
+	// 环上虚拟节点的最大数量，超过时按比例减少每个节点的虚拟节点
+	maxRingSize = 1 << 17
+	// maglev 查找表的大小，必须是质数
+	maglevTableSize = 65537
+)
+
+func init() {
+	loadbalance.Register(NAME, RingFactor)
+	loadbalance.Register(RING, RingFactor)
+	loadbalance.Register(MAGLEV, MaglevFactor)
+}
+
+func RingFactor() loadbalance.Picker {
+	return &picker{build: newRing}
+}
+
+func MaglevFactor() loadbalance.Picker {
+	return &picker{build: newMaglev}
+}
+
+// table lookup 从 hash 对应的位置开始，跳过 skip 为 true 的节点
+type table interface {
+	lookup(hash uint64, skip func(discovery.Node) bool) discovery.Node
+}
+
+type picker struct {
+	build func(nodes []discovery.Node) table
+	nodes atomic.Pointer[group]
+}
+
+type group struct {
+	nodes []discovery.Node
+	table table
+}
+
+func (p *picker) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	g := p.nodes.Load()
+	if g == nil || len(g.nodes) == 0 {
+		return nil, nil, errors.New("no node was found")
+	}
+	key, ok := reqcontext.HashKey(ctx)
+	if !ok {
+		return g.nodes[rand.Intn(len(g.nodes))], nil, nil
+	}
+	// 重试时沿环或查找表找下一个没有尝试过的节点，都尝试过时仍然选择原来的节点
+	skip := func(discovery.Node) bool { return false }
+	if tried, ok := reqcontext.Tried(ctx); ok && len(tried) > 0 {
+		remaining := 0
+		for _, n := range g.nodes {
+			if !tried[n.Uri()] {
+				remaining++
+			}
+		}
+		if remaining > 0 {
+			skip = func(n discovery.Node) bool { return tried[n.Uri()] }
+		}
+	}
+	return g.table.lookup(hash(key), skip), nil, nil
+}
+
+func (p *picker) Apply(nodes []discovery.Node) {
+	ns := make([]discovery.Node, 0, len(nodes))
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if seen[n.Uri()] {
+			continue
+		}
+		seen[n.Uri()] = true
+		ns = append(ns, n)
+	}
+	if len(ns) == 0 {
+		p.nodes.Store(&group{})
+		return
+	}
+	// 按 uri 排序，同样的节点无论顺序如何都得到同样的结果
+	sort.Slice(ns, func(i, j int) bool {
+		return ns[i].Uri() < ns[j].Uri()
+	})
+	p.nodes.Store(&group{nodes: ns, table: p.build(ns)})
+}
+
+func weightOf(n discovery.Node) int {
+	if n.Weight() <= 0 {
+		return 1
+	}
+	return n.Weight()
+}
+
+type ringEntry struct {
+	hash uint64
+	node discovery.Node
+}
+
+type ring []ringEntry
+
+// newRing 每个节点的虚拟节点数与权重成正比
+func newRing(nodes []discovery.Node) table {
+	total := 0
+	for _, n := range nodes {
+		total += weightOf(n)
+	}
+	scale := float64(replicasPerWeight)
+	if total*replicasPerWeight > maxRingSize {
+		scale = float64(maxRingSize) / float64(total)
+	}
+	r := make(ring, 0, int(scale*float64(total))+len(nodes))
+	for _, n := range nodes {
+		replicas := int(scale*float64(weightOf(n))) + 1
+		for i := 0; i < replicas; i++ {
+			r = append(r, ringEntry{hash: hash(n.Uri() + "_" + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].hash < r[j].hash
+	})
+	return r
+}
+
+func (r ring) lookup(h uint64, skip func(discovery.Node) bool) discovery.Node {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].hash >= h
+	})
+	for j := 0; j < len(r); j++ {
+		if n := r[(i+j)%len(r)].node; !skip(n) {
+			return n
+		}
+	}
+	return r[i%len(r)].node
+}
+
+type maglev []discovery.Node
+
+// newMaglev 按 Maglev 论文生成查找表，权重大的节点每轮有更多机会填充
+func newMaglev(nodes []discovery.Node) table {
+	const m = maglevTableSize
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+	weights := make([]float64, len(nodes))
+	acc := make([]float64, len(nodes))
+	maxWeight := 0
+	for i, n := range nodes {
+		offsets[i] = hash(n.Uri()) % m
+		skips[i] = hash(n.Uri()+"_skip")%(m-1) + 1
+		if w := weightOf(n); w > maxWeight {
+			maxWeight = w
+		}
+	}
+	for i, n := range nodes {
+		weights[i] = float64(weightOf(n)) / float64(maxWeight)
+	}
+
+	t := make(maglev, m)
+	filled := 0
+	for filled < m {
+		for i := range nodes {
+			acc[i] += weights[i]
+			if acc[i] < 1 {
+				continue
+			}
+			acc[i]--
+			for {
+				c := (offsets[i] + next[i]*skips[i]) % m
+				next[i]++
+				if t[c] == nil {
+					t[c] = nodes[i]
+					filled++
+					break
+				}
+			}
+			if filled == m {
+				break
+			}
+		}
+	}
+	return t
+}
+
+func (t maglev) lookup(h uint64, skip func(discovery.Node) bool) discovery.Node {
+	i := h % uint64(len(t))
+	for j := uint64(0); j < uint64(len(t)); j++ {
+		if n := t[(i+j)%uint64(len(t))]; !skip(n) {
+			return n
+		}
+	}
+	return t[i]
+}
+
+// hash FNV-1a 加上 splitmix64 的混合，相近的字符串也能均匀分布
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
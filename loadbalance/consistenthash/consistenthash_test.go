@@ -0,0 +1,40 @@
+package consistenthash
+
+import (
+	"context"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"mini-gateway/reqcontext"
+	"testing"
+)
+
+// 重试时跳过已经尝试过的节点，都尝试过时仍然选择原来的节点
+func TestNextSkipsTriedNodes(t *testing.T) {
+	nodes := []discovery.Node{
+		discovery.NewNode("http://10.0.0.1:80", 1, nil),
+		discovery.NewNode("http://10.0.0.2:80", 1, nil),
+		discovery.NewNode("http://10.0.0.3:80", 1, nil),
+	}
+	for name, f := range map[string]loadbalance.Factory{RING: RingFactor, MAGLEV: MaglevFactor} {
+		p := f()
+		p.Apply(nodes)
+		ctx := reqcontext.WithHashKey(context.Background(), "user-42")
+		first, _, _ := p.Next(ctx)
+
+		tried := map[string]bool{first.Uri(): true}
+		second, _, _ := p.Next(reqcontext.WithTried(ctx, tried))
+		if second.Uri() == first.Uri() {
+			t.Fatalf("%s picked tried node %s again", name, first.Uri())
+		}
+		if again, _, _ := p.Next(reqcontext.WithTried(ctx, tried)); again.Uri() != second.Uri() {
+			t.Fatalf("%s should pick the same next node,got %s and %s", name, second.Uri(), again.Uri())
+		}
+
+		for _, n := range nodes {
+			tried[n.Uri()] = true
+		}
+		if n, _, _ := p.Next(reqcontext.WithTried(ctx, tried)); n.Uri() != first.Uri() {
+			t.Fatalf("%s should fall back to %s when all nodes are tried,got %s", name, first.Uri(), n.Uri())
+		}
+	}
+}
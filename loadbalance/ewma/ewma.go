@@ -0,0 +1,141 @@
+package ewma
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NAME peak EWMA，随机选择两个节点，取 延迟 x (处理中请求数+1) 较小的一个。
+// 延迟变大时立即采用新值，变小时按指数加权平均逐渐衰减
+const NAME = "ewma"
+
+const (
+	// 衰减的时间常数，越小对延迟变化越敏感
+	decayTime = 10 * time.Second
+	// 没有延迟样本且有处理中请求的节点的代价，新节点在得到样本前一次只接收一个请求
+	penalty = float64(math.MaxInt32)
+	// 失败和 5xx 响应按不小于此值的延迟记录，避免快速失败的节点因延迟低而得到更多请求
+	failureLatency = time.Second
+)
+
+func init() {
+	loadbalance.Register(NAME, Factor)
+}
+
+func Factor() loadbalance.Picker {
+	return newEwmaPicker()
+}
+
+func newEwmaPicker() *ewma {
+	return &ewma{stats: make(map[string]*stats)}
+}
+
+type ewma struct {
+	nodes atomic.Value
+	// nodes []*state
+	mux sync.Mutex
+	// stats 按 uri 保存延迟和处理中的请求数，节点更新后不会丢失
+	stats map[string]*stats
+}
+
+type state struct {
+	node  discovery.Node
+	stats *stats
+}
+
+type stats struct {
+	outstanding atomic.Int64
+	mux         sync.Mutex
+	// latency 单位纳秒
+	latency float64
+	stamp   time.Time
+}
+
+func (s *stats) cost() float64 {
+	s.mux.Lock()
+	latency := s.latency
+	s.mux.Unlock()
+	outstanding := float64(s.outstanding.Load())
+	if latency == 0 && outstanding > 0 {
+		return penalty + outstanding
+	}
+	return latency * (outstanding + 1)
+}
+
+func (s *stats) observe(rtt time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(s.stamp)
+	s.stamp = now
+	v := float64(rtt)
+	if v > s.latency {
+		s.latency = v
+		return
+	}
+	w := math.Exp(-float64(elapsed) / float64(decayTime))
+	s.latency = s.latency*w + v*(1-w)
+}
+
+func (s *ewma) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	n, _ := s.nodes.Load().([]*state)
+	if len(n) == 0 {
+		return nil, nil, errors.New("no node was found")
+	}
+
+	picked := n[rand.Intn(len(n))]
+	if len(n) > 1 {
+		i := rand.Intn(len(n) - 1)
+		if n[i] == picked {
+			i = len(n) - 1
+		}
+		if n[i].stats.cost() < picked.stats.cost() {
+			picked = n[i]
+		}
+	}
+
+	st := picked.stats
+	st.outstanding.Add(1)
+	return picked.node, func(info loadbalance.DoneInfo) {
+		st.outstanding.Add(-1)
+		switch {
+		// 与节点无关或客户端取消的请求不记录延迟
+		case errors.Is(info.Err, loadbalance.ErrIgnored) || errors.Is(info.Err, context.Canceled):
+		case info.Err != nil || info.StatusCode >= 500:
+			latency := info.Latency
+			if latency < failureLatency {
+				latency = failureLatency
+			}
+			st.observe(latency)
+		default:
+			st.observe(info.Latency)
+		}
+	}, nil
+}
+
+func (s *ewma) Apply(nodes []discovery.Node) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	all := make(map[string]*stats, len(nodes))
+	ns := make([]*state, 0, len(nodes))
+	for _, n := range nodes {
+		if _, ok := all[n.Uri()]; ok {
+			continue
+		}
+		st, ok := s.stats[n.Uri()]
+		if !ok {
+			st = &stats{stamp: time.Now()}
+		}
+		all[n.Uri()] = st
+		ns = append(ns, &state{node: n, stats: st})
+	}
+	s.stats = all
+	s.nodes.Store(ns)
+}
@@ -0,0 +1,64 @@
+package ewma
+
+import (
+	"context"
+	"errors"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 失败和 5xx 响应按惩罚延迟记录，与节点无关的结果不记录
+func TestFailuresArePenalized(t *testing.T) {
+	cases := map[string]struct {
+		info    loadbalance.DoneInfo
+		latency time.Duration
+	}{
+		"success":        {loadbalance.DoneInfo{StatusCode: http.StatusOK, Latency: 10 * time.Millisecond}, 10 * time.Millisecond},
+		"client error":   {loadbalance.DoneInfo{StatusCode: http.StatusNotFound, Latency: 10 * time.Millisecond}, 10 * time.Millisecond},
+		"fast failure":   {loadbalance.DoneInfo{Err: errors.New("connection refused"), Latency: time.Millisecond}, failureLatency},
+		"server error":   {loadbalance.DoneInfo{StatusCode: http.StatusBadGateway, Latency: time.Millisecond}, failureLatency},
+		"slow failure":   {loadbalance.DoneInfo{Err: context.DeadlineExceeded, Latency: 3 * time.Second}, 3 * time.Second},
+		"ignored":        {loadbalance.DoneInfo{Err: loadbalance.ErrIgnored}, 0},
+		"client cancels": {loadbalance.DoneInfo{Err: context.Canceled, Latency: time.Millisecond}, 0},
+	}
+	for name, c := range cases {
+		p := newEwmaPicker()
+		p.Apply([]discovery.Node{discovery.NewNode("http://a", 1, nil)})
+		_, done, err := p.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(c.info)
+		if got := time.Duration(p.stats["http://a"].latency); got != c.latency {
+			t.Errorf("%s: expected latency %s,got %s", name, c.latency, got)
+		}
+	}
+}
+
+// 快速失败的节点不会因延迟低而得到更多请求
+func TestFailingNodeLosesTraffic(t *testing.T) {
+	p := newEwmaPicker()
+	p.Apply([]discovery.Node{discovery.NewNode("http://ok", 1, nil), discovery.NewNode("http://bad", 1, nil)})
+	for i := 0; i < 20; i++ {
+		n, done, _ := p.Next(context.Background())
+		if n.Uri() == "http://bad" {
+			done(loadbalance.DoneInfo{StatusCode: http.StatusServiceUnavailable, Latency: time.Millisecond})
+		} else {
+			done(loadbalance.DoneInfo{StatusCode: http.StatusOK, Latency: 50 * time.Millisecond})
+		}
+	}
+	bad := 0
+	for i := 0; i < 100; i++ {
+		n, done, _ := p.Next(context.Background())
+		if n.Uri() == "http://bad" {
+			bad++
+		}
+		done(loadbalance.DoneInfo{Err: loadbalance.ErrIgnored})
+	}
+	if bad > 0 {
+		t.Fatalf("failing node should lose traffic,got %d of 100 requests", bad)
+	}
+}
@@ -0,0 +1,114 @@
+package leastrequest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"mini-gateway/discovery"
+	"mini-gateway/loadbalance"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// NAME 选择处理中请求数最少的节点
+	NAME = "leastRequest"
+	// P2C 随机选择两个节点，取处理中请求数较少的一个，节点很多时开销比 leastRequest 小
+	P2C = "p2c"
+)
+
+func init() {
+	loadbalance.Register(NAME, Factor)
+	loadbalance.Register(P2C, P2CFactor)
+}
+
+func Factor() loadbalance.Picker {
+	return newLeastRequestPicker(false)
+}
+
+func P2CFactor() loadbalance.Picker {
+	return newLeastRequestPicker(true)
+}
+
+func newLeastRequestPicker(p2c bool) *leastRequest {
+	return &leastRequest{p2c: p2c, counters: make(map[string]*atomic.Int64)}
+}
+
+type leastRequest struct {
+	p2c   bool
+	nodes atomic.Value
+	// nodes []*state
+	mux sync.Mutex
+	// counters 按 uri 保存处理中的请求数，节点更新后不会丢失
+	counters map[string]*atomic.Int64
+}
+
+type state struct {
+	node        discovery.Node
+	weight      float64
+	outstanding *atomic.Int64
+}
+
+// load 权重越大的节点可以承担越多的请求
+func (s *state) load() float64 {
+	return float64(s.outstanding.Load()+1) / s.weight
+}
+
+func (s *leastRequest) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	n, _ := s.nodes.Load().([]*state)
+	if len(n) == 0 {
+		return nil, nil, errors.New("no node was found")
+	}
+
+	var picked *state
+	if s.p2c || len(n) == 1 {
+		picked = n[rand.Intn(len(n))]
+		if len(n) > 1 {
+			i := rand.Intn(len(n) - 1)
+			if n[i] == picked {
+				i = len(n) - 1
+			}
+			if n[i].load() < picked.load() {
+				picked = n[i]
+			}
+		}
+	} else {
+		// 从随机位置开始遍历，负载相同时不总是选择第一个节点
+		offset := rand.Intn(len(n))
+		for i := range n {
+			c := n[(offset+i)%len(n)]
+			if picked == nil || c.load() < picked.load() {
+				picked = c
+			}
+		}
+	}
+
+	picked.outstanding.Add(1)
+	return picked.node, func(loadbalance.DoneInfo) {
+		picked.outstanding.Add(-1)
+	}, nil
+}
+
+func (s *leastRequest) Apply(nodes []discovery.Node) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	counters := make(map[string]*atomic.Int64, len(nodes))
+	ns := make([]*state, 0, len(nodes))
+	for _, n := range nodes {
+		if _, ok := counters[n.Uri()]; ok {
+			continue
+		}
+		counter, ok := s.counters[n.Uri()]
+		if !ok {
+			counter = &atomic.Int64{}
+		}
+		counters[n.Uri()] = counter
+		weight := n.Weight()
+		if weight <= 0 {
+			weight = 1
+		}
+		ns = append(ns, &state{node: n, weight: float64(weight), outstanding: counter})
+	}
+	s.counters = counters
+	s.nodes.Store(ns)
+}
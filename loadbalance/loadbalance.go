@@ -2,17 +2,38 @@ package loadbalance
 
 import (
 	"context"
+	"errors"
 	"mini-gateway/discovery"
 	"sync"
+	"time"
 )
 
 var pickerFactory = sync.Map{}
 
+// Picker Next 返回的 DoneFunc 可以为空，不为空时调用方必须在请求结束后调用一次
 type Picker interface {
-	Next(ctx context.Context) (discovery.Node, error)
+	Next(ctx context.Context) (discovery.Node, DoneFunc, error)
 	Apply(nodes []discovery.Node)
 }
 
+// ErrIgnored 请求结果与节点无关，比如重试时放弃的节点、读取客户端请求体失败，picker 不计入节点的失败和延迟
+var ErrIgnored = errors.New("request result is not related to the node")
+
+// DoneInfo 请求结束时反馈给 picker 的信息，Err 为 ErrIgnored 时 Latency 没有意义
+type DoneInfo struct {
+	Err        error
+	StatusCode int
+	// Latency 从发出请求到收到响应头的时间
+	Latency time.Duration
+}
+
+type DoneFunc func(info DoneInfo)
+
+// SlowStarter 支持慢启动的 picker，新加入的节点在 window 内权重逐渐增加到配置的权重
+type SlowStarter interface {
+	SetSlowStart(window time.Duration, minWeightPercent int)
+}
+
 type Factory func() Picker
 
 func Register(name string, f Factory) {
@@ -2,10 +2,9 @@ package rotation
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"mini-gateway/discovery"
 	"mini-gateway/loadbalance"
-	"mini-gateway/reqcontext"
 	"sync/atomic"
 )
 
@@ -24,45 +23,22 @@ func newRotationPicker() *rotationPicker {
 }
 
 type rotationPicker struct {
+	index atomic.Uint32
 	nodes atomic.Value
-	// nodes map[string]*node
+	// nodes []discovery.Node
 }
 
-func (s *rotationPicker) Next(ctx context.Context) (discovery.Node, error) {
-	color, _ := reqcontext.Color(ctx)
-	n := s.nodes.Load().(map[string]*node)[color]
-	if n == nil {
-		return nil, fmt.Errorf("no node for color:%s was found", color)
-	}
-
-	for {
-		index := n.index.Add(1)
-		if index < int32(len(n.nodes)) {
-			return n.nodes[index], nil
-		}
-		if n.index.CompareAndSwap(index, 0) {
-			return n.nodes[0], nil
-		}
+func (s *rotationPicker) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	ns, _ := s.nodes.Load().([]discovery.Node)
+	if len(ns) == 0 {
+		return nil, nil, errors.New("no node was found")
 	}
+	index := s.index.Add(1) - 1
+	return ns[index%uint32(len(ns))], nil, nil
 }
 
 func (s *rotationPicker) Apply(nodes []discovery.Node) {
-	ns := make(map[string]*node)
-	for _, n := range nodes {
-		color, _ := n.Tag("color")
-		if v, ok := ns[color]; ok {
-			v.nodes = append(v.nodes, n)
-		} else {
-			newNode := &node{index: atomic.Int32{}}
-			newNode.index.Store(-1)
-			newNode.nodes = append(newNode.nodes, n)
-			ns[color] = newNode
-		}
-	}
+	ns := make([]discovery.Node, len(nodes))
+	copy(ns, nodes)
 	s.nodes.Store(ns)
 }
-
-type node struct {
-	index atomic.Int32
-	nodes []discovery.Node
-}
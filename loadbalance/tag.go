@@ -0,0 +1,137 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"mini-gateway/discovery"
+	"mini-gateway/reqcontext"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 所有候选分区都没有节点时的处理
+const (
+	// PolicyFail 返回错误
+	PolicyFail = "fail"
+	// PolicyFallback 使用没有标签的节点
+	PolicyFallback = "fallback"
+	// PolicyAny 使用所有节点
+	PolicyAny = "any"
+)
+
+// DefaultTags 没有配置时只按 color 标签划分节点
+var DefaultTags = []string{"color"}
+
+// NewTagPicker 按节点标签把节点划分为多个分区，每个分区使用 f 创建的 picker，分区的 picker 在节点更新后保留。
+// 请求的标签没有节点时按 fallback 依次尝试，fallback 的 key 和值为各标签的值按 tags 的顺序用逗号连接，
+// 比如 tags 为 [color] 时 gray: [blue, ""] 表示 gray 没有节点时使用 blue，再使用没有 color 标签的节点
+func NewTagPicker(f Factory, tags []string, fallback map[string][]string, policy string) Picker {
+	if len(tags) == 0 {
+		tags = DefaultTags
+	}
+	if policy == "" {
+		policy = PolicyFail
+	}
+	return &tagPicker{
+		factory:  f,
+		tags:     tags,
+		fallback: fallback,
+		policy:   policy,
+		pickers:  make(map[string]Picker),
+	}
+}
+
+type tagPicker struct {
+	factory  Factory
+	tags     []string
+	fallback map[string][]string
+	policy   string
+
+	mux     sync.Mutex
+	pickers map[string]Picker
+	all     Picker
+	current atomic.Pointer[partitions]
+}
+
+type partitions struct {
+	pickers map[string]Picker
+	all     Picker
+}
+
+func (p *tagPicker) Next(ctx context.Context) (discovery.Node, DoneFunc, error) {
+	key := p.requestKey(ctx)
+	current := p.current.Load()
+	if current == nil {
+		return nil, nil, fmt.Errorf("no node for tags:%s was found", key)
+	}
+	if picker, ok := current.pickers[key]; ok {
+		return picker.Next(ctx)
+	}
+	for _, k := range p.fallback[key] {
+		if picker, ok := current.pickers[k]; ok {
+			return picker.Next(ctx)
+		}
+	}
+	switch p.policy {
+	case PolicyFallback:
+		if picker, ok := current.pickers[p.defaultKey()]; ok {
+			return picker.Next(ctx)
+		}
+	case PolicyAny:
+		if current.all != nil {
+			return current.all.Next(ctx)
+		}
+	}
+	return nil, nil, fmt.Errorf("no node for tags:%s was found", key)
+}
+
+func (p *tagPicker) requestKey(ctx context.Context) string {
+	tags, _ := reqcontext.Tags(ctx)
+	values := make([]string, len(p.tags))
+	for i, t := range p.tags {
+		values[i] = tags[t]
+	}
+	return strings.Join(values, ",")
+}
+
+func (p *tagPicker) defaultKey() string {
+	return strings.Repeat(",", len(p.tags)-1)
+}
+
+func (p *tagPicker) nodeKey(n discovery.Node) string {
+	values := make([]string, len(p.tags))
+	for i, t := range p.tags {
+		values[i], _ = n.Tag(t)
+	}
+	return strings.Join(values, ",")
+}
+
+func (p *tagPicker) Apply(nodes []discovery.Node) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	groups := make(map[string][]discovery.Node)
+	for _, n := range nodes {
+		key := p.nodeKey(n)
+		groups[key] = append(groups[key], n)
+	}
+	pickers := make(map[string]Picker, len(groups))
+	for key, ns := range groups {
+		picker, ok := p.pickers[key]
+		if !ok {
+			picker = p.factory()
+		}
+		picker.Apply(ns)
+		pickers[key] = picker
+	}
+	var all Picker
+	if p.policy == PolicyAny && len(nodes) > 0 {
+		if p.all == nil {
+			p.all = p.factory()
+		}
+		p.all.Apply(nodes)
+		all = p.all
+	}
+	p.pickers = pickers
+	p.current.Store(&partitions{pickers: pickers, all: all})
+}
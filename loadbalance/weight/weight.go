@@ -2,16 +2,21 @@ package weight
 
 import (
 	"context"
-	"fmt"
-	"math/rand"
+	"errors"
 	"mini-gateway/discovery"
 	"mini-gateway/loadbalance"
-	"mini-gateway/reqcontext"
+	"mini-gateway/slog"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// NAME 平滑加权轮询，与 nginx 的算法相同，权重大的节点不会连续被选中
 const NAME = "weight"
 
+// 慢启动期间的最小权重百分比
+const defaultMinWeightPercent = 10
+
 func init() {
 	loadbalance.Register(NAME, Factor)
 }
@@ -21,41 +26,118 @@ func Factor() loadbalance.Picker {
 }
 
 func newWeightPicker() *weight {
-	return &weight{}
+	return &weight{states: make(map[string]*state)}
 }
 
 type weight struct {
-	nodes atomic.Value
-	// nodes map[string]*node
+	nodes atomic.Pointer[group]
+	mux   sync.Mutex
+	// states 按 uri 保存节点状态，节点更新后当前权重和加入时间不会丢失
+	states  map[string]*state
+	applied bool
+
+	slowStartWindow  time.Duration
+	minWeightPercent int
+}
+
+type group struct {
+	mux    sync.Mutex
+	states []*state
+}
+
+type state struct {
+	group   *group
+	node    discovery.Node
+	weight  float64
+	current float64
+	addedAt time.Time
+	// invalid 配置的权重不大于 0，只在第一次出现时告警
+	invalid bool
 }
 
-func (s *weight) Next(ctx context.Context) (discovery.Node, error) {
-	color, _ := reqcontext.Color(ctx)
-	n := s.nodes.Load().(map[string]*node)[color]
-	if n == nil {
-		return nil, fmt.Errorf("no node for color:%s was found", color)
+// SetSlowStart 新加入的节点在 window 内权重从 minWeightPercent% 线性增加到配置的权重，
+// 第一次应用的节点不做慢启动
+func (s *weight) SetSlowStart(window time.Duration, minWeightPercent int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if minWeightPercent <= 0 || minWeightPercent > 100 {
+		minWeightPercent = defaultMinWeightPercent
 	}
-	index := rand.Intn(len(n.nodes))
-	return n.nodes[index], nil
+	s.slowStartWindow = window
+	s.minWeightPercent = minWeightPercent
 }
 
+func (s *weight) Next(ctx context.Context) (discovery.Node, loadbalance.DoneFunc, error) {
+	g := s.nodes.Load()
+	if g == nil || len(g.states) == 0 {
+		return nil, nil, errors.New("no node was found")
+	}
+
+	now := time.Now()
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	var best *state
+	total := 0.0
+	for _, st := range g.states {
+		w := s.effectiveWeight(st, now)
+		st.current += w
+		total += w
+		if best == nil || st.current > best.current {
+			best = st
+		}
+	}
+	best.current -= total
+	return best.node, nil, nil
+}
+
+func (s *weight) effectiveWeight(st *state, now time.Time) float64 {
+	if s.slowStartWindow <= 0 || st.addedAt.IsZero() {
+		return st.weight
+	}
+	elapsed := now.Sub(st.addedAt)
+	if elapsed >= s.slowStartWindow {
+		return st.weight
+	}
+	factor := float64(elapsed) / float64(s.slowStartWindow)
+	if min := float64(s.minWeightPercent) / 100; factor < min {
+		factor = min
+	}
+	return st.weight * factor
+}
+
+// Apply 节点的权重可以随时调整，已存在的节点保留当前权重，权重不大于 0 时按 1 处理
 func (s *weight) Apply(nodes []discovery.Node) {
-	ns := make(map[string]*node)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	states := make(map[string]*state, len(nodes))
+	g := &group{}
 	for _, n := range nodes {
-		for i := 0; i < n.Weight(); i++ {
-			color, _ := n.Tag("color")
-			if v, ok := ns[color]; ok {
-				v.nodes = append(v.nodes, n)
-			} else {
-				newNode := &node{}
-				newNode.nodes = append(newNode.nodes, n)
-				ns[color] = newNode
+		if _, ok := states[n.Uri()]; ok {
+			continue
+		}
+		w := n.Weight()
+		old, exist := s.states[n.Uri()]
+		invalid := w <= 0
+		if invalid {
+			if !exist || !old.invalid {
+				slog.Warn("node %s weight %d is invalid,1 is used by default", n.Uri(), w)
 			}
+			w = 1
+		}
+		st := &state{group: g, node: n, weight: float64(w), invalid: invalid}
+		if exist {
+			old.group.mux.Lock()
+			st.current = old.current
+			old.group.mux.Unlock()
+			st.addedAt = old.addedAt
+		} else if s.applied && s.slowStartWindow > 0 {
+			st.addedAt = now
 		}
+		states[n.Uri()] = st
+		g.states = append(g.states, st)
 	}
-	s.nodes.Store(ns)
-}
-
-type node struct {
-	nodes []discovery.Node
+	s.states = states
+	s.applied = true
+	s.nodes.Store(g)
 }
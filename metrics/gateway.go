@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+)
+
+var (
+	Requests = NewCounterVec("gateway_requests_total",
+		"Total number of requests handled by the gateway.", "endpoint", "method", "code")
+	RequestDuration = NewHistogramVec("gateway_request_duration_seconds",
+		"Request latency in seconds.", DefaultLatencyBuckets, "endpoint", "method", "code")
+	RequestsInFlight = NewGaugeVec("gateway_requests_in_flight",
+		"Number of requests currently being served.", "endpoint")
+	RequestSize = NewHistogramVec("gateway_request_size_bytes",
+		"Request body size in bytes.", DefaultSizeBuckets, "endpoint", "method")
+	ResponseSize = NewHistogramVec("gateway_response_size_bytes",
+		"Response body size in bytes.", DefaultSizeBuckets, "endpoint", "method", "code")
+
+	UpstreamRequests = NewCounterVec("gateway_upstream_requests_total",
+		"Total number of requests sent to upstream nodes.", "endpoint", "node", "code")
+	UpstreamDuration = NewHistogramVec("gateway_upstream_request_duration_seconds",
+		"Upstream request latency in seconds until response headers are received.", DefaultLatencyBuckets, "endpoint", "node")
+	Retries = NewCounterVec("gateway_upstream_retries_total",
+		"Total number of upstream retries.", "endpoint")
+
+	MirrorRequests = NewCounterVec("gateway_mirror_requests_total",
+		"Total number of mirrored requests, result is the code class, error, dropped or skipped.", "endpoint", "result")
+	MirrorDuration = NewHistogramVec("gateway_mirror_request_duration_seconds",
+		"Mirrored request latency in seconds until response headers are received.", DefaultLatencyBuckets, "endpoint")
+
+	DiscoveredNodes = NewGaugeFuncVec("gateway_discovered_nodes",
+		"Number of nodes discovered or configured for the endpoint.", "endpoint")
+	PickerNodes = NewGaugeFuncVec("gateway_picker_nodes",
+		"Number of nodes in load balancer rotation, excluding ejected and unhealthy nodes.", "endpoint")
+	NodeHealthy = NewGaugeFuncVec("gateway_upstream_node_healthy",
+		"Active health check state of upstream nodes, 1 is healthy.", "endpoint", "node")
+	CircuitBreakerState = NewGaugeFuncVec("gateway_circuit_breaker_state",
+		"Circuit breaker state of upstream nodes, 0 closed, 1 open, 2 half-open.", "endpoint", "node")
+
+	ConfigReloads = NewCounterVec("gateway_config_reloads_total",
+		"Total number of configuration reloads.", "source", "result")
+)
+
+// CodeClass 把状态码归类为 2xx、4xx 等，0 表示请求没有得到响应
+func CodeClass(code int) string {
+	if code < 100 || code > 599 {
+		return "error"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// ReloadResult 配置重载结果的标签值
+func ReloadResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+type partialDeleter interface {
+	DeletePartial(labels map[string]string) int
+}
+
+// endpointVecs 带 endpoint 标签的指标，nodeVecs 带 node 标签的指标
+var (
+	endpointVecs = []partialDeleter{Requests, RequestDuration, RequestsInFlight, RequestSize, ResponseSize,
+		UpstreamRequests, UpstreamDuration, Retries, MirrorRequests, MirrorDuration}
+	nodeVecs = []partialDeleter{UpstreamRequests, UpstreamDuration}
+)
+
+// endpointNodes 端点最近一次应用的节点，跨端点重建保留，用于找出下线的节点
+var endpointNodes = struct {
+	sync.Mutex
+	m map[string]map[string]bool
+}{m: make(map[string]map[string]bool)}
+
+// SetNodes 记录端点当前的节点，删除已下线节点的指标
+func SetNodes(endpointID string, uris []string) {
+	current := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		current[uri] = true
+	}
+	endpointNodes.Lock()
+	previous := endpointNodes.m[endpointID]
+	endpointNodes.m[endpointID] = current
+	endpointNodes.Unlock()
+	for uri := range previous {
+		if current[uri] {
+			continue
+		}
+		for _, v := range nodeVecs {
+			v.DeletePartial(map[string]string{"endpoint": endpointID, "node": uri})
+		}
+	}
+}
+
+// DeleteEndpoint 删除端点的全部指标，端点被移除时调用
+func DeleteEndpoint(endpointID string) {
+	endpointNodes.Lock()
+	delete(endpointNodes.m, endpointID)
+	endpointNodes.Unlock()
+	for _, v := range endpointVecs {
+		v.DeletePartial(map[string]string{"endpoint": endpointID})
+	}
+}
@@ -0,0 +1,404 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	DefaultSizeBuckets    = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+var defaultRegistry = &registry{}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type registry struct {
+	mux        sync.RWMutex
+	collectors []collector
+}
+
+func (r *registry) register(c collector) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Handler 以 Prometheus 文本格式输出所有指标
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		defaultRegistry.mux.RLock()
+		for _, c := range defaultRegistry.collectors {
+			c.write(bw)
+		}
+		defaultRegistry.mux.RUnlock()
+		_ = bw.Flush()
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d *desc) writeSample(w *bufio.Writer, name string, labelValues []string, extra string, value float64) {
+	w.WriteString(name)
+	if len(d.labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(labelValues[i]))
+			w.WriteByte('"')
+		}
+		if extra != "" {
+			if len(d.labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expected %d label values,got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// value 原子操作的 float64
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if v.bits.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) Get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+type series[T any] struct {
+	labelValues []string
+	metric      T
+}
+
+// vec 按标签值保存指标
+type vec[T any] struct {
+	desc
+	mux    sync.RWMutex
+	series map[string]*series[T]
+	newT   func() T
+}
+
+func (v *vec[T]) with(labelValues []string) T {
+	key := v.key(labelValues)
+	v.mux.RLock()
+	s, ok := v.series[key]
+	v.mux.RUnlock()
+	if ok {
+		return s.metric
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	s = &series[T]{labelValues: append([]string(nil), labelValues...), metric: v.newT()}
+	v.series[key] = s
+	return s.metric
+}
+
+// Delete 删除指定标签值的指标
+func (v *vec[T]) Delete(labelValues ...string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	delete(v.series, v.key(labelValues))
+}
+
+// DeletePartial 删除标签值匹配 labels 的全部指标，返回删除的数量
+func (v *vec[T]) DeletePartial(labels map[string]string) int {
+	idx := make(map[int]string, len(labels))
+	for name, value := range labels {
+		i := indexOf(v.labels, name)
+		if i < 0 {
+			return 0
+		}
+		idx[i] = value
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	n := 0
+	for key, s := range v.series {
+		match := true
+		for i, value := range idx {
+			if s.labelValues[i] != value {
+				match = false
+				break
+			}
+		}
+		if match {
+			delete(v.series, key)
+			n++
+		}
+	}
+	return n
+}
+
+func indexOf(labels []string, name string) int {
+	for i, l := range labels {
+		if l == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (v *vec[T]) sorted() []*series[T] {
+	v.mux.RLock()
+	ss := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		ss = append(ss, s)
+	}
+	v.mux.RUnlock()
+	sort.Slice(ss, func(i, j int) bool {
+		return strings.Join(ss[i].labelValues, "\xff") < strings.Join(ss[j].labelValues, "\xff")
+	})
+	return ss
+}
+
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+type CounterVec struct {
+	vec[*Counter]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec[*Counter]{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		series: make(map[string]*series[*Counter]),
+		newT:   func() *Counter { return &Counter{} },
+	}}
+	defaultRegistry.register(v)
+	return v
+}
+
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.with(labelValues)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		v.writeSample(w, v.name, s.labelValues, "", s.metric.Get())
+	}
+}
+
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+type GaugeVec struct {
+	vec[*Gauge]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec[*Gauge]{
+		desc:   desc{name: name, help: help, typ: "gauge", labels: labels},
+		series: make(map[string]*series[*Gauge]),
+		newT:   func() *Gauge { return &Gauge{} },
+	}}
+	defaultRegistry.register(v)
+	return v
+}
+
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.with(labelValues)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		v.writeSample(w, v.name, s.labelValues, "", s.metric.Get())
+	}
+}
+
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64
+	sum         value
+	count       atomic.Uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+type HistogramVec struct {
+	vec[*Histogram]
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{
+		vec: vec[*Histogram]{
+			desc:   desc{name: name, help: help, typ: "histogram", labels: labels},
+			series: make(map[string]*series[*Histogram]),
+			newT: func() *Histogram {
+				return &Histogram{upperBounds: buckets, counts: make([]atomic.Uint64, len(buckets))}
+			},
+		},
+		buckets: buckets,
+	}
+	defaultRegistry.register(v)
+	return v
+}
+
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.with(labelValues)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		h := s.metric
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += h.counts[i].Load()
+			v.writeSample(w, v.name+"_bucket", s.labelValues, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		v.writeSample(w, v.name+"_bucket", s.labelValues, `le="+Inf"`, float64(h.count.Load()))
+		v.writeSample(w, v.name+"_sum", s.labelValues, "", h.sum.Get())
+		v.writeSample(w, v.name+"_count", s.labelValues, "", float64(h.count.Load()))
+	}
+}
+
+// GaugeFuncVec 在采集时通过回调获取数值，适合节点状态这类随时变化的集合
+type GaugeFuncVec struct {
+	desc
+	mux   sync.Mutex
+	id    uint64
+	funcs map[uint64]func(emit func(value float64, labelValues ...string))
+}
+
+func NewGaugeFuncVec(name, help string, labels ...string) *GaugeFuncVec {
+	v := &GaugeFuncVec{
+		desc:  desc{name: name, help: help, typ: "gauge", labels: labels},
+		funcs: make(map[uint64]func(emit func(value float64, labelValues ...string))),
+	}
+	defaultRegistry.register(v)
+	return v
+}
+
+// Register 注册采集回调，ctx 取消后自动注销
+func (v *GaugeFuncVec) Register(ctx context.Context, f func(emit func(value float64, labelValues ...string))) {
+	v.mux.Lock()
+	v.id++
+	id := v.id
+	v.funcs[id] = f
+	v.mux.Unlock()
+	go func() {
+		<-ctx.Done()
+		v.mux.Lock()
+		delete(v.funcs, id)
+		v.mux.Unlock()
+	}()
+}
+
+func (v *GaugeFuncVec) write(w *bufio.Writer) {
+	v.mux.Lock()
+	ids := make([]uint64, 0, len(v.funcs))
+	for id := range v.funcs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	fs := make([]func(emit func(value float64, labelValues ...string)), 0, len(ids))
+	for _, id := range ids {
+		fs = append(fs, v.funcs[id])
+	}
+	v.mux.Unlock()
+
+	v.writeHeader(w)
+	for _, f := range fs {
+		f(func(value float64, labelValues ...string) {
+			v.key(labelValues)
+			v.writeSample(w, v.name, labelValues, "", value)
+		})
+	}
+}
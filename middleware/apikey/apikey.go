@@ -0,0 +1,116 @@
+package apikey
+
+import (
+	"mini-gateway/config"
+	"mini-gateway/middleware"
+	"mini-gateway/middleware/consumer"
+	"mini-gateway/reqcontext"
+	"mini-gateway/slog"
+	"net/http"
+)
+
+const NAME = "apiKey"
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"header":          config.ArgString,
+		"query":           config.ArgString,
+		"hideCredentials": config.ArgBool,
+		"consumerHeader":  config.ArgString,
+		"consumers":       config.ArgList,
+		"file":            config.ArgString,
+	})
+}
+
+// Factory api key 鉴权中间件
+//
+//	header 读取 key 的请求头，默认 X-API-Key，query 不为空时也从该查询参数读取
+//	consumers 调用方列表，file 为同样格式的 yaml 文件，keys 建议使用 <keyId>.<hash> 形式的 bcrypt 或 argon2id 哈希
+//	hideCredentials 默认 true，不把 key 转发给上游，consumerHeader 不为空时通过该请求头转发调用方名称
+func Factory(c *config.Middleware) middleware.Middleware {
+	header := "X-API-Key"
+	query := ""
+	hideCredentials := true
+	consumerHeader := ""
+
+	if v, ok := c.Args["header"]; ok {
+		header = v.(string)
+	}
+	if v, ok := c.Args["query"]; ok {
+		query = v.(string)
+	}
+	if v, ok := c.Args["hideCredentials"]; ok {
+		hideCredentials = v.(bool)
+	}
+	if v, ok := c.Args["consumerHeader"]; ok {
+		consumerHeader = v.(string)
+	}
+	var verifier *consumer.KeyVerifier
+	consumers, err := consumer.Load(c)
+	if err == nil {
+		verifier, err = consumer.NewKeyVerifier(consumers)
+	}
+	if err != nil {
+		slog.Error("api key middleware error:%s,all requests will be rejected", err.Error())
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &apiKey{
+			header:          header,
+			query:           query,
+			hideCredentials: hideCredentials,
+			consumerHeader:  consumerHeader,
+			verifier:        verifier,
+			next:            next,
+		}
+	}
+}
+
+type apiKey struct {
+	header          string
+	query           string
+	hideCredentials bool
+	consumerHeader  string
+	verifier        *consumer.KeyVerifier
+	next            http.RoundTripper
+}
+
+func (a *apiKey) RoundTrip(req *http.Request) (*http.Response, error) {
+	if a.consumerHeader != "" {
+		req.Header.Del(a.consumerHeader)
+	}
+	key := req.Header.Get(a.header)
+	if key == "" && a.query != "" {
+		key = req.URL.Query().Get(a.query)
+	}
+	if key == "" {
+		return consumer.Response(http.StatusUnauthorized, "api key is missing", nil), nil
+	}
+	if a.verifier == nil {
+		return consumer.Response(http.StatusUnauthorized, "api key is invalid", nil), nil
+	}
+	c, ok := a.verifier.Verify(key)
+	if !ok {
+		return consumer.Response(http.StatusUnauthorized, "api key is invalid", nil), nil
+	}
+	if !c.Allowed(req) {
+		return consumer.Response(http.StatusForbidden, "consumer is not allowed to access this route", nil), nil
+	}
+
+	if a.hideCredentials {
+		req.Header.Del(a.header)
+		if a.query != "" {
+			q := req.URL.Query()
+			if q.Has(a.query) {
+				q.Del(a.query)
+				req.URL.RawQuery = q.Encode()
+			}
+		}
+	}
+	if a.consumerHeader != "" {
+		req.Header.Set(a.consumerHeader, c.Name)
+	}
+	ctx := reqcontext.WithConsumer(req.Context(), c.Name)
+	return a.next.RoundTrip(req.WithContext(ctx))
+}
@@ -0,0 +1,105 @@
+package basicauth
+
+import (
+	"mini-gateway/config"
+	"mini-gateway/middleware"
+	"mini-gateway/middleware/consumer"
+	"mini-gateway/reqcontext"
+	"mini-gateway/slog"
+	"net/http"
+	"strconv"
+)
+
+const NAME = "basicAuth"
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"realm":           config.ArgString,
+		"hideCredentials": config.ArgBool,
+		"consumerHeader":  config.ArgString,
+		"consumers":       config.ArgList,
+		"file":            config.ArgString,
+	})
+}
+
+// Factory http basic 鉴权中间件
+//
+//	consumers 调用方列表，file 为同样格式的 yaml 文件，password 建议使用 bcrypt 或 argon2id 哈希
+//	hideCredentials 默认 true，不把 Authorization 头转发给上游，consumerHeader 不为空时通过该请求头转发调用方名称
+func Factory(c *config.Middleware) middleware.Middleware {
+	realm := "mini-gateway"
+	hideCredentials := true
+	consumerHeader := ""
+
+	if v, ok := c.Args["realm"]; ok {
+		realm = v.(string)
+	}
+	if v, ok := c.Args["hideCredentials"]; ok {
+		hideCredentials = v.(bool)
+	}
+	if v, ok := c.Args["consumerHeader"]; ok {
+		consumerHeader = v.(string)
+	}
+	var verifier *consumer.UserVerifier
+	consumers, err := consumer.Load(c)
+	if err == nil {
+		verifier, err = consumer.NewUserVerifier(consumers)
+	}
+	if err != nil {
+		slog.Error("basic auth middleware error:%s,all requests will be rejected", err.Error())
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &basicAuth{
+			challenge:       "Basic realm=" + strconv.Quote(realm) + `, charset="UTF-8"`,
+			hideCredentials: hideCredentials,
+			consumerHeader:  consumerHeader,
+			verifier:        verifier,
+			next:            next,
+		}
+	}
+}
+
+type basicAuth struct {
+	challenge       string
+	hideCredentials bool
+	consumerHeader  string
+	verifier        *consumer.UserVerifier
+	next            http.RoundTripper
+}
+
+func (b *basicAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.consumerHeader != "" {
+		req.Header.Del(b.consumerHeader)
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return b.unauthorized("credentials are missing"), nil
+	}
+	if b.verifier == nil {
+		return b.unauthorized("credentials are invalid"), nil
+	}
+	c, ok := b.verifier.Verify(username, password)
+	if !ok {
+		return b.unauthorized("credentials are invalid"), nil
+	}
+	if !c.Allowed(req) {
+		return consumer.Response(http.StatusForbidden, "consumer is not allowed to access this route", nil), nil
+	}
+
+	if b.hideCredentials {
+		req.Header.Del("Authorization")
+	}
+	if b.consumerHeader != "" {
+		req.Header.Set(b.consumerHeader, c.Name)
+	}
+	ctx := reqcontext.WithConsumer(req.Context(), c.Name)
+	return b.next.RoundTrip(req.WithContext(ctx))
+}
+
+func (b *basicAuth) unauthorized(message string) *http.Response {
+	header := http.Header{}
+	header.Set("WWW-Authenticate", b.challenge)
+	return consumer.Response(http.StatusUnauthorized, message, header)
+}
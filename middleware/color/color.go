@@ -11,17 +11,29 @@ const NAME = "color"
 
 func init() {
 	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"fromHeaderKey": config.ArgString,
+		"tags":          config.ArgStringMap,
+	})
 }
 
+// Factory fromHeaderKey 为 color 标签的请求头，tags 为其他标签到请求头的映射，比如 {version: X-Version}
 func Factory(c *config.Middleware) middleware.Middleware {
 	fromHeaderKey := ""
 	if v, ok := c.Args["fromHeaderKey"]; ok {
 		fromHeaderKey = v.(string)
 	}
+	tags := make(map[string]string)
+	if v, ok := c.Args["tags"]; ok {
+		for tag, header := range v.(map[string]interface{}) {
+			tags[tag] = header.(string)
+		}
+	}
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		return &color{
 			headerKey: fromHeaderKey,
+			tags:      tags,
 			next:      next,
 		}
 	}
@@ -29,11 +41,17 @@ func Factory(c *config.Middleware) middleware.Middleware {
 
 type color struct {
 	headerKey string
+	tags      map[string]string
 	next      http.RoundTripper
 }
 
 func (c *color) RoundTrip(req *http.Request) (*http.Response, error) {
 	_color := req.Header.Get(c.headerKey)
 	ctx := reqcontext.WithColor(req.Context(), _color)
+	for tag, header := range c.tags {
+		if v := req.Header.Get(header); v != "" {
+			ctx = reqcontext.WithTag(ctx, tag, v)
+		}
+	}
 	return c.next.RoundTrip(req.WithContext(ctx))
 }
@@ -0,0 +1,315 @@
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/reqcontext"
+	"mini-gateway/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 缓存校验通过的凭证，避免每个请求都计算 bcrypt、argon2
+const maxCacheSize = 4096
+
+// Consumer 调用方身份，密钥和密码支持 bcrypt、argon2id、sha256:<hex> 和明文
+//
+//	keys 使用 bcrypt、argon2id 哈希时必须写成 <keyId>.<hash>，调用方发送 <keyId>.<secret>，按 keyId 只校验一个哈希
+//	allow 允许访问的端点 id，为空时允许访问全部端点
+type Consumer struct {
+	Name     string   `yaml:"name" json:"name"`
+	Keys     []string `yaml:"keys" json:"keys,omitempty"`
+	Username string   `yaml:"username" json:"username,omitempty"`
+	Password string   `yaml:"password" json:"password,omitempty"`
+	Allow    []string `yaml:"allow" json:"allow,omitempty"`
+}
+
+// Allowed 调用方是否可以访问请求的端点
+func (c *Consumer) Allowed(req *http.Request) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	endpoint, ok := reqcontext.Endpoint(req.Context())
+	if !ok || endpoint == nil {
+		return false
+	}
+	for _, id := range c.Allow {
+		if id == endpoint.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Load 从中间件参数 consumers 和 file 指定的 yaml 文件加载调用方
+func Load(c *config.Middleware) ([]*Consumer, error) {
+	consumers := make([]*Consumer, 0)
+	if v, ok := c.Args["consumers"]; ok {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &consumers); err != nil {
+			return nil, fmt.Errorf("%s middleware consumers are invalid,error:%s", c.Name, err.Error())
+		}
+	}
+	if v, ok := c.Args["file"]; ok {
+		data, err := os.ReadFile(v.(string))
+		if err != nil {
+			return nil, err
+		}
+		fromFile := make([]*Consumer, 0)
+		if err := yaml.UnmarshalStrict(data, &fromFile); err != nil {
+			return nil, fmt.Errorf("consumer file %s is invalid,error:%s", v.(string), err.Error())
+		}
+		consumers = append(consumers, fromFile...)
+	}
+	names := make(map[string]bool)
+	for _, consumer := range consumers {
+		if consumer.Name == "" {
+			return nil, errors.New("consumer name cannot be empty")
+		}
+		if names[consumer.Name] {
+			return nil, fmt.Errorf("consumer name is duplicated,name:%s", consumer.Name)
+		}
+		names[consumer.Name] = true
+	}
+	return consumers, nil
+}
+
+// KeyVerifier 按 api key 查找调用方
+type KeyVerifier struct {
+	// exact 明文和 sha256 的密钥可以直接查表，key 为密钥的 sha256
+	exact map[[32]byte]*Consumer
+	// hashed bcrypt、argon2id 的密钥按 keyId 查表
+	hashed map[string]hashedKey
+	cache  *cache
+}
+
+type hashedKey struct {
+	hash     string
+	consumer *Consumer
+}
+
+func NewKeyVerifier(consumers []*Consumer) (*KeyVerifier, error) {
+	v := &KeyVerifier{
+		exact:  make(map[[32]byte]*Consumer),
+		hashed: make(map[string]hashedKey),
+		cache:  newCache(),
+	}
+	for _, c := range consumers {
+		for _, k := range c.Keys {
+			id, hash, _ := strings.Cut(k, ".")
+			switch {
+			case isHashed(k):
+				return nil, fmt.Errorf("consumer %s hashed key must be in the form <keyId>.<hash>", c.Name)
+			case id != "" && isHashed(hash):
+				if _, ok := v.hashed[id]; ok {
+					return nil, fmt.Errorf("consumer key id is duplicated,id:%s", id)
+				}
+				v.hashed[id] = hashedKey{hash: hash, consumer: c}
+			case strings.HasPrefix(k, "sha256:"):
+				sum, err := decodeSha256(k)
+				if err != nil {
+					return nil, fmt.Errorf("consumer %s has invalid key,error:%s", c.Name, err.Error())
+				}
+				v.exact[sum] = c
+			default:
+				slog.Warn("consumer %s key is stored in plaintext,a bcrypt or argon2id hash is recommended", c.Name)
+				v.exact[sha256.Sum256([]byte(k))] = c
+			}
+		}
+	}
+	return v, nil
+}
+
+func (v *KeyVerifier) Verify(key string) (*Consumer, bool) {
+	if key == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	if c, ok := v.exact[sum]; ok {
+		return c, true
+	}
+	if c, ok := v.cache.get(sum); ok {
+		return c, true
+	}
+	id, secret, ok := strings.Cut(key, ".")
+	if !ok {
+		return nil, false
+	}
+	h, ok := v.hashed[id]
+	if !ok || !compareHash(h.hash, secret) {
+		return nil, false
+	}
+	v.cache.put(sum, h.consumer)
+	return h.consumer, true
+}
+
+// UserVerifier 按用户名和密码查找调用方
+type UserVerifier struct {
+	users map[string]*Consumer
+	cache *cache
+}
+
+func NewUserVerifier(consumers []*Consumer) (*UserVerifier, error) {
+	v := &UserVerifier{
+		users: make(map[string]*Consumer),
+		cache: newCache(),
+	}
+	for _, c := range consumers {
+		if c.Username == "" {
+			continue
+		}
+		if _, ok := v.users[c.Username]; ok {
+			return nil, fmt.Errorf("consumer username is duplicated,username:%s", c.Username)
+		}
+		if strings.HasPrefix(c.Password, "sha256:") {
+			if _, err := decodeSha256(c.Password); err != nil {
+				return nil, fmt.Errorf("consumer %s has invalid password,error:%s", c.Name, err.Error())
+			}
+		} else if !isHashed(c.Password) {
+			slog.Warn("consumer %s password is stored in plaintext,a bcrypt or argon2id hash is recommended", c.Name)
+		}
+		v.users[c.Username] = c
+	}
+	return v, nil
+}
+
+func (v *UserVerifier) Verify(username, password string) (*Consumer, bool) {
+	c, ok := v.users[username]
+	if !ok || password == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	if cached, ok := v.cache.get(sum); ok && cached == c {
+		return c, true
+	}
+	if !Compare(c.Password, password) {
+		return nil, false
+	}
+	v.cache.put(sum, c)
+	return c, true
+}
+
+// Compare 校验密钥或密码，stored 可以是 bcrypt、argon2id、sha256:<hex> 或明文
+func Compare(stored, secret string) bool {
+	if isHashed(stored) {
+		return compareHash(stored, secret)
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if strings.HasPrefix(stored, "sha256:") {
+		want, err := decodeSha256(stored)
+		return err == nil && subtle.ConstantTimeCompare(sum[:], want[:]) == 1
+	}
+	want := sha256.Sum256([]byte(stored))
+	return subtle.ConstantTimeCompare(sum[:], want[:]) == 1
+}
+
+type cache struct {
+	mu sync.Mutex
+	m  map[[32]byte]*Consumer
+}
+
+func newCache() *cache {
+	return &cache{m: make(map[[32]byte]*Consumer)}
+}
+
+func (c *cache) get(key [32]byte) (*Consumer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	consumer, ok := c.m[key]
+	return consumer, ok
+}
+
+func (c *cache) put(key [32]byte, consumer *Consumer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= maxCacheSize {
+		c.m = make(map[[32]byte]*Consumer)
+	}
+	c.m[key] = consumer
+}
+
+func decodeSha256(s string) ([32]byte, error) {
+	var sum [32]byte
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "sha256:"))
+	if err != nil {
+		return sum, err
+	}
+	if len(b) != sha256.Size {
+		return sum, errors.New("sha256 digest must be 32 bytes")
+	}
+	copy(sum[:], b)
+	return sum, nil
+}
+
+func isHashed(s string) bool {
+	return isBcrypt(s) || strings.HasPrefix(s, "$argon2id$")
+}
+
+func isBcrypt(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+func compareHash(hash, secret string) bool {
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+	}
+	return compareArgon2id(hash, secret)
+}
+
+// compareArgon2id 校验 $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> 格式的哈希
+func compareArgon2id(hash, secret string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Response 返回带 JSON 错误信息的响应
+func Response(code int, message string, header http.Header) *http.Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode:    code,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,40 @@
+package consumer
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestKeyVerifierLooksUpHashedKeysById(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret.value"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &Consumer{Name: "alice", Keys: []string{"k1." + string(hash)}}
+	bob := &Consumer{Name: "bob", Keys: []string{"plain-key"}}
+	v, err := NewKeyVerifier([]*Consumer{alice, bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]*Consumer{
+		"k1.s3cret.value": alice,
+		"plain-key":       bob,
+		"k1.wrong":        nil,
+		"k2.s3cret.value": nil,
+		"s3cret.value":    nil,
+	}
+	for key, want := range cases {
+		got, ok := v.Verify(key)
+		if ok != (want != nil) || got != want {
+			t.Errorf("Verify(%q) = %v,%v", key, got, ok)
+		}
+	}
+
+	if _, err := NewKeyVerifier([]*Consumer{{Name: "carol", Keys: []string{string(hash)}}}); err == nil {
+		t.Error("hashed key without key id should be rejected")
+	}
+	dup := &Consumer{Name: "dave", Keys: []string{"k1." + string(hash)}}
+	if _, err := NewKeyVerifier([]*Consumer{alice, dup}); err == nil {
+		t.Error("duplicated key id should be rejected")
+	}
+}
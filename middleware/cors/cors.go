@@ -11,6 +11,13 @@ const NAME = "cors"
 
 func init() {
 	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"allowOrigin":   config.ArgString,
+		"allowHeaders":  config.ArgString,
+		"allowMethod":   config.ArgString,
+		"exposeHeaders": config.ArgString,
+		"credentials":   config.ArgBool,
+	})
 }
 
 func Factory(c *config.Middleware) middleware.Middleware {
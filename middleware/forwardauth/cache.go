@@ -0,0 +1,58 @@
+package forwardauth
+
+import (
+	"sync"
+	"time"
+)
+
+const maxCacheSize = 10000
+
+type decisionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	decision *decision
+	expires  time.Time
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+func (c *decisionCache) get(key string) *decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.decision
+}
+
+func (c *decisionCache) put(key string, d *decision) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheSize {
+		// 先清理过期的，仍然超过上限时全部清空
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheSize {
+			c.entries = make(map[string]*cacheEntry)
+		}
+	}
+	c.entries[key] = &cacheEntry{decision: d, expires: now.Add(c.ttl)}
+}
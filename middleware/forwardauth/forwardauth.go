@@ -0,0 +1,233 @@
+package forwardauth
+
+import (
+	"bytes"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/middleware"
+	"mini-gateway/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const NAME = "forwardAuth"
+
+const (
+	TypeHttp = "http"
+	TypeGrpc = "grpc"
+)
+
+const (
+	defaultTimeout = 2 * time.Second
+	// 拒绝响应最多读取 64KB 返回给客户端
+	maxDeniedBodySize = 64 << 10
+)
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"type":                config.ArgString,
+		"address":             config.ArgString,
+		"timeout":             config.ArgInt,
+		"cacheTtl":            config.ArgInt,
+		"failOpen":            config.ArgBool,
+		"requestHeaders":      config.ArgString,
+		"authResponseHeaders": config.ArgString,
+		"contextExtensions":   config.ArgStringMap,
+	})
+}
+
+// Factory 外部鉴权中间件
+//
+//	type: http | grpc，grpc 兼容 envoy ext_authz v3 的 Authorization/Check
+//	address 鉴权服务地址，http 为完整 URL，grpc 为 host:port 或 http(s)://host:port
+//	requestHeaders 逗号分隔，发送给鉴权服务的请求头，为空时发送全部请求头
+//	authResponseHeaders 逗号分隔，http 模式鉴权通过后复制到上游请求的响应头
+//	contextExtensions grpc 模式的 context_extensions
+//	timeout、cacheTtl 单位毫秒，cacheTtl 大于 0 时按发送给鉴权服务的内容缓存鉴权结果，failOpen 为 true 时鉴权服务不可用直接放行
+func Factory(c *config.Middleware) middleware.Middleware {
+	typ := TypeHttp
+	address := ""
+	timeout := defaultTimeout
+	cacheTtl := time.Duration(0)
+	failOpen := false
+	requestHeaders := make([]string, 0)
+	authResponseHeaders := make([]string, 0)
+	contextExtensions := make(map[string]string)
+
+	if v, ok := c.Args["type"]; ok {
+		typ = v.(string)
+	}
+	if v, ok := c.Args["address"]; ok {
+		address = v.(string)
+	}
+	if v, ok := c.Args["timeout"]; ok {
+		timeout = time.Duration(v.(int)) * time.Millisecond
+	}
+	if v, ok := c.Args["cacheTtl"]; ok {
+		cacheTtl = time.Duration(v.(int)) * time.Millisecond
+	}
+	if v, ok := c.Args["failOpen"]; ok {
+		failOpen = v.(bool)
+	}
+	if v, ok := c.Args["requestHeaders"]; ok {
+		requestHeaders = splitHeaders(v.(string))
+	}
+	if v, ok := c.Args["authResponseHeaders"]; ok {
+		authResponseHeaders = splitHeaders(v.(string))
+	}
+	if v, ok := c.Args["contextExtensions"]; ok {
+		for k, val := range v.(map[string]interface{}) {
+			contextExtensions[k] = val.(string)
+		}
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	var a authorizer
+	switch typ {
+	case TypeGrpc:
+		a = newGrpcAuthorizer(address, timeout, requestHeaders, contextExtensions)
+	default:
+		if typ != TypeHttp {
+			slog.Warn("unknown forward auth type %s,%s is used by default", typ, TypeHttp)
+		}
+		a = newHttpAuthorizer(address, timeout, requestHeaders, authResponseHeaders)
+	}
+	if address == "" {
+		slog.Error("forward auth middleware address is empty,all requests will be rejected")
+	}
+	var cache *decisionCache
+	if cacheTtl > 0 {
+		cache = newDecisionCache(cacheTtl)
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &forwardAuth{
+			authorizer: a,
+			cache:      cache,
+			failOpen:   failOpen,
+			next:       next,
+		}
+	}
+}
+
+// authorizer cacheKey 只由发送给鉴权服务的内容决定，内容相同的请求可以共享鉴权结果
+type authorizer interface {
+	check(req *http.Request) (*decision, error)
+	cacheKey(req *http.Request) string
+}
+
+// decision 鉴权结果，创建后不再修改，可以被缓存共享
+type decision struct {
+	allowed bool
+	// upstreamHeaders 通过时设置到上游请求的请求头，removeHeaders 通过时从上游请求删除的请求头
+	upstreamHeaders []headerValue
+	removeHeaders   []string
+	// responseHeaders 通过时添加到客户端响应，拒绝时作为拒绝响应的响应头
+	responseHeaders []headerValue
+	status          int
+	body            []byte
+}
+
+type headerValue struct {
+	key    string
+	value  string
+	action int
+}
+
+const (
+	actionSet = iota
+	actionAppend
+	actionAddIfAbsent
+	actionOverwriteIfExists
+)
+
+func (h headerValue) apply(header http.Header) {
+	switch h.action {
+	case actionAppend:
+		header.Add(h.key, h.value)
+	case actionAddIfAbsent:
+		if header.Get(h.key) == "" {
+			header.Set(h.key, h.value)
+		}
+	case actionOverwriteIfExists:
+		if header.Get(h.key) != "" {
+			header.Set(h.key, h.value)
+		}
+	default:
+		header.Set(h.key, h.value)
+	}
+}
+
+type forwardAuth struct {
+	authorizer authorizer
+	cache      *decisionCache
+	failOpen   bool
+	next       http.RoundTripper
+}
+
+func (f *forwardAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := ""
+	var d *decision
+	if f.cache != nil {
+		key = f.authorizer.cacheKey(req)
+		d = f.cache.get(key)
+	}
+	if d == nil {
+		var err error
+		if d, err = f.authorizer.check(req); err != nil {
+			if f.failOpen {
+				slog.Warn("forward auth error:%s,request is allowed", err.Error())
+				return f.next.RoundTrip(req)
+			}
+			return nil, err
+		}
+		// 鉴权服务自身的错误不缓存
+		if f.cache != nil && d.status < http.StatusInternalServerError {
+			f.cache.put(key, d)
+		}
+	}
+
+	if !d.allowed {
+		header := http.Header{}
+		for _, h := range d.responseHeaders {
+			h.apply(header)
+		}
+		return &http.Response{
+			StatusCode:    d.status,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(d.body)),
+			ContentLength: int64(len(d.body)),
+		}, nil
+	}
+	for _, h := range d.removeHeaders {
+		req.Header.Del(h)
+	}
+	for _, h := range d.upstreamHeaders {
+		h.apply(req.Header)
+	}
+	resp, err := f.next.RoundTrip(req)
+	if err != nil || len(d.responseHeaders) == 0 {
+		return resp, err
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	for _, h := range d.responseHeaders {
+		h.apply(resp.Header)
+	}
+	return resp, nil
+}
+
+func splitHeaders(s string) []string {
+	headers := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			headers = append(headers, http.CanonicalHeaderKey(v))
+		}
+	}
+	return headers
+}
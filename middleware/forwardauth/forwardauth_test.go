@@ -0,0 +1,83 @@
+package forwardauth
+
+import (
+	"mini-gateway/config"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+type okTripper struct{}
+
+func (okTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func request(remoteAddr string, header map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/orders", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+// 鉴权结果按客户端地址区分，同一客户端的相同请求使用缓存
+func TestCacheKeyIncludesClientIP(t *testing.T) {
+	var hits int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer auth.Close()
+	rt := Factory(&config.Middleware{Name: NAME, Args: map[string]interface{}{
+		"address":        auth.URL,
+		"cacheTtl":       60000,
+		"requestHeaders": "Authorization",
+	}})(okTripper{})
+
+	cases := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"192.0.2.1:1000", http.StatusOK},
+		{"192.0.2.1:2000", http.StatusOK},
+		{"198.51.100.7:1000", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp, err := rt.RoundTrip(request(c.remoteAddr, map[string]string{"Authorization": "Bearer t"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Fatalf("request from %s expected %d,got %d", c.remoteAddr, c.status, resp.StatusCode)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected 2 authorizer requests,got %d", n)
+	}
+}
+
+// grpc 模式只发送 requestHeaders 中的请求头，缓存 key 与发送的内容一致
+func TestGrpcHonoursRequestHeaders(t *testing.T) {
+	a := newGrpcAuthorizer("127.0.0.1:9000", 0, []string{"X-Token"}, nil)
+	base := a.cacheKey(request("192.0.2.1:1000", map[string]string{"X-Token": "a", "Cookie": "c=1"}))
+	if a.cacheKey(request("192.0.2.1:2000", map[string]string{"X-Token": "a", "Cookie": "c=2"})) != base {
+		t.Fatal("headers that are not sent should not change the cache key")
+	}
+	if a.cacheKey(request("192.0.2.1:1000", map[string]string{"X-Token": "b"})) == base {
+		t.Fatal("sent headers should change the cache key")
+	}
+	if a.cacheKey(request("198.51.100.7:1000", map[string]string{"X-Token": "a"})) == base {
+		t.Fatal("client ip should change the cache key")
+	}
+
+	all := newGrpcAuthorizer("127.0.0.1:9000", 0, nil, nil)
+	if all.cacheKey(request("192.0.2.1:1000", map[string]string{"Authorization": "x"})) ==
+		all.cacheKey(request("192.0.2.1:1000", map[string]string{"Authorization": "y"})) {
+		t.Fatal("authorization is sent without requestHeaders and should change the cache key")
+	}
+}
@@ -0,0 +1,424 @@
+package forwardauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"mini-gateway/clientip"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const checkMethod = "/envoy.service.auth.v3.Authorization/Check"
+
+// grpcAuthorizer 调用 envoy ext_authz v3 的 Check 接口，请求和响应按 proto 定义手工编解码
+//
+//	https://github.com/envoyproxy/envoy/blob/main/api/envoy/service/auth/v3/external_auth.proto
+type grpcAuthorizer struct {
+	url               string
+	timeout           time.Duration
+	requestHeaders    []string
+	contextExtensions map[string]string
+	transport         *http2.Transport
+}
+
+func newGrpcAuthorizer(address string, timeout time.Duration, requestHeaders []string, contextExtensions map[string]string) *grpcAuthorizer {
+	scheme := "http"
+	host := address
+	if u, err := url.Parse(address); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		scheme = u.Scheme
+		host = u.Host
+	}
+	t := &http2.Transport{DisableCompression: true}
+	if scheme == "http" {
+		dialer := &net.Dialer{Timeout: timeout}
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return &grpcAuthorizer{
+		url:               scheme + "://" + host + checkMethod,
+		timeout:           timeout,
+		requestHeaders:    requestHeaders,
+		contextExtensions: contextExtensions,
+		transport:         t,
+	}
+}
+
+func (a *grpcAuthorizer) check(req *http.Request) (*decision, error) {
+	msg := a.checkRequest(req)
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	ctx, cancel := context.WithTimeout(req.Context(), a.timeout)
+	defer cancel()
+	grpcReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	grpcReq.ContentLength = int64(len(frame))
+	grpcReq.Header.Set("Content-Type", "application/grpc")
+	grpcReq.Header.Set("Te", "trailers")
+	grpcReq.Header.Set("Grpc-Timeout", strconv.FormatInt(a.timeout.Milliseconds(), 10)+"m")
+	resp, err := a.transport.RoundTrip(grpcReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ext_authz returns http status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		// 只有 header 没有 body 的响应，状态在响应头中
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return nil, fmt.Errorf("ext_authz returns grpc status %s,message:%s", status, message)
+	}
+	if len(body) < 5 {
+		return nil, errors.New("ext_authz response is empty")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("compressed ext_authz response is not supported")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if int(n) > len(body)-5 {
+		return nil, errors.New("ext_authz response is truncated")
+	}
+	return parseCheckResponse(body[5 : 5+n])
+}
+
+// cacheKey 由发送给鉴权服务的 source、destination 和 HttpRequest 组成，不含请求时间
+func (a *grpcAuthorizer) cacheKey(req *http.Request) string {
+	w := &pbWriter{}
+	a.peers(w, req)
+	w.message(2, func(h *pbWriter) { a.httpRequest(h, req) })
+	sum := sha256.Sum256(w.buf)
+	return string(sum[:])
+}
+
+// peers 编码 AttributeContext 的 source 和 destination，source 为按可信代理计算的客户端地址，不含端口
+func (a *grpcAuthorizer) peers(w *pbWriter, req *http.Request) {
+	if addr := socketAddress(net.JoinHostPort(clientip.Get(req), "0")); addr != nil {
+		w.message(1, func(peer *pbWriter) { peer.message(1, addr) })
+	}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if addr := socketAddress(local.String()); addr != nil {
+			w.message(2, func(peer *pbWriter) { peer.message(1, addr) })
+		}
+	}
+}
+
+// checkRequest 编码 CheckRequest{attributes: AttributeContext}
+func (a *grpcAuthorizer) checkRequest(req *http.Request) []byte {
+	attrs := &pbWriter{}
+	a.peers(attrs, req)
+	attrs.message(4, func(r *pbWriter) {
+		now := time.Now()
+		r.message(1, func(ts *pbWriter) {
+			ts.uint(1, uint64(now.Unix()))
+			ts.uint(2, uint64(now.Nanosecond()))
+		})
+		r.message(2, func(h *pbWriter) { a.httpRequest(h, req) })
+	})
+	keys := make([]string, 0, len(a.contextExtensions))
+	for k := range a.contextExtensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs.mapEntry(10, k, a.contextExtensions[k])
+	}
+
+	w := &pbWriter{}
+	w.bytes(1, attrs.buf)
+	return w.buf
+}
+
+// httpRequest 编码 AttributeContext.HttpRequest，请求头的 key 为小写，多个值用逗号连接，
+// 配置了 requestHeaders 时只发送这些请求头
+func (a *grpcAuthorizer) httpRequest(w *pbWriter, req *http.Request) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	path := req.URL.RequestURI()
+	headers := map[string]string{
+		":method":    req.Method,
+		":path":      path,
+		":authority": req.Host,
+		":scheme":    scheme,
+	}
+	if len(a.requestHeaders) == 0 {
+		for k, vv := range req.Header {
+			headers[strings.ToLower(k)] = strings.Join(vv, ",")
+		}
+	} else {
+		for _, k := range a.requestHeaders {
+			if vv := req.Header.Values(k); len(vv) > 0 {
+				headers[strings.ToLower(k)] = strings.Join(vv, ",")
+			}
+		}
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.string(2, req.Method)
+	for _, k := range keys {
+		w.mapEntry(3, k, headers[k])
+	}
+	w.string(4, path)
+	w.string(5, req.Host)
+	w.string(6, scheme)
+	w.string(7, req.URL.RawQuery)
+	if req.ContentLength > 0 {
+		w.uint(9, uint64(req.ContentLength))
+	}
+	w.string(10, req.Proto)
+}
+
+func socketAddress(hostport string) func(*pbWriter) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	return func(addr *pbWriter) {
+		addr.message(1, func(sa *pbWriter) {
+			sa.string(2, host)
+			sa.uint(3, p)
+		})
+	}
+}
+
+// parseCheckResponse 解析 CheckResponse，status.code 为 0 时通过
+func parseCheckResponse(b []byte) (*decision, error) {
+	d := &decision{status: http.StatusForbidden}
+	code := uint64(0)
+	var denied, ok []byte
+	err := parseFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			return parseFields(data, func(field int, v uint64, data []byte) error {
+				if field == 1 {
+					code = v
+				}
+				return nil
+			})
+		case 2:
+			denied = data
+		case 3:
+			ok = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code == 0 {
+		d.allowed = true
+		d.status = 0
+		if ok != nil {
+			err = parseFields(ok, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 2:
+					h, err := parseHeaderValueOption(data)
+					if err != nil {
+						return err
+					}
+					d.upstreamHeaders = append(d.upstreamHeaders, h)
+				case 5:
+					d.removeHeaders = append(d.removeHeaders, string(data))
+				case 6:
+					h, err := parseHeaderValueOption(data)
+					if err != nil {
+						return err
+					}
+					d.responseHeaders = append(d.responseHeaders, h)
+				}
+				return nil
+			})
+		}
+		return d, err
+	}
+	if denied != nil {
+		err = parseFields(denied, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				return parseFields(data, func(field int, v uint64, data []byte) error {
+					if field == 1 && v >= 100 && v <= 599 {
+						d.status = int(v)
+					}
+					return nil
+				})
+			case 2:
+				h, err := parseHeaderValueOption(data)
+				if err != nil {
+					return err
+				}
+				d.responseHeaders = append(d.responseHeaders, h)
+			case 3:
+				d.body = append([]byte(nil), data...)
+			}
+			return nil
+		})
+	}
+	return d, err
+}
+
+// parseHeaderValueOption 解析 HeaderValueOption{header, append, append_action}
+func parseHeaderValueOption(b []byte) (headerValue, error) {
+	h := headerValue{action: actionSet}
+	appendSet := false
+	err := parseFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			return parseFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					h.key = string(data)
+				case 2, 3:
+					h.value = string(data)
+				}
+				return nil
+			})
+		case 2:
+			appendSet = true
+			h.action = actionSet
+			return parseFields(data, func(field int, v uint64, data []byte) error {
+				if field == 1 && v != 0 {
+					h.action = actionAppend
+				}
+				return nil
+			})
+		case 3:
+			if appendSet {
+				return nil
+			}
+			switch v {
+			case 1:
+				h.action = actionAddIfAbsent
+			case 3:
+				h.action = actionOverwriteIfExists
+			}
+		}
+		return nil
+	})
+	return h, err
+}
+
+// pbWriter protobuf 编码，零值字段不写入
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (w *pbWriter) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 0)
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *pbWriter) bytes(field int, b []byte) {
+	w.tag(field, 2)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *pbWriter) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	w.bytes(field, []byte(s))
+}
+
+func (w *pbWriter) message(field int, f func(*pbWriter)) {
+	m := &pbWriter{}
+	f(m)
+	w.bytes(field, m.buf)
+}
+
+// mapEntry map<string, string> 编码为 key=1、value=2 的重复消息
+func (w *pbWriter) mapEntry(field int, key, value string) {
+	w.message(field, func(e *pbWriter) {
+		e.string(1, key)
+		e.string(2, value)
+	})
+}
+
+// parseFields 遍历 protobuf 字段，varint 字段通过 v 返回，长度分隔字段通过 data 返回
+func parseFields(b []byte, f func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf field tag")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("invalid protobuf length")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := f(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package forwardauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"mini-gateway/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 与 protobuf 文档中的编码示例一致
+func TestPbWriterWireFormat(t *testing.T) {
+	w := &pbWriter{}
+	w.uint(1, 150)
+	w.string(2, "testing")
+	w.message(3, func(m *pbWriter) { m.uint(1, 150) })
+	w.uint(4, 0)
+	w.string(5, "")
+	want := []byte{0x08, 0x96, 0x01, 0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g', 0x1a, 0x03, 0x08, 0x96, 0x01}
+	if !bytes.Equal(w.buf, want) {
+		t.Fatalf("expected % x,got % x", want, w.buf)
+	}
+}
+
+// field 按路径读取嵌套的长度分隔字段，不存在时返回 nil
+func field(b []byte, path ...int) []byte {
+	for _, f := range path {
+		var found []byte
+		err := parseFields(b, func(field int, v uint64, data []byte) error {
+			if field == f && found == nil {
+				found = data
+			}
+			return nil
+		})
+		if err != nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+// header 编码 HeaderValueOption，appendValue 为 nil 时不写 append
+func header(key, value string, appendValue *bool, action uint64) func(*pbWriter) {
+	return func(w *pbWriter) {
+		w.message(1, func(h *pbWriter) {
+			h.string(1, key)
+			h.string(2, value)
+		})
+		if appendValue != nil {
+			w.message(2, func(b *pbWriter) {
+				if *appendValue {
+					b.uint(1, 1)
+				}
+			})
+		}
+		w.uint(3, action)
+	}
+}
+
+// extAuthzServer ext_authz 的 h2c 替身，/deny 开头的路径拒绝，/error 开头的路径返回 grpc 错误，其余通过
+func extAuthzServer(t *testing.T) *httptest.Server {
+	yes, no := true, false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != checkMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("unexpected grpc request %s %s %s", r.Proto, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("invalid grpc frame % x", body)
+			return
+		}
+		attrs := field(body[5:], 1)
+		httpReq := field(attrs, 4, 2)
+		if got := string(field(httpReq, 2)); got != http.MethodGet {
+			t.Errorf("expected method GET,got %s", got)
+		}
+		path := string(field(httpReq, 4))
+		if got := string(field(attrs, 1, 1, 1, 2)); got != "192.0.2.1" {
+			t.Errorf("expected source address 192.0.2.1,got %s", got)
+		}
+		if got := string(field(attrs, 10, 2)); got != "orders" {
+			t.Errorf("expected context extension orders,got %s", got)
+		}
+		token := ""
+		_ = parseFields(httpReq, func(f int, _ uint64, data []byte) error {
+			if f == 3 && string(field(data, 1)) == "authorization" {
+				token = string(field(data, 2))
+			}
+			return nil
+		})
+		if token != "Bearer t" {
+			t.Errorf("expected authorization header,got %q", token)
+		}
+
+		if strings.HasPrefix(path, "/error") {
+			// 只有 header 的 grpc 错误响应
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "14")
+			w.Header().Set("Grpc-Message", "unavailable")
+			return
+		}
+		resp := &pbWriter{}
+		if strings.HasPrefix(path, "/deny") {
+			// PERMISSION_DENIED
+			resp.message(1, func(s *pbWriter) { s.uint(1, 7) })
+			resp.message(2, func(d *pbWriter) {
+				d.message(1, func(s *pbWriter) { s.uint(1, http.StatusUnauthorized) })
+				d.message(2, header("Www-Authenticate", "Bearer", nil, 0))
+				d.string(3, "denied")
+			})
+		} else {
+			resp.message(1, func(s *pbWriter) {})
+			resp.message(3, func(ok *pbWriter) {
+				ok.message(2, header("X-User", "alice", nil, 0))
+				ok.message(2, header("X-Append", "b", &yes, 0))
+				// append 为 false 时忽略 append_action
+				ok.message(2, header("X-Set", "new", &no, 1))
+				// ADD_IF_ABSENT 不覆盖已有的值，OVERWRITE_IF_EXISTS 不添加不存在的请求头
+				ok.message(2, header("X-Absent", "new", nil, 1))
+				ok.message(2, header("X-Missing", "new", nil, 3))
+				ok.string(5, "X-Remove")
+				ok.message(6, header("X-Auth-Result", "ok", nil, 0))
+			})
+		}
+		frame := make([]byte, 5, 5+len(resp.buf))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp.buf)))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(append(frame, resp.buf...))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	s := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// upstreamRecorder 记录到达上游的请求头
+type upstreamRecorder struct {
+	header http.Header
+}
+
+func (u *upstreamRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.header = req.Header.Clone()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func TestGrpcCheckAgainstStandInServer(t *testing.T) {
+	s := extAuthzServer(t)
+	upstream := &upstreamRecorder{}
+	rt := Factory(&config.Middleware{Name: NAME, Args: map[string]interface{}{
+		"type":              TypeGrpc,
+		"address":           s.URL,
+		"contextExtensions": map[string]interface{}{"service": "orders"},
+	}})(upstream)
+
+	req := request("192.0.2.1:1000", map[string]string{
+		"Authorization": "Bearer t",
+		"X-Append":      "a",
+		"X-Set":         "old",
+		"X-Absent":      "old",
+		"X-Remove":      "secret",
+	})
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Auth-Result") != "ok" {
+		t.Fatalf("expected allowed response with X-Auth-Result,got %d %v", resp.StatusCode, resp.Header)
+	}
+	h := upstream.header
+	checks := map[string]string{
+		"X-User":    "alice",
+		"X-Append":  "a,b",
+		"X-Set":     "new",
+		"X-Absent":  "old",
+		"X-Missing": "",
+		"X-Remove":  "",
+	}
+	for k, want := range checks {
+		if got := strings.Join(h.Values(k), ","); got != want {
+			t.Errorf("upstream header %s expected %q,got %q", k, want, got)
+		}
+	}
+
+	req = request("192.0.2.1:1000", map[string]string{"Authorization": "Bearer t"})
+	req.URL.Path = "/deny"
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnauthorized || string(body) != "denied" || resp.Header.Get("Www-Authenticate") != "Bearer" {
+		t.Fatalf("unexpected denied response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	req = request("192.0.2.1:1000", map[string]string{"Authorization": "Bearer t"})
+	req.URL.Path = "/error"
+	if _, err := rt.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("expected grpc status error,got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package forwardauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"mini-gateway/clientip"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 这些请求头描述请求体或连接，不发送给鉴权服务
+var skipRequestHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Expect":            true,
+	"Upgrade":           true,
+	"Connection":        true,
+}
+
+type httpAuthorizer struct {
+	address             string
+	timeout             time.Duration
+	requestHeaders      []string
+	authResponseHeaders []string
+	client              *http.Client
+}
+
+func newHttpAuthorizer(address string, timeout time.Duration, requestHeaders, authResponseHeaders []string) *httpAuthorizer {
+	return &httpAuthorizer{
+		address:             address,
+		timeout:             timeout,
+		requestHeaders:      requestHeaders,
+		authResponseHeaders: authResponseHeaders,
+		client: &http.Client{
+			// 鉴权服务返回的跳转交给客户端处理，比如跳转到登录页
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// headers 发送给鉴权服务的请求头，包括原始请求的方法、协议、host、uri 和客户端地址
+func (a *httpAuthorizer) headers(req *http.Request) http.Header {
+	header := http.Header{}
+	if len(a.requestHeaders) == 0 {
+		for k, vv := range req.Header {
+			if skipRequestHeaders[k] {
+				continue
+			}
+			header[k] = append([]string(nil), vv...)
+		}
+	} else {
+		for _, k := range a.requestHeaders {
+			if vv := req.Header.Values(k); len(vv) > 0 {
+				header[k] = append([]string(nil), vv...)
+			}
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Method", req.Method)
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", req.Host)
+	header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	header.Set("X-Forwarded-For", clientip.Get(req))
+	return header
+}
+
+// cacheKey 由发送给鉴权服务的全部请求头组成
+func (a *httpAuthorizer) cacheKey(req *http.Request) string {
+	header := a.headers(req)
+	names := make([]string, 0, len(header))
+	for k := range header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		for _, v := range header[name] {
+			h.Write([]byte(v))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return string(h.Sum(nil))
+}
+
+// check 鉴权服务返回 2xx 时通过，否则把鉴权服务的响应返回给客户端
+func (a *httpAuthorizer) check(req *http.Request) (*decision, error) {
+	if a.address == "" {
+		return nil, errors.New("forward auth address is empty")
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), a.timeout)
+	defer cancel()
+	authReq, err := http.NewRequestWithContext(ctx, http.MethodGet, a.address, nil)
+	if err != nil {
+		return nil, err
+	}
+	authReq.Header = a.headers(req)
+
+	resp, err := a.client.Do(authReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxDeniedBodySize))
+		d := &decision{allowed: true}
+		for _, k := range a.authResponseHeaders {
+			if v := resp.Header.Values(k); len(v) > 0 {
+				d.upstreamHeaders = append(d.upstreamHeaders, headerValue{key: k, value: strings.Join(v, ",")})
+			} else {
+				// 鉴权服务没有返回时也要删除，避免客户端伪造
+				d.removeHeaders = append(d.removeHeaders, k)
+			}
+		}
+		return d, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDeniedBodySize))
+	if err != nil {
+		return nil, err
+	}
+	d := &decision{status: resp.StatusCode, body: body}
+	for k, vv := range resp.Header {
+		if k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection" {
+			continue
+		}
+		for _, v := range vv {
+			d.responseHeaders = append(d.responseHeaders, headerValue{key: k, value: v, action: actionAppend})
+		}
+	}
+	return d, nil
+}
@@ -3,6 +3,8 @@ package forwarding
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"mini-gateway/config"
 	"mini-gateway/middleware"
@@ -13,8 +15,16 @@ import (
 
 const NAME = "grpc"
 
+// maxMessageSize 响应消息的最大长度，与 grpc 默认的接收上限一致
+const maxMessageSize = 4 << 20
+
 func init() {
 	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"httpStatus":        config.ArgInt,
+		"grpcErrorTemplate": config.ArgString,
+		"clearGrpcHeader":   config.ArgBool,
+	})
 }
 
 func Factory(c *config.Middleware) middleware.Middleware {
@@ -55,15 +65,38 @@ func (g *grpc) RoundTrip(req *http.Request) (*http.Response, error) {
 	if (endpoint != nil && strings.ToLower(endpoint.Protocol) != "grpc") || strings.HasSuffix(contentType, "application/grpc") {
 		return g.next.RoundTrip(req)
 	}
-	bodyByte, err := io.ReadAll(req.Body)
-	if err != nil {
-		return nil, err
-	}
 	// grpc 业务数据包头5字节,第一个字节是否压缩，后4字节消息长度
 	// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
-	grpcBodyByte := make([]byte, len(bodyByte)+5)
-	binary.BigEndian.PutUint32(grpcBodyByte[1:], uint32(len(bodyByte)))
-	copy(grpcBodyByte[5:], bodyByte)
+	prefix := make([]byte, 5)
+	if req.Body != nil && req.ContentLength > 0 {
+		// 长度已知时直接拼接包头流式转发
+		binary.BigEndian.PutUint32(prefix[1:], uint32(req.ContentLength))
+		req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), req.Body), closer: req.Body}
+		req.ContentLength += 5
+	} else {
+		var bodyByte []byte
+		if req.Body != nil {
+			var err error
+			bodyByte, err = io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(bodyByte)))
+		grpcBodyByte := append(prefix, bodyByte...)
+		req.ContentLength = int64(len(grpcBodyByte))
+		req.Body = io.NopCloser(bytes.NewReader(grpcBodyByte))
+	}
+	if req.GetBody != nil {
+		getBody := req.GetBody
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return &readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), body), closer: body}, nil
+		}
+	}
 
 	protocol := strings.TrimLeft(contentType, "application/")
 	if index := strings.Index(protocol, ";"); index != -1 {
@@ -71,16 +104,21 @@ func (g *grpc) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	req.Header.Set("Content-Type", "application/grpc+"+protocol)
 	req.Header.Del("Content-Length")
-	req.ContentLength = int64(len(grpcBodyByte))
-	req.Body = io.NopCloser(bytes.NewReader(grpcBodyByte))
 
 	resp, err := g.next.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
 
-	resData, err := io.ReadAll(resp.Body)
-	if err != nil {
+	// 只支持一元调用，读完响应体才能拿到 trailers，流式响应有多条消息时直接报错
+	message, err := readMessage(resp.Body)
+	if err == nil {
+		if _, err = readMessage(resp.Body); err == nil {
+			err = errors.New("grpc response has more than one message,streaming is not supported")
+		}
+	}
+	resp.Body.Close()
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 	/*
@@ -115,7 +153,39 @@ func (g *grpc) RoundTrip(req *http.Request) (*http.Response, error) {
 		}, nil
 	}
 
-	resp.Body = io.NopCloser(bytes.NewReader(resData[5:]))
-	resp.ContentLength = int64(len(resData) - 5)
+	resp.Body = io.NopCloser(bytes.NewReader(message))
+	resp.ContentLength = int64(len(message))
 	return resp, nil
 }
+
+// readMessage 读取一条 grpc 消息，没有更多消息时返回 io.EOF
+func readMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("grpc response message is compressed,which is not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("grpc response message is larger than %d bytes,length:%d", maxMessageSize, length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *readCloser) Close() error {
+	return r.closer.Close()
+}
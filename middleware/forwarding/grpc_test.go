@@ -0,0 +1,80 @@
+package forwarding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mini-gateway/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// frameTripper 返回由 frames 组成的 grpc 响应
+type frameTripper struct {
+	frames [][]byte
+}
+
+func (f frameTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	var body bytes.Buffer
+	for _, frame := range f.frames {
+		body.Write(frame)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/grpc"}},
+		Body:       io.NopCloser(&body),
+		Trailer:    http.Header{"Grpc-Status": {"0"}},
+	}, nil
+}
+
+func frame(compressed byte, message string) []byte {
+	prefix := make([]byte, 5)
+	prefix[0] = compressed
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	return append(prefix, message...)
+}
+
+func roundTrip(frames ...[]byte) (*http.Response, error) {
+	rt := Factory(&config.Middleware{Name: NAME})(frameTripper{frames: frames})
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/svc/Method", strings.NewReader("req"))
+	req.Header.Set("Content-Type", "application/json")
+	return rt.RoundTrip(req)
+}
+
+func TestGrpcUnaryResponse(t *testing.T) {
+	resp, err := roundTrip(frame(0, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %q %s", body, resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = roundTrip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Fatalf("expected empty body,got %q", body)
+	}
+}
+
+// 流式响应、压缩消息、超长和截断的消息都返回错误
+func TestGrpcRejectsUnsupportedResponses(t *testing.T) {
+	tooLarge := make([]byte, 5)
+	binary.BigEndian.PutUint32(tooLarge[1:], maxMessageSize+1)
+	cases := map[string][][]byte{
+		"streaming":  {frame(0, "a"), frame(0, "b")},
+		"compressed": {frame(1, "a")},
+		"too large":  {tooLarge},
+		"truncated":  {frame(0, "hello")[:7]},
+	}
+	for name, frames := range cases {
+		if _, err := roundTrip(frames...); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
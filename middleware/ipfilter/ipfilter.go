@@ -0,0 +1,178 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mini-gateway/clientip"
+	"mini-gateway/config"
+	"mini-gateway/geoip"
+	"mini-gateway/middleware"
+	"mini-gateway/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const NAME = "ipFilter"
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"allow":          config.ArgString,
+		"deny":           config.ArgString,
+		"allowCountries": config.ArgString,
+		"denyCountries":  config.ArgString,
+		"status":         config.ArgInt,
+		"geoDatabase":    config.ArgString,
+	})
+}
+
+// Factory 按客户端地址过滤请求，客户端地址按 http.trustedProxies 计算
+//
+//	allow、deny 逗号分隔的 CIDR 或 IP，deny 优先，allow 不为空时只允许其中的地址
+//	geoDatabase MaxMind 格式的国家库文件，allowCountries、denyCountries 逗号分隔的 ISO 国家代码
+//	status 拒绝时的状态码，默认 403
+func Factory(c *config.Middleware) middleware.Middleware {
+	f := &ipFilter{status: http.StatusForbidden}
+	var err error
+	if v, ok := c.Args["allow"]; ok {
+		if f.allow, err = parsePrefixes(v.(string)); err != nil {
+			f.broken = true
+			slog.Error("ip filter allow is invalid,error:%s", err.Error())
+		}
+	}
+	if v, ok := c.Args["deny"]; ok {
+		if f.deny, err = parsePrefixes(v.(string)); err != nil {
+			f.broken = true
+			slog.Error("ip filter deny is invalid,error:%s", err.Error())
+		}
+	}
+	if v, ok := c.Args["allowCountries"]; ok {
+		f.allowCountries = parseCountries(v.(string))
+	}
+	if v, ok := c.Args["denyCountries"]; ok {
+		f.denyCountries = parseCountries(v.(string))
+	}
+	if v, ok := c.Args["status"]; ok {
+		if status := v.(int); status >= 100 && status <= 999 {
+			f.status = status
+		} else {
+			slog.Warn("ip filter status %d is invalid,%d is used by default", status, http.StatusForbidden)
+		}
+	}
+	if v, ok := c.Args["geoDatabase"]; ok {
+		if f.geo, err = geoip.Open(v.(string)); err != nil {
+			slog.Error("ip filter open geo database %s error:%s", v.(string), err.Error())
+		}
+	}
+	if (len(f.allowCountries) > 0 || len(f.denyCountries) > 0) && f.geo == nil {
+		// 无法判断国家时拒绝全部请求，避免误放行
+		f.broken = true
+		slog.Error("ip filter country rules require a valid geoDatabase,all requests will be rejected")
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		n := *f
+		n.next = next
+		return &n
+	}
+}
+
+type ipFilter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	geo            *geoip.Reader
+	status         int
+	// broken 配置错误时拒绝全部请求
+	broken bool
+	next   http.RoundTripper
+}
+
+func (f *ipFilter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.broken {
+		return f.reject("ip filter is misconfigured"), nil
+	}
+	addr, err := clientip.ParseAddr(clientip.Get(req))
+	if err != nil {
+		return f.reject("client address is invalid"), nil
+	}
+	if contains(f.deny, addr) {
+		return f.reject("client address is denied"), nil
+	}
+	if len(f.allow) > 0 && !contains(f.allow, addr) {
+		return f.reject("client address is not allowed"), nil
+	}
+	if len(f.allowCountries) > 0 || len(f.denyCountries) > 0 {
+		country, err := f.geo.Country(addr)
+		if err != nil {
+			slog.Error("ip filter lookup %s error:%s", addr.String(), err.Error())
+		}
+		if f.denyCountries[country] {
+			return f.reject(fmt.Sprintf("country %s is denied", country)), nil
+		}
+		if len(f.allowCountries) > 0 && !f.allowCountries[country] {
+			return f.reject("country is not allowed"), nil
+		}
+	}
+	return f.next.RoundTrip(req)
+}
+
+func (f *ipFilter) reject(message string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode:    f.status,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func parseCountries(s string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+			countries[v] = true
+		}
+	}
+	return countries
+}
@@ -0,0 +1,28 @@
+package ipfilter
+
+import (
+	"mini-gateway/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 不合法的拒绝状态码回退到 403，避免写响应时 panic
+func TestInvalidStatusFallsBackToForbidden(t *testing.T) {
+	cases := map[int]int{0: http.StatusForbidden, 99: http.StatusForbidden, 1000: http.StatusForbidden, 451: 451}
+	for status, want := range cases {
+		rt := Factory(&config.Middleware{Name: NAME, Args: map[string]interface{}{
+			"deny":   "0.0.0.0/0",
+			"status": status,
+		}})(http.DefaultTransport)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("status %d expected %d,got %d", status, want, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"math/big"
+	"mini-gateway/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultJWKSRefresh = 5 * time.Minute
+	DefaultJWKSTimeout = 5 * time.Second
+	// 两次拉取之间的最小间隔，避免未知 kid 的请求或 JWKS 不可用时频繁拉取
+	minJWKSInterval = 10 * time.Second
+)
+
+// KeySet 从 JWKS 地址拉取并缓存公钥，缓存过期或遇到未知 kid 时重新拉取
+type KeySet struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	fetchMu     sync.Mutex
+	refreshing  atomic.Bool
+	mu          sync.RWMutex
+	keys        []jwk
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+func NewKeySet(url string, refresh, timeout time.Duration) *KeySet {
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	if timeout <= 0 {
+		timeout = DefaultJWKSTimeout
+	}
+	return &KeySet{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Keyfunc 按 token 的 kid 和 alg 选择公钥，可直接用于 jwt.Parse
+func (s *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg := token.Method.Alg()
+	s.refreshIfStale()
+	if key, ok := s.find(kid, alg); ok {
+		return key, nil
+	}
+	// 密钥轮换后 kid 可能还不在缓存中
+	s.update(true)
+	if key, ok := s.find(kid, alg); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no jwks key found for kid %s and alg %s", kid, alg)
+}
+
+func (s *KeySet) find(kid, alg string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if keyMatchesAlg(k.key, alg) {
+			return k.key, true
+		}
+	}
+	return nil, false
+}
+
+// refreshIfStale 还没有密钥时同步拉取，缓存过期时在后台拉取，请求继续使用旧的密钥
+func (s *KeySet) refreshIfStale() {
+	s.mu.RLock()
+	due, empty := s.due(false), s.fetched.IsZero()
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+	if empty {
+		s.update(false)
+		return
+	}
+	if s.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer s.refreshing.Store(false)
+			s.update(false)
+		}()
+	}
+}
+
+// due 调用时需要持有 mu，force 为 false 时只在缓存过期后拉取，两种情况都受最小拉取间隔限制
+func (s *KeySet) due(force bool) bool {
+	if !force && time.Since(s.fetched) < s.refresh {
+		return false
+	}
+	return time.Since(s.lastAttempt) >= minJWKSInterval
+}
+
+// update 先在读锁下判断是否需要拉取，同一时间只有一个请求拉取
+func (s *KeySet) update(force bool) {
+	s.mu.RLock()
+	due := s.due(force)
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	// 等待期间其他请求可能已经拉取过
+	s.mu.RLock()
+	due = s.due(force)
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	keys, err := s.fetch()
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAttempt = now
+	if err != nil {
+		slog.Error("fetch jwks from %s error:%s", s.url, err.Error())
+		return
+	}
+	s.keys = keys
+	s.fetched = now
+}
+
+func (s *KeySet) fetch() ([]jwk, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS 解析 JWKS 文档，跳过用于加密和不支持的密钥
+func parseJWKS(data []byte) ([]jwk, error) {
+	var doc struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := make([]jwk, 0, len(doc.Keys))
+	for _, raw := range doc.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key, err := raw.publicKey()
+		if err != nil {
+			slog.Warn("skip jwks key %s,error:%s", raw.Kid, err.Error())
+			continue
+		}
+		keys = append(keys, jwk{kid: raw.Kid, alg: raw.Alg, key: key})
+	}
+	if len(doc.Keys) > 0 && len(keys) == 0 {
+		return nil, errors.New("jwks contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k *rawJWK) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is invalid")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519 key size is invalid")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keyMatchesAlg 防止用非对称公钥校验 HS 签名之类的算法混淆
+func keyMatchesAlg(key interface{}, alg string) bool {
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		_, ok := key.([]byte)
+		return ok
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case strings.HasPrefix(alg, "ES"):
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case alg == "EdDSA":
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	}
+	return false
+}
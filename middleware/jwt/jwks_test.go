@@ -0,0 +1,173 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeJWKS 本地的 JWKS 地址，记录拉取次数，block 不为空时阻塞到其关闭
+type fakeJWKS struct {
+	mux   sync.Mutex
+	keys  map[string]*rsa.PrivateKey
+	hits  int32
+	block chan struct{}
+}
+
+func newFakeJWKS(t *testing.T, kids ...string) (*fakeJWKS, *httptest.Server) {
+	f := &fakeJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	for _, kid := range kids {
+		f.add(t, kid)
+	}
+	s := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(s.Close)
+	return f, s
+}
+
+func (f *fakeJWKS) add(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mux.Lock()
+	f.keys[kid] = key
+	f.mux.Unlock()
+}
+
+func (f *fakeJWKS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.hits, 1)
+	f.mux.Lock()
+	block := f.block
+	keys := make([]map[string]string, 0, len(f.keys))
+	for kid, key := range f.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	f.mux.Unlock()
+	if block != nil {
+		<-block
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (f *fakeJWKS) sign(t *testing.T, kid string) string {
+	f.mux.Lock()
+	key := f.keys[kid]
+	f.mux.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice"})
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func verify(ks *KeySet, token string) error {
+	_, err := jwt.Parse(token, ks.Keyfunc)
+	return err
+}
+
+// 缓存有效时并发的请求只拉取一次
+func TestKeySetFetchesOnce(t *testing.T) {
+	f, s := newFakeJWKS(t, "k1")
+	ks := NewKeySet(s.URL, time.Minute, time.Second)
+	token := f.sign(t, "k1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := verify(ks, token); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits := atomic.LoadInt32(&f.hits); hits != 1 {
+		t.Fatalf("expected 1 fetch,got %d", hits)
+	}
+}
+
+// 密钥轮换后未知的 kid 触发重新拉取
+func TestKeySetRefetchesUnknownKid(t *testing.T) {
+	f, s := newFakeJWKS(t, "k1")
+	ks := NewKeySet(s.URL, time.Minute, time.Second)
+	if err := verify(ks, f.sign(t, "k1")); err != nil {
+		t.Fatal(err)
+	}
+	f.add(t, "k2")
+	token := f.sign(t, "k2")
+	// 最小拉取间隔内不重新拉取
+	if err := verify(ks, token); err == nil {
+		t.Fatal("unknown kid should fail within the minimum fetch interval")
+	}
+	ks.mu.Lock()
+	ks.lastAttempt = time.Now().Add(-minJWKSInterval)
+	ks.mu.Unlock()
+	if err := verify(ks, token); err != nil {
+		t.Fatal(err)
+	}
+	if hits := atomic.LoadInt32(&f.hits); hits != 2 {
+		t.Fatalf("expected 2 fetches,got %d", hits)
+	}
+}
+
+// 缓存过期后在后台拉取，请求不等待 JWKS 地址的响应
+func TestKeySetRefreshesStaleKeysInBackground(t *testing.T) {
+	f, s := newFakeJWKS(t, "k1")
+	ks := NewKeySet(s.URL, time.Minute, 5*time.Second)
+	token := f.sign(t, "k1")
+	if err := verify(ks, token); err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	f.mux.Lock()
+	f.block = block
+	f.mux.Unlock()
+	ks.mu.Lock()
+	ks.fetched = time.Now().Add(-time.Hour)
+	ks.lastAttempt = ks.fetched
+	ks.mu.Unlock()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := verify(ks, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("requests waited %s for the background refresh", elapsed)
+	}
+	close(block)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ks.mu.RLock()
+		fresh := time.Since(ks.fetched) < time.Minute
+		ks.mu.RUnlock()
+		if fresh {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for background refresh")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hits := atomic.LoadInt32(&f.hits); hits != 2 {
+		t.Fatalf("expected 2 fetches,got %d", hits)
+	}
+}
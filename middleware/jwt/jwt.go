@@ -1,74 +1,236 @@
 package jwt
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
+	"io"
 	"mini-gateway/config"
 	"mini-gateway/middleware"
+	"mini-gateway/reqcontext"
 	"mini-gateway/router/trie"
+	"mini-gateway/slog"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
 const NAME = "jwt"
 
+const defaultTokenLookup = "header:Authorization,header:X-Auth-Token"
+
 func init() {
 	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"tokenLookup":    config.ArgString,
+		"secret":         config.ArgString,
+		"publicKey":      config.ArgString,
+		"publicKeyFile":  config.ArgString,
+		"jwksUrl":        config.ArgString,
+		"jwksRefresh":    config.ArgInt,
+		"jwksTimeout":    config.ArgInt,
+		"algorithms":     config.ArgString,
+		"issuer":         config.ArgString,
+		"audience":       config.ArgString,
+		"requiredClaims": config.ArgString,
+		"clockSkew":      config.ArgInt,
+		"forwardClaims":  config.ArgStringMap,
+		"skipValidUrl":   config.ArgString,
+	})
 }
 
+// Factory jwt 鉴权中间件
+//
+//	secret、publicKey(PEM)、publicKeyFile、jwksUrl 至少配置一个
+//	tokenLookup: header:<name> | cookie:<name> | query:<name>，逗号分隔按顺序查找，Authorization 头去掉 Bearer 前缀
+//	algorithms、issuer、audience、requiredClaims 逗号分隔，clockSkew、jwksRefresh、jwksTimeout 单位毫秒
+//	forwardClaims 声明到请求头的映射，比如 {sub: X-User-Id}，支持 a.b 形式的嵌套声明
 func Factory(c *config.Middleware) middleware.Middleware {
-	secret := "12345678"
-	if v, ok := c.Args["secret"]; ok {
-		secret = v.(string)
+	v := &Validator{}
+	tokenLookup := defaultTokenLookup
+	jwksUrl := ""
+	jwksRefresh := DefaultJWKSRefresh
+	jwksTimeout := DefaultJWKSTimeout
+	forwardClaims := make(map[string]string)
+
+	if v, ok := c.Args["tokenLookup"]; ok {
+		tokenLookup = v.(string)
+	}
+	if s, ok := c.Args["secret"]; ok {
+		v.Secret = []byte(s.(string))
+	}
+	if s, ok := c.Args["publicKey"]; ok {
+		v.PublicKey = parsePublicKey([]byte(s.(string)))
+	}
+	if s, ok := c.Args["publicKeyFile"]; ok {
+		data, err := os.ReadFile(s.(string))
+		if err != nil {
+			slog.Error("read jwt public key file %s error:%s", s.(string), err.Error())
+		} else {
+			v.PublicKey = parsePublicKey(data)
+		}
+	}
+	if s, ok := c.Args["jwksUrl"]; ok {
+		jwksUrl = s.(string)
+	}
+	if s, ok := c.Args["jwksRefresh"]; ok {
+		jwksRefresh = time.Duration(s.(int)) * time.Millisecond
+	}
+	if s, ok := c.Args["jwksTimeout"]; ok {
+		jwksTimeout = time.Duration(s.(int)) * time.Millisecond
+	}
+	if s, ok := c.Args["algorithms"]; ok {
+		v.Algorithms = splitList(s.(string))
+	}
+	if s, ok := c.Args["issuer"]; ok {
+		v.Issuers = splitList(s.(string))
+	}
+	if s, ok := c.Args["audience"]; ok {
+		v.Audiences = splitList(s.(string))
+	}
+	if s, ok := c.Args["requiredClaims"]; ok {
+		v.RequiredClaims = splitList(s.(string))
+	}
+	if s, ok := c.Args["clockSkew"]; ok {
+		v.ClockSkew = time.Duration(s.(int)) * time.Millisecond
+	}
+	if s, ok := c.Args["forwardClaims"]; ok {
+		for claim, header := range s.(map[string]interface{}) {
+			forwardClaims[claim] = header.(string)
+		}
+	}
+	if jwksUrl != "" {
+		v.KeySet = NewKeySet(jwksUrl, jwksRefresh, jwksTimeout)
+	}
+	if len(v.Secret) == 0 && v.PublicKey == nil && v.KeySet == nil {
+		slog.Error("jwt middleware has no secret, public key or jwks url,all requests will be rejected")
 	}
 
 	t := trie.NewTrie[any]()
 	if v, ok := c.Args["skipValidUrl"]; ok {
 		ss := strings.Split(v.(string), ",")
 		for _, s := range ss {
-			t.Insert(s, nil)
+			if err := t.Insert(s, nil); err != nil {
+				slog.Error(err.Error())
+			}
 		}
 	}
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		return &jWt{
-			next:   next,
-			secret: secret,
-			trie:   t,
+			next:          next,
+			validator:     v,
+			tokenLookup:   splitList(tokenLookup),
+			forwardClaims: forwardClaims,
+			trie:          t,
 		}
 	}
 }
 
 type jWt struct {
-	secret       string
-	skipValidUrl string
-	trie         *trie.Trie[any]
-	next         http.RoundTripper
+	validator     *Validator
+	tokenLookup   []string
+	forwardClaims map[string]string
+	trie          *trie.Trie[any]
+	next          http.RoundTripper
 }
 
 func (j *jWt) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 上游信任转发的声明头，不允许客户端伪造
+	for _, header := range j.forwardClaims {
+		req.Header.Del(header)
+	}
 	if _, _, b := j.trie.Search(req.URL.Path); b {
 		return j.next.RoundTrip(req)
 	}
-	token := req.Header.Get("X-Auth-Token")
-	_, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return []byte(j.secret), nil
-	})
+	claims, err := j.validator.Validate(j.token(req))
 	if err != nil {
-		return &http.Response{
-			StatusCode: http.StatusUnauthorized,
-		}, nil
+		return Unauthorized(err), nil
+	}
+	for claim, header := range j.forwardClaims {
+		if value, ok := ClaimValue(claims, claim); ok && value != nil {
+			req.Header.Set(header, ClaimString(value))
+		}
 	}
-	return j.next.RoundTrip(req)
+	ctx := reqcontext.WithClaims(req.Context(), claims)
+	return j.next.RoundTrip(req.WithContext(ctx))
 }
 
-//func createToken(userId int, secret string) (tokens string, err error) {
-//	claim := jwt.MapClaims{
-//		"id":  userId,
-//		"nbf": time.Now().Unix(),
-//		"iat": time.Now().Unix(),
-//		"exp": time.Now().Unix() + 2592000,
-//	}
-//	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-//	tokens, err = token.SignedString([]byte(secret))
-//	return
-//}
+func (j *jWt) token(req *http.Request) string {
+	for _, lookup := range j.tokenLookup {
+		kind, name, _ := strings.Cut(lookup, ":")
+		value := ""
+		switch kind {
+		case "header":
+			value = bearer(req.Header.Get(name))
+		case "cookie":
+			if c, err := req.Cookie(name); err == nil {
+				value = c.Value
+			}
+		case "query":
+			value = req.URL.Query().Get(name)
+		}
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func bearer(value string) string {
+	if len(value) > 7 && strings.EqualFold(value[:7], "Bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	return value
+}
+
+// Unauthorized 返回带错误信息的 401 响应
+func Unauthorized(err error) *http.Response {
+	code := "invalid_token"
+	if errors.Is(err, errTokenMissing) {
+		code = "missing_token"
+	}
+	body, _ := json.Marshal(map[string]string{
+		"error":   code,
+		"message": err.Error(),
+	})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if code == "missing_token" {
+		header.Set("WWW-Authenticate", "Bearer")
+	} else {
+		header.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	return &http.Response{
+		StatusCode:    http.StatusUnauthorized,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func parsePublicKey(data []byte) interface{} {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return key
+	}
+	slog.Error("jwt public key is not a valid RSA, EC or Ed25519 PEM public key")
+	return nil
+}
+
+func splitList(s string) []string {
+	ss := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
@@ -0,0 +1,146 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errTokenMissing = errors.New("token is missing")
+
+var (
+	HMACAlgorithms       = []string{"HS256", "HS384", "HS512"}
+	AsymmetricAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+)
+
+// Validator 校验 token 的签名和声明，Algorithms 为空时按配置的密钥推导
+type Validator struct {
+	Secret         []byte
+	PublicKey      interface{}
+	KeySet         *KeySet
+	Algorithms     []string
+	Issuers        []string
+	Audiences      []string
+	RequiredClaims []string
+	ClockSkew      time.Duration
+}
+
+func (v *Validator) algorithms() []string {
+	if len(v.Algorithms) > 0 {
+		return v.Algorithms
+	}
+	algs := make([]string, 0)
+	if len(v.Secret) > 0 {
+		algs = append(algs, HMACAlgorithms...)
+	}
+	if v.PublicKey != nil || v.KeySet != nil {
+		algs = append(algs, AsymmetricAlgorithms...)
+	}
+	return algs
+}
+
+func (v *Validator) Validate(tokenString string) (jwt.MapClaims, error) {
+	if tokenString == "" {
+		return nil, errTokenMissing
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods(v.algorithms()), jwt.WithLeeway(v.ClockSkew))
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(tokenString, claims, v.keyfunc); err != nil {
+		return nil, err
+	}
+	if len(v.Issuers) > 0 {
+		iss, _ := claims.GetIssuer()
+		if !contains(v.Issuers, iss) {
+			return nil, fmt.Errorf("token issuer %s is not allowed", iss)
+		}
+	}
+	if len(v.Audiences) > 0 {
+		aud, _ := claims.GetAudience()
+		matched := false
+		for _, a := range aud {
+			if contains(v.Audiences, a) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, errors.New("token audience is not allowed")
+		}
+	}
+	for _, name := range v.RequiredClaims {
+		if value, ok := ClaimValue(claims, name); !ok || value == nil {
+			return nil, fmt.Errorf("token claim %s is required", name)
+		}
+	}
+	return claims, nil
+}
+
+func (v *Validator) keyfunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if strings.HasPrefix(alg, "HS") && len(v.Secret) > 0 {
+		return v.Secret, nil
+	}
+	if v.PublicKey != nil && keyMatchesAlg(v.PublicKey, alg) {
+		return v.PublicKey, nil
+	}
+	if v.KeySet != nil {
+		return v.KeySet.Keyfunc(token)
+	}
+	return nil, fmt.Errorf("no key configured for alg %s", alg)
+}
+
+// ClaimValue 按 a.b.c 的路径读取嵌套的声明
+func ClaimValue(claims map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := claims[path]; ok {
+		return v, true
+	}
+	var cur interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// ClaimString 把声明转换为请求头的值，数组用逗号连接，对象编码为 JSON
+func ClaimString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case []interface{}:
+		ss := make([]string, 0, len(val))
+		for _, item := range val {
+			ss = append(ss, ClaimString(item))
+		}
+		return strings.Join(ss, ",")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
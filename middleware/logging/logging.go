@@ -3,6 +3,7 @@ package logging
 import (
 	"mini-gateway/config"
 	"mini-gateway/middleware"
+	"mini-gateway/reqcontext"
 	"mini-gateway/slog"
 	"net/http"
 	"time"
@@ -31,6 +32,10 @@ func (l *logging) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, err
 	}
 	cost := time.Since(start)
+	if consumer, ok := reqcontext.Consumer(req.Context()); ok {
+		slog.Info("logging req %s,consumer:%s,耗时:%fms", req.URL, consumer, cost.Seconds()*1000)
+		return trip, err
+	}
 	slog.Info("logging req %s,耗时:%fms", req.URL, cost.Seconds()*1000)
 	return trip, err
 }
@@ -27,8 +27,13 @@ func Get(cfg *config.Middleware) (f Factory, ok bool) {
 }
 
 func BuildMiddleware(ms []*config.Middleware, next http.RoundTripper) (http.RoundTripper, error) {
+	// 排序副本，配置可能同时被管理接口读取
+	ms = append([]*config.Middleware(nil), ms...)
 	middlewareSort(ms)
 	for i := 0; i < len(ms); i++ {
+		if err := ms[i].Validate(); err != nil {
+			return nil, err
+		}
 		factory, ok := Get(ms[i])
 		if !ok {
 			slog.Error("%s middleware not found", ms[i].Name)
@@ -0,0 +1,455 @@
+package oidc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/middleware"
+	"mini-gateway/middleware/jwt"
+	"mini-gateway/reqcontext"
+	"mini-gateway/router/trie"
+	"mini-gateway/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const NAME = "oidc"
+
+const (
+	defaultCookieName  = "mini_gateway_session"
+	defaultRedirectUrl = "/oauth2/callback"
+	defaultLogoutUrl   = "/oauth2/logout"
+	defaultScopes      = "openid,profile,email"
+	defaultSessionTtl  = 24 * time.Hour
+	defaultTimeout     = 5 * time.Second
+	loginStateTtl      = 10 * time.Minute
+	// access token 过期前提前刷新的时间
+	refreshLeeway = 30 * time.Second
+)
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"issuer":                config.ArgString,
+		"clientId":              config.ArgString,
+		"clientSecret":          config.ArgString,
+		"cookieSecret":          config.ArgString,
+		"cookieName":            config.ArgString,
+		"cookieSecure":          config.ArgBool,
+		"redirectUrl":           config.ArgString,
+		"logoutUrl":             config.ArgString,
+		"postLogoutRedirectUrl": config.ArgString,
+		"scopes":                config.ArgString,
+		"sessionTtl":            config.ArgInt,
+		"timeout":               config.ArgInt,
+		"forwardAccessToken":    config.ArgBool,
+		"forwardClaims":         config.ArgStringMap,
+		"skipUrl":               config.ArgString,
+	})
+}
+
+// Factory oidc 授权码登录中间件
+//
+//	issuer、clientId、clientSecret、cookieSecret 必填
+//	redirectUrl 回调地址，可以是完整 URL 或路径，logoutUrl 登出路径，两者都必须路由到当前端点
+//	scopes 逗号分隔，sessionTtl、timeout 单位毫秒，cookieSecure 为 true 时 cookie 只通过 https 发送
+//	skipUrl 逗号分隔的不需要登录的路径，语法同路由路径
+//	forwardClaims 声明到请求头的映射，forwardAccessToken 为 true 时通过 Authorization 头转发 access token
+func Factory(c *config.Middleware) middleware.Middleware {
+	issuer := ""
+	clientID := ""
+	clientSecret := ""
+	cookieSecret := ""
+	o := &oidc{
+		cookieName:    defaultCookieName,
+		redirectUrl:   defaultRedirectUrl,
+		logoutUrl:     defaultLogoutUrl,
+		scopes:        defaultScopes,
+		sessionTtl:    defaultSessionTtl,
+		forwardClaims: make(map[string]string),
+		trie:          trie.NewTrie[any](),
+	}
+	timeout := defaultTimeout
+	cookieSecure := false
+
+	if v, ok := c.Args["issuer"]; ok {
+		issuer = v.(string)
+	}
+	if v, ok := c.Args["clientId"]; ok {
+		clientID = v.(string)
+	}
+	if v, ok := c.Args["clientSecret"]; ok {
+		clientSecret = v.(string)
+	}
+	if v, ok := c.Args["cookieSecret"]; ok {
+		cookieSecret = v.(string)
+	}
+	if v, ok := c.Args["cookieName"]; ok {
+		o.cookieName = v.(string)
+	}
+	if v, ok := c.Args["cookieSecure"]; ok {
+		cookieSecure = v.(bool)
+	}
+	if v, ok := c.Args["redirectUrl"]; ok {
+		o.redirectUrl = v.(string)
+	}
+	if v, ok := c.Args["logoutUrl"]; ok {
+		o.logoutUrl = v.(string)
+	}
+	if v, ok := c.Args["postLogoutRedirectUrl"]; ok {
+		o.postLogoutRedirectUrl = v.(string)
+	}
+	if v, ok := c.Args["scopes"]; ok {
+		o.scopes = v.(string)
+	}
+	if v, ok := c.Args["sessionTtl"]; ok {
+		o.sessionTtl = time.Duration(v.(int)) * time.Millisecond
+	}
+	if v, ok := c.Args["timeout"]; ok {
+		timeout = time.Duration(v.(int)) * time.Millisecond
+	}
+	if v, ok := c.Args["forwardAccessToken"]; ok {
+		o.forwardAccessToken = v.(bool)
+	}
+	if v, ok := c.Args["forwardClaims"]; ok {
+		for claim, header := range v.(map[string]interface{}) {
+			o.forwardClaims[claim] = header.(string)
+		}
+	}
+	if v, ok := c.Args["skipUrl"]; ok {
+		for _, s := range strings.Split(v.(string), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if err := o.trie.Insert(s, nil); err != nil {
+				slog.Error(err.Error())
+			}
+		}
+	}
+
+	if issuer == "" || clientID == "" {
+		slog.Error("oidc middleware requires issuer and clientId,all requests will be rejected")
+	}
+	if cookieSecret == "" {
+		// 每次加载配置都会生成新密钥，已有会话会失效
+		slog.Warn("oidc middleware cookieSecret is empty,a random secret is used and sessions will not survive reloads")
+		cookieSecret = randomString(32)
+	}
+	if o.sessionTtl <= 0 {
+		o.sessionTtl = defaultSessionTtl
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	codec, err := newCookieCodec(cookieSecret, cookieSecure)
+	if err != nil {
+		slog.Error("oidc cookie codec error:%s", err.Error())
+	}
+	o.codec = codec
+	o.stateCookie = o.cookieName + "_state"
+	o.provider = newProvider(issuer, clientID, clientSecret, timeout)
+	o.callbackPath = o.redirectUrl
+	if u, err := url.Parse(o.redirectUrl); err == nil && u.Path != "" {
+		o.callbackPath = u.Path
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		n := *o
+		n.next = next
+		return &n
+	}
+}
+
+type oidc struct {
+	provider              *provider
+	codec                 *cookieCodec
+	cookieName            string
+	stateCookie           string
+	redirectUrl           string
+	callbackPath          string
+	logoutUrl             string
+	postLogoutRedirectUrl string
+	scopes                string
+	sessionTtl            time.Duration
+	forwardAccessToken    bool
+	forwardClaims         map[string]string
+	trie                  *trie.Trie[any]
+	next                  http.RoundTripper
+}
+
+func (o *oidc) RoundTrip(req *http.Request) (*http.Response, error) {
+	for _, header := range o.forwardClaims {
+		req.Header.Del(header)
+	}
+	if o.provider.issuer == "" || o.provider.clientID == "" || o.codec == nil {
+		return errorResponse(http.StatusUnauthorized, "oidc middleware is not configured"), nil
+	}
+	switch req.URL.Path {
+	case o.callbackPath:
+		return o.callback(req), nil
+	case o.logoutUrl:
+		return o.logout(req), nil
+	}
+	if _, _, ok := o.trie.Search(req.URL.Path); ok {
+		o.stripCookies(req)
+		return o.next.RoundTrip(req)
+	}
+
+	s := &session{}
+	if err := o.codec.read(req, o.cookieName, s); err != nil {
+		return o.login(req), nil
+	}
+	now := time.Now()
+	if now.After(time.Unix(s.Created, 0).Add(o.sessionTtl)) {
+		return o.login(req), nil
+	}
+	refreshed := false
+	if s.Expiry > 0 && now.Add(refreshLeeway).After(time.Unix(s.Expiry, 0)) {
+		if s.RefreshToken == "" {
+			return o.login(req), nil
+		}
+		if err := o.refresh(req, s); err != nil {
+			slog.Warn("oidc refresh token error:%s", err.Error())
+			return o.login(req), nil
+		}
+		refreshed = true
+	}
+
+	o.stripCookies(req)
+	for claim, header := range o.forwardClaims {
+		if value, ok := jwt.ClaimValue(s.Claims, claim); ok && value != nil {
+			req.Header.Set(header, jwt.ClaimString(value))
+		}
+	}
+	if o.forwardAccessToken && s.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	}
+	ctx := reqcontext.WithClaims(req.Context(), s.Claims)
+	resp, err := o.next.RoundTrip(req.WithContext(ctx))
+	if err != nil || !refreshed {
+		return resp, err
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	// 刷新不延长会话的有效期
+	maxAge := time.Until(time.Unix(s.Created, 0).Add(o.sessionTtl))
+	if err := o.codec.write(resp.Header, req, o.cookieName, s, maxAge); err != nil {
+		slog.Error("oidc write session cookie error:%s", err.Error())
+	}
+	return resp, nil
+}
+
+// login 浏览器请求跳转到授权端点，其他请求返回 401
+func (o *oidc) login(req *http.Request) *http.Response {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return errorResponse(http.StatusUnauthorized, "login required")
+	}
+	m, _, err := o.provider.load(req.Context())
+	if err != nil {
+		slog.Error("oidc discovery error:%s", err.Error())
+		return errorResponse(http.StatusBadGateway, "identity provider is unavailable")
+	}
+	state := &loginState{
+		State:    randomString(24),
+		Nonce:    randomString(24),
+		Verifier: randomString(32),
+		Redirect: req.URL.RequestURI(),
+	}
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.provider.clientID)
+	q.Set("redirect_uri", o.callbackUrl(req))
+	q.Set("scope", strings.Join(strings.Split(o.scopes, ","), " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	location := m.AuthorizationEndpoint
+	if strings.Contains(location, "?") {
+		location += "&" + q.Encode()
+	} else {
+		location += "?" + q.Encode()
+	}
+
+	resp := redirect(location)
+	if err := o.codec.write(resp.Header, req, o.stateCookie, state, loginStateTtl); err != nil {
+		slog.Error("oidc write state cookie error:%s", err.Error())
+		return errorResponse(http.StatusInternalServerError, "write login state failed")
+	}
+	return resp
+}
+
+func (o *oidc) callback(req *http.Request) *http.Response {
+	q := req.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return errorResponse(http.StatusUnauthorized, e+" "+q.Get("error_description"))
+	}
+	state := &loginState{}
+	if err := o.codec.read(req, o.stateCookie, state); err != nil {
+		return errorResponse(http.StatusBadRequest, "login state is missing or invalid")
+	}
+	if q.Get("state") != state.State || q.Get("code") == "" {
+		return errorResponse(http.StatusBadRequest, "login state does not match")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", q.Get("code"))
+	form.Set("redirect_uri", o.callbackUrl(req))
+	form.Set("code_verifier", state.Verifier)
+	t, err := o.provider.token(req.Context(), form)
+	if err != nil {
+		slog.Error("oidc exchange code error:%s", err.Error())
+		return errorResponse(http.StatusBadGateway, "exchange authorization code failed")
+	}
+	claims, err := o.verifyIDToken(req, t.IDToken)
+	if err != nil {
+		slog.Warn("oidc id token is invalid:%s", err.Error())
+		return errorResponse(http.StatusUnauthorized, "id token is invalid")
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+		return errorResponse(http.StatusUnauthorized, "id token nonce does not match")
+	}
+
+	s := &session{Claims: claims, Created: time.Now().Unix()}
+	s.update(t)
+	target := state.Redirect
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	resp := redirect(target)
+	o.codec.clear(resp.Header, req, o.stateCookie)
+	if err := o.codec.write(resp.Header, req, o.cookieName, s, o.sessionTtl); err != nil {
+		slog.Error("oidc write session cookie error:%s", err.Error())
+		return errorResponse(http.StatusInternalServerError, "write session failed")
+	}
+	return resp
+}
+
+func (o *oidc) refresh(req *http.Request, s *session) error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", s.RefreshToken)
+	t, err := o.provider.token(req.Context(), form)
+	if err != nil {
+		return err
+	}
+	if t.IDToken != "" {
+		claims, err := o.verifyIDToken(req, t.IDToken)
+		if err != nil {
+			return err
+		}
+		s.Claims = claims
+	}
+	s.update(t)
+	return nil
+}
+
+func (o *oidc) verifyIDToken(req *http.Request, idToken string) (map[string]interface{}, error) {
+	_, v, err := o.provider.load(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if idToken == "" {
+		return nil, errors.New("token response has no id token")
+	}
+	return v.Validate(idToken)
+}
+
+func (s *session) update(t *tokenResponse) {
+	if t.IDToken != "" {
+		s.IDToken = t.IDToken
+	}
+	s.AccessToken = t.AccessToken
+	if t.RefreshToken != "" {
+		s.RefreshToken = t.RefreshToken
+	}
+	s.Expiry = 0
+	if t.ExpiresIn > 0 {
+		s.Expiry = time.Now().Unix() + t.ExpiresIn
+	} else if exp, ok := s.Claims["exp"].(float64); ok {
+		s.Expiry = int64(exp)
+	}
+}
+
+// logout 清除会话，提供方支持时跳转到提供方登出
+func (o *oidc) logout(req *http.Request) *http.Response {
+	s := &session{}
+	hasSession := o.codec.read(req, o.cookieName, s) == nil
+	location := o.postLogoutRedirectUrl
+	if location == "" {
+		location = "/"
+	}
+	if m, _, err := o.provider.load(req.Context()); err == nil && m.EndSessionEndpoint != "" {
+		q := url.Values{}
+		q.Set("client_id", o.provider.clientID)
+		if hasSession && s.IDToken != "" {
+			q.Set("id_token_hint", s.IDToken)
+		}
+		if o.postLogoutRedirectUrl != "" {
+			q.Set("post_logout_redirect_uri", o.postLogoutRedirectUrl)
+		}
+		location = m.EndSessionEndpoint + "?" + q.Encode()
+	}
+	resp := redirect(location)
+	o.codec.clear(resp.Header, req, o.cookieName)
+	return resp
+}
+
+func (o *oidc) callbackUrl(req *http.Request) string {
+	if strings.HasPrefix(o.redirectUrl, "http://") || strings.HasPrefix(o.redirectUrl, "https://") {
+		return o.redirectUrl
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + o.redirectUrl
+}
+
+// stripCookies 不把网关的会话 cookie 转发给上游
+func (o *oidc) stripCookies(req *http.Request) {
+	cookies := req.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == o.cookieName || c.Name == o.stateCookie || strings.HasPrefix(c.Name, o.cookieName+"_") {
+			continue
+		}
+		req.AddCookie(c)
+	}
+}
+
+func redirect(location string) *http.Response {
+	header := http.Header{}
+	header.Set("Location", location)
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		StatusCode: http.StatusFound,
+		Header:     header,
+		Body:       http.NoBody,
+	}
+}
+
+func errorResponse(code int, message string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Cache-Control", "no-store")
+	return &http.Response{
+		StatusCode:    code,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,202 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"mini-gateway/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider 本地的 OIDC 提供方，支持 discovery、JWKS 和授权码换取 token
+type fakeProvider struct {
+	t         *testing.T
+	url       string
+	key       *rsa.PrivateKey
+	mux       sync.Mutex
+	nonce     string
+	discovery int32
+	failing   atomic.Bool
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeProvider{t: t, key: key}
+	s := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(s.Close)
+	f.url = s.URL
+	return f
+}
+
+func (f *fakeProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		atomic.AddInt32(&f.discovery, 1)
+		if f.failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.url,
+			"authorization_endpoint": f.url + "/authorize",
+			"token_endpoint":         f.url + "/token",
+			"jwks_uri":               f.url + "/jwks",
+		})
+	case "/jwks":
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+	case "/token":
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if id, _, _ := r.BasicAuth(); id != "gateway" {
+			f.t.Errorf("unexpected client id %s", id)
+		}
+		f.mux.Lock()
+		nonce := f.nonce
+		f.mux.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": f.url, "aud": "gateway", "sub": "alice", "nonce": nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+		})
+		token.Header["kid"] = "k1"
+		idToken, err := token.SignedString(f.key)
+		if err != nil {
+			f.t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken,
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type recordTripper struct {
+	req *http.Request
+}
+
+func (r *recordTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.req = req
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func browserRequest(t *testing.T, target string, cookies []*http.Cookie) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func roundTrip(t *testing.T, rt http.RoundTripper, req *http.Request) *http.Response {
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestLoginFlow(t *testing.T) {
+	f := newFakeProvider(t)
+	next := &recordTripper{}
+	rt := Factory(&config.Middleware{Name: NAME, Args: map[string]interface{}{
+		"issuer":        f.url,
+		"clientId":      "gateway",
+		"clientSecret":  "secret",
+		"cookieSecret":  "cookie-secret",
+		"forwardClaims": map[string]interface{}{"sub": "X-User"},
+	}})(next)
+
+	resp := roundTrip(t, rt, browserRequest(t, "http://app.example.com/orders?page=2", nil))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected login redirect,got %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), f.url+"/authorize?") {
+		t.Fatalf("unexpected authorize location %s", resp.Header.Get("Location"))
+	}
+	q := location.Query()
+	if q.Get("redirect_uri") != "http://app.example.com/oauth2/callback" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorize query %s", location.RawQuery)
+	}
+	f.mux.Lock()
+	f.nonce = q.Get("nonce")
+	f.mux.Unlock()
+
+	callback := "http://app.example.com/oauth2/callback?code=good-code&state=" + url.QueryEscape(q.Get("state"))
+	resp = roundTrip(t, rt, browserRequest(t, callback, resp.Cookies()))
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/orders?page=2" {
+		t.Fatalf("expected redirect back to /orders?page=2,got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp = roundTrip(t, rt, browserRequest(t, "http://app.example.com/orders?page=2", resp.Cookies()))
+	if resp.StatusCode != http.StatusOK || next.req == nil {
+		t.Fatalf("expected request to reach upstream,got %d", resp.StatusCode)
+	}
+	if user := next.req.Header.Get("X-User"); user != "alice" {
+		t.Fatalf("expected X-User alice,got %s", user)
+	}
+	if cookie := next.req.Header.Get("Cookie"); cookie != "" {
+		t.Fatalf("session cookies should not reach upstream,got %s", cookie)
+	}
+}
+
+// discovery 失败后在重试间隔内直接返回错误，并发的请求只获取一次
+func TestDiscoveryFailureIsCached(t *testing.T) {
+	f := newFakeProvider(t)
+	f.failing.Store(true)
+	p := newProvider(f.url, "gateway", "", time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := p.load(context.Background()); err == nil {
+				t.Error("expected discovery error")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&f.discovery); n != 1 {
+		t.Fatalf("expected 1 discovery request,got %d", n)
+	}
+
+	f.failing.Store(false)
+	if _, _, err := p.load(context.Background()); err == nil {
+		t.Fatal("failure should be cached within the retry interval")
+	}
+	p.mu.Lock()
+	p.failedAt = time.Now().Add(-discoveryRetryInterval)
+	p.mu.Unlock()
+	if _, _, err := p.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&f.discovery); n != 2 {
+		t.Fatalf("expected 2 discovery requests,got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mini-gateway/middleware/jwt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discovery 失败后重新获取前的间隔，期间直接返回上次的错误
+const discoveryRetryInterval = 10 * time.Second
+
+// provider 从 issuer 的 discovery 文档获取各端点，获取成功后缓存
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu        sync.Mutex
+	metadata  *metadata
+	validator *jwt.Validator
+	// loading 不为空时有请求正在获取 discovery 文档，关闭后其他请求重新检查结果
+	loading  chan struct{}
+	err      error
+	failedAt time.Time
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+func newProvider(issuer, clientID, clientSecret string, timeout time.Duration) *provider {
+	return &provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: timeout},
+	}
+}
+
+// load 同一时间只有一个请求获取 discovery 文档，其他请求等待其结果，获取时不持有锁
+func (p *provider) load(ctx context.Context) (*metadata, *jwt.Validator, error) {
+	for {
+		p.mu.Lock()
+		if p.metadata != nil {
+			m, v := p.metadata, p.validator
+			p.mu.Unlock()
+			return m, v, nil
+		}
+		if p.err != nil && time.Since(p.failedAt) < discoveryRetryInterval {
+			err := p.err
+			p.mu.Unlock()
+			return nil, nil, err
+		}
+		if loading := p.loading; loading != nil {
+			p.mu.Unlock()
+			select {
+			case <-loading:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		loading := make(chan struct{})
+		p.loading = loading
+		p.mu.Unlock()
+
+		// 结果由所有请求共享，不使用单个请求的 ctx，超时由 client 控制
+		m, err := p.discover()
+		p.mu.Lock()
+		p.loading = nil
+		if err != nil {
+			p.err, p.failedAt = err, time.Now()
+		} else {
+			p.err = nil
+			p.metadata = m
+			p.validator = &jwt.Validator{
+				KeySet:         jwt.NewKeySet(m.JwksURI, 0, p.client.Timeout),
+				Algorithms:     jwt.AsymmetricAlgorithms,
+				Issuers:        []string{m.Issuer},
+				Audiences:      []string{p.clientID},
+				RequiredClaims: []string{"sub", "exp"},
+				ClockSkew:      time.Minute,
+			}
+		}
+		v := p.validator
+		p.mu.Unlock()
+		close(loading)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, v, nil
+	}
+}
+
+func (p *provider) discover() (*metadata, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery of %s returns status code %d", p.issuer, resp.StatusCode)
+	}
+	m := &metadata{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(m); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc discovery issuer %s does not match %s", m.Issuer, p.issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JwksURI == "" {
+		return nil, fmt.Errorf("oidc discovery of %s is missing required endpoints", p.issuer)
+	}
+	return m, nil
+}
+
+// token 向 token 端点发起授权码或刷新请求
+func (p *provider) token(ctx context.Context, form url.Values) (*tokenResponse, error) {
+	m, _, err := p.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form.Set("client_id", p.clientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	t := &tokenResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(t); err != nil {
+		return nil, fmt.Errorf("decode token response error:%s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || t.Error != "" {
+		return nil, fmt.Errorf("token endpoint returns status code %d,error:%s %s", resp.StatusCode, t.Error, t.ErrorDesc)
+	}
+	return t, nil
+}
@@ -0,0 +1,163 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 单个 cookie 值的最大长度，超过后拆分为 name、name_1、name_2...
+const cookieChunkSize = 3800
+
+type session struct {
+	Claims       map[string]interface{} `json:"c"`
+	IDToken      string                 `json:"it,omitempty"`
+	AccessToken  string                 `json:"at,omitempty"`
+	RefreshToken string                 `json:"rt,omitempty"`
+	// Expiry access token 的过期时间，Created 会话创建时间，都是 unix 秒
+	Expiry  int64 `json:"exp,omitempty"`
+	Created int64 `json:"iat"`
+}
+
+// loginState 登录跳转前保存的状态，回调时校验
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Redirect string `json:"r"`
+}
+
+// cookieCodec 用 AES-GCM 加密 cookie，cookie 名作为附加数据，防止不同 cookie 之间互换
+type cookieCodec struct {
+	aead   cipher.AEAD
+	secure bool
+}
+
+func newCookieCodec(secret string, secure bool) (*cookieCodec, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCodec{aead: aead, secure: secure}, nil
+}
+
+func (c *cookieCodec) encode(name string, v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plain, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *cookieCodec) decode(name, value string, v interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return errors.New("cookie is too short")
+	}
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// read 读取并合并拆分的 cookie
+func (c *cookieCodec) read(req *http.Request, name string, v interface{}) error {
+	first, err := req.Cookie(name)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString(first.Value)
+	for i := 1; ; i++ {
+		ck, err := req.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		sb.WriteString(ck.Value)
+	}
+	return c.decode(name, sb.String(), v)
+}
+
+// write 写入 cookie，并删除请求中多余的旧分片
+func (c *cookieCodec) write(h http.Header, req *http.Request, name string, v interface{}, maxAge time.Duration) error {
+	value, err := c.encode(name, v)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for ; len(value) > 0; i++ {
+		n := cookieChunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		c.set(h, chunkName(name, i), value[:n], int(maxAge/time.Second))
+		value = value[n:]
+	}
+	c.expireChunks(h, req, name, i)
+	return nil
+}
+
+// clear 删除 cookie 及其全部分片
+func (c *cookieCodec) clear(h http.Header, req *http.Request, name string) {
+	c.expireChunks(h, req, name, 0)
+}
+
+func (c *cookieCodec) expireChunks(h http.Header, req *http.Request, name string, from int) {
+	for i := from; ; i++ {
+		if _, err := req.Cookie(chunkName(name, i)); err != nil {
+			return
+		}
+		c.set(h, chunkName(name, i), "", -1)
+	}
+}
+
+func (c *cookieCodec) set(h http.Header, name, value string, maxAge int) {
+	ck := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	h.Add("Set-Cookie", ck.String())
+}
+
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(i)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,231 @@
+package ratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"mini-gateway/clientip"
+	"mini-gateway/config"
+	"mini-gateway/middleware"
+	"mini-gateway/reqcontext"
+	"mini-gateway/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const NAME = "rateLimit"
+
+const (
+	AlgorithmTokenBucket   = "tokenBucket"
+	AlgorithmSlidingWindow = "slidingWindow"
+)
+
+func init() {
+	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"algorithm":     config.ArgString,
+		"rate":          config.ArgInt,
+		"period":        config.ArgInt,
+		"burst":         config.ArgInt,
+		"keyBy":         config.ArgString,
+		"prefix":        config.ArgString,
+		"scope":         config.ArgString,
+		"headers":       config.ArgBool,
+		"store":         config.ArgString,
+		"redisAddr":     config.ArgString,
+		"redisPassword": config.ArgString,
+		"redisDB":       config.ArgInt,
+	})
+}
+
+// Factory 限流中间件
+//
+//	keyBy: ip | consumer | header:<name> | claim:<name> | param:<name>，取不到值时按 ip 限流
+//	consumer 需要放在 apiKey、basicAuth 等鉴权中间件之后
+func Factory(c *config.Middleware) middleware.Middleware {
+	algorithm := AlgorithmTokenBucket
+	rate := int64(100)
+	period := time.Second
+	burst := int64(0)
+	keyBy := "ip"
+	prefix := "mini-gateway:ratelimit"
+	scope := "route"
+	headers := true
+	var store Store
+
+	if v, ok := c.Args["algorithm"]; ok {
+		algorithm = v.(string)
+	}
+	if v, ok := c.Args["rate"]; ok {
+		rate = int64(v.(int))
+	}
+	if v, ok := c.Args["period"]; ok {
+		period = time.Duration(v.(int)) * time.Millisecond
+	}
+	if v, ok := c.Args["burst"]; ok {
+		burst = int64(v.(int))
+	}
+	if v, ok := c.Args["keyBy"]; ok {
+		keyBy = v.(string)
+	}
+	if v, ok := c.Args["prefix"]; ok {
+		prefix = v.(string)
+	}
+	if v, ok := c.Args["scope"]; ok {
+		scope = v.(string)
+	}
+	if v, ok := c.Args["headers"]; ok {
+		headers = v.(bool)
+	}
+	if v, ok := c.Args["store"]; ok && v.(string) == "redis" {
+		addr := "127.0.0.1:6379"
+		password := ""
+		db := 0
+		if v, ok := c.Args["redisAddr"]; ok {
+			addr = v.(string)
+		}
+		if v, ok := c.Args["redisPassword"]; ok {
+			password = v.(string)
+		}
+		if v, ok := c.Args["redisDB"]; ok {
+			db = v.(int)
+		}
+		store = SharedRedisStore(addr, password, db)
+	} else {
+		store = MemoryStore()
+	}
+
+	if rate <= 0 {
+		slog.Warn("rate limit rate %d is invalid,100 is used by default", rate)
+		rate = 100
+	}
+	if period <= 0 {
+		period = time.Second
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	if algorithm != AlgorithmTokenBucket && algorithm != AlgorithmSlidingWindow {
+		slog.Warn("unknown rate limit algorithm %s,%s is used by default", algorithm, AlgorithmTokenBucket)
+		algorithm = AlgorithmTokenBucket
+	}
+
+	// 不同参数的限流中间件使用不同的计数，避免全局和端点的限流共享同一个桶
+	fingerprint := fmt.Sprintf("%s:%d:%d:%d", algorithm, rate, period.Milliseconds(), burst)
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &rateLimit{
+			algorithm:   algorithm,
+			fingerprint: fingerprint,
+			rate:        rate,
+			period:      period,
+			burst:       burst,
+			keyBy:       keyBy,
+			prefix:      prefix,
+			scope:       scope,
+			headers:     headers,
+			store:       store,
+			next:        next,
+		}
+	}
+}
+
+type rateLimit struct {
+	algorithm   string
+	fingerprint string
+	rate        int64
+	period      time.Duration
+	burst       int64
+	keyBy       string
+	prefix      string
+	scope       string
+	headers     bool
+	store       Store
+	next        http.RoundTripper
+}
+
+func (l *rateLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := l.key(req)
+	var (
+		r   *Result
+		err error
+	)
+	if l.algorithm == AlgorithmSlidingWindow {
+		r, err = l.store.SlidingWindow(req.Context(), key, l.rate, l.period)
+	} else {
+		r, err = l.store.TokenBucket(req.Context(), key, l.rate, l.burst, l.period)
+	}
+	if err != nil {
+		// 存储不可用时放行，避免限流组件故障导致整体不可用
+		slog.Error("rate limit store error:%s", err.Error())
+		return l.next.RoundTrip(req)
+	}
+
+	if !r.Allowed {
+		header := http.Header{}
+		l.setHeaders(header, r)
+		header.Set("Retry-After", strconv.FormatInt(ceilSeconds(r.RetryAfter), 10))
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		body := http.StatusText(http.StatusTooManyRequests)
+		return &http.Response{
+			StatusCode:    http.StatusTooManyRequests,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+			ContentLength: int64(len(body)),
+		}, nil
+	}
+
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if l.headers && resp.Header != nil {
+		l.setHeaders(resp.Header, r)
+	}
+	return resp, nil
+}
+
+func (l *rateLimit) setHeaders(h http.Header, r *Result) {
+	h.Set("RateLimit-Limit", strconv.FormatInt(r.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(r.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(r.Reset), 10))
+}
+
+func (l *rateLimit) key(req *http.Request) string {
+	scope := "global"
+	if l.scope != "global" {
+		if endpoint, ok := reqcontext.Endpoint(req.Context()); ok && endpoint != nil {
+			scope = endpoint.ID
+		}
+	}
+	value := ""
+	kind, name, _ := strings.Cut(l.keyBy, ":")
+	switch kind {
+	case "header":
+		value = req.Header.Get(name)
+	case "claim":
+		if claims, ok := reqcontext.Claims(req.Context()); ok {
+			if v, ok := claims[name]; ok && v != nil {
+				value = fmt.Sprint(v)
+			}
+		}
+	case "param":
+		if params, ok := reqcontext.Params(req.Context()); ok {
+			value = params[name]
+		}
+	case "consumer":
+		value, _ = reqcontext.Consumer(req.Context())
+	}
+	if value == "" {
+		kind = "ip"
+		value = clientip.Get(req)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s:%s", l.prefix, scope, l.fingerprint, kind, value)
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
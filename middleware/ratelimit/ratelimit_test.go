@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"mini-gateway/config"
+	"net/http"
+	"testing"
+)
+
+type okTripper struct{}
+
+func (okTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func newLimiter(args map[string]interface{}) http.RoundTripper {
+	return Factory(&config.Middleware{Name: NAME, Args: args})(okTripper{})
+}
+
+func status(t *testing.T, rt http.RoundTripper) int {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// 两个参数不同的限流中间件叠加时各自计数
+func TestStackedLimitersUseSeparateBuckets(t *testing.T) {
+	perSecond := newLimiter(map[string]interface{}{"rate": 2, "period": 1000, "scope": "global", "prefix": t.Name()})
+	perMinute := newLimiter(map[string]interface{}{"rate": 5, "period": 60000, "scope": "global", "prefix": t.Name()})
+
+	for i := 0; i < 2; i++ {
+		if code := status(t, perSecond); code != http.StatusOK {
+			t.Fatalf("per second request %d got %d", i, code)
+		}
+	}
+	if code := status(t, perSecond); code != http.StatusTooManyRequests {
+		t.Fatalf("per second limiter expected 429,got %d", code)
+	}
+	for i := 0; i < 5; i++ {
+		if code := status(t, perMinute); code != http.StatusOK {
+			t.Fatalf("per minute request %d got %d", i, code)
+		}
+	}
+	if code := status(t, perMinute); code != http.StatusTooManyRequests {
+		t.Fatalf("per minute limiter expected 429,got %d", code)
+	}
+}
+
+// 相同参数的限流中间件重新创建后继续使用原来的计数
+func TestRebuiltLimiterKeepsBucket(t *testing.T) {
+	args := map[string]interface{}{"rate": 1, "period": 60000, "scope": "global", "prefix": t.Name()}
+	if code := status(t, newLimiter(args)); code != http.StatusOK {
+		t.Fatalf("expected 200,got %d", code)
+	}
+	if code := status(t, newLimiter(args)); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after rebuild,got %d", code)
+	}
+}
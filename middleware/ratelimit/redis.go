@@ -0,0 +1,288 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucketScript 在 redis 中原子地完成令牌桶的补充和扣减，使用 redis 服务器时间避免多实例时钟偏差
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local per = period / rate
+local v = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(v[1])
+local last = tonumber(v[2])
+if tokens == nil then
+  tokens = burst
+  last = now
+end
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) / per)
+  last = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+local reset = math.ceil((burst - tokens) * per)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(last))
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(reset / 1000)))
+local retry = 0
+if allowed == 0 then
+  retry = math.ceil((1 - tokens) * per)
+end
+return {allowed, math.floor(tokens), reset, retry}
+`
+
+// redisStores 相同地址、密码和库共享一个存储，配置重载时不重复创建连接池
+var redisStores sync.Map
+
+// SharedRedisStore 返回进程内共享的 redis 存储
+func SharedRedisStore(addr, password string, db int) Store {
+	key := addr + "\x00" + password + "\x00" + strconv.Itoa(db)
+	if s, ok := redisStores.Load(key); ok {
+		return s.(Store)
+	}
+	s, _ := redisStores.LoadOrStore(key, NewRedisStore(addr, password, db))
+	return s.(Store)
+}
+
+// NewRedisStore 创建基于 redis 协议的存储，兼容 redis 协议的服务都可以使用
+func NewRedisStore(addr, password string, db int) Store {
+	return &redisStore{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  time.Second,
+		idle:     make(chan *redisConn, 16),
+	}
+}
+
+type redisStore struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+func (s *redisStore) TokenBucket(ctx context.Context, key string, rate, burst int64, period time.Duration) (*Result, error) {
+	replies, err := s.do(ctx, []string{"EVAL", tokenBucketScript, "1", key,
+		strconv.FormatInt(rate, 10), strconv.FormatInt(burst, 10), strconv.FormatInt(period.Microseconds(), 10)})
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := replies[0].([]any)
+	if !ok || len(vs) != 4 {
+		return nil, fmt.Errorf("unexpected redis reply %v", replies[0])
+	}
+	ints := make([]int64, 4)
+	for i, v := range vs {
+		if ints[i], ok = v.(int64); !ok {
+			return nil, fmt.Errorf("unexpected redis reply %v", replies[0])
+		}
+	}
+	return &Result{
+		Allowed:    ints[0] == 1,
+		Limit:      burst,
+		Remaining:  ints[1],
+		Reset:      time.Duration(ints[2]) * time.Microsecond,
+		RetryAfter: time.Duration(ints[3]) * time.Microsecond,
+	}, nil
+}
+
+// SlidingWindow 每个固定窗口一个计数器，只使用 INCR、PEXPIRE、GET 命令
+func (s *redisStore) SlidingWindow(ctx context.Context, key string, limit int64, size time.Duration) (*Result, error) {
+	now := time.Now()
+	start := now.Truncate(size)
+	index := start.UnixNano() / int64(size)
+	curr := key + ":" + strconv.FormatInt(index, 10)
+	prev := key + ":" + strconv.FormatInt(index-1, 10)
+
+	replies, err := s.do(ctx,
+		[]string{"INCR", curr},
+		[]string{"PEXPIRE", curr, strconv.FormatInt((2 * size).Milliseconds(), 10)},
+		[]string{"GET", prev},
+	)
+	if err != nil {
+		return nil, err
+	}
+	currCount, ok := replies[0].(int64)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply %v", replies[0])
+	}
+	var prevCount int64
+	if v, ok := replies[2].(string); ok {
+		prevCount, _ = strconv.ParseInt(v, 10, 64)
+	}
+	// 计数已包含本次请求
+	return slidingWindowResult(prevCount, currCount-1, limit, now.Sub(start), size), nil
+}
+
+// do 以 pipeline 方式执行命令
+func (s *redisStore) do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.conn.SetDeadline(deadline)
+
+	replies, err := c.do(cmds...)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	for _, r := range replies {
+		if e, ok := r.(redisError); ok {
+			return nil, e
+		}
+	}
+	return replies, nil
+}
+
+func (s *redisStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	cmds := make([][]string, 0, 2)
+	if s.password != "" {
+		cmds = append(cmds, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(cmds) > 0 {
+		replies, err := c.do(cmds...)
+		if err == nil {
+			for _, r := range replies {
+				if e, ok := r.(redisError); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *redisStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	mux  sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func (c *redisConn) do(cmds ...[]string) ([]any, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		r, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// read 读取一个 RESP 回复，nil 回复返回 nil
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: invalid reply")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		vs := make([]any, n)
+		for i := range vs {
+			if vs[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
@@ -0,0 +1,260 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 实现限流用到的 redis 命令，EVAL 只支持令牌桶脚本，按脚本的逻辑在 Go 中计算
+type fakeRedis struct {
+	t        *testing.T
+	ln       net.Listener
+	password string
+
+	mux     sync.Mutex
+	now     time.Time
+	strings map[string]string
+	hashes  map[string]map[string]string
+	dials   int
+	auths   int
+	selects []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		t:        t,
+		ln:       ln,
+		password: password,
+		now:      time.Unix(1700000000, 0),
+		strings:  make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+	}
+	go r.serve()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.ln.Addr().String()
+}
+
+func (r *fakeRedis) advance(d time.Duration) {
+	r.mux.Lock()
+	r.now = r.now.Add(d)
+	r.mux.Unlock()
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.mux.Lock()
+		r.dials++
+		r.mux.Unlock()
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		cmd, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(cmd[0])
+		if !authed && name != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		r.mux.Lock()
+		reply := r.exec(name, cmd[1:], &authed)
+		r.mux.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func (r *fakeRedis) exec(name string, args []string, authed *bool) string {
+	switch name {
+	case "AUTH":
+		r.auths++
+		if args[0] != r.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case "SELECT":
+		r.selects = append(r.selects, args[0])
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.ParseInt(r.strings[args[0]], 10, 64)
+		n++
+		r.strings[args[0]] = strconv.FormatInt(n, 10)
+		return fmt.Sprintf(":%d\r\n", n)
+	case "PEXPIRE":
+		return ":1\r\n"
+	case "GET":
+		v, ok := r.strings[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "EVAL":
+		if args[0] != tokenBucketScript {
+			return "-ERR unknown script\r\n"
+		}
+		return r.tokenBucket(args[2], args[3:])
+	}
+	return "-ERR unknown command '" + name + "'\r\n"
+}
+
+// tokenBucket 与 tokenBucketScript 相同的计算
+func (r *fakeRedis) tokenBucket(key string, argv []string) string {
+	rate, _ := strconv.ParseFloat(argv[0], 64)
+	burst, _ := strconv.ParseFloat(argv[1], 64)
+	period, _ := strconv.ParseFloat(argv[2], 64)
+	now := float64(r.now.UnixMicro())
+	per := period / rate
+	h, ok := r.hashes[key]
+	tokens, last := burst, now
+	if ok {
+		tokens, _ = strconv.ParseFloat(h["tokens"], 64)
+		last, _ = strconv.ParseFloat(h["last"], 64)
+	}
+	if now > last {
+		tokens = math.Min(burst, tokens+(now-last)/per)
+		last = now
+	}
+	allowed := 0
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	}
+	reset := math.Ceil((burst - tokens) * per)
+	r.hashes[key] = map[string]string{
+		"tokens": strconv.FormatFloat(tokens, 'f', -1, 64),
+		"last":   strconv.FormatFloat(last, 'f', -1, 64),
+	}
+	retry := 0.0
+	if allowed == 0 {
+		retry = math.Ceil((1 - tokens) * per)
+	}
+	return fmt.Sprintf("*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n", allowed, int64(math.Floor(tokens)), int64(reset), int64(retry))
+}
+
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:size])
+	}
+	return cmd, nil
+}
+
+func TestRedisStoreTokenBucket(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	s := NewRedisStore(fake.addr(), "secret", 2)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		r, err := s.TokenBucket(ctx, "k", 1, 3, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Allowed || r.Remaining != int64(2-i) || r.Limit != 3 {
+			t.Fatalf("request %d got %+v", i, r)
+		}
+	}
+	r, err := s.TokenBucket(ctx, "k", 1, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Allowed || r.RetryAfter != time.Second {
+		t.Fatalf("expected rejection with 1s retry,got %+v", r)
+	}
+	fake.advance(time.Second)
+	if r, _ = s.TokenBucket(ctx, "k", 1, 3, time.Second); !r.Allowed {
+		t.Fatalf("expected a refilled token,got %+v", r)
+	}
+
+	fake.mux.Lock()
+	defer fake.mux.Unlock()
+	// 连接被复用，只认证和选择一次库
+	if fake.dials != 1 || fake.auths != 1 || len(fake.selects) != 1 || fake.selects[0] != "2" {
+		t.Fatalf("dials %d auths %d selects %v", fake.dials, fake.auths, fake.selects)
+	}
+}
+
+func TestRedisStoreSlidingWindow(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	s := NewRedisStore(fake.addr(), "", 0)
+	ctx := context.Background()
+	// 窗口足够大，测试期间不会跨窗口
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		r, err := s.SlidingWindow(ctx, "w", 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected 3 allowed requests,got %d", allowed)
+	}
+}
+
+func TestRedisStoreError(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	s := NewRedisStore(fake.addr(), "wrong", 0)
+	if _, err := s.TokenBucket(context.Background(), "k", 1, 1, time.Second); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected auth error,got %v", err)
+	}
+}
+
+func TestSharedRedisStore(t *testing.T) {
+	a := SharedRedisStore("127.0.0.1:1", "", 0)
+	if b := SharedRedisStore("127.0.0.1:1", "", 0); a != b {
+		t.Fatal("expected the same store for the same address")
+	}
+	if c := SharedRedisStore("127.0.0.1:1", "", 1); a == c {
+		t.Fatal("expected a different store for a different db")
+	}
+}
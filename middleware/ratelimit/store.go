@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Result 一次限流判断的结果
+type Result struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// Reset 配额完全恢复需要的时间
+	Reset time.Duration
+	// RetryAfter 被拒绝时距离下次可以请求的时间
+	RetryAfter time.Duration
+}
+
+// Store 限流计数存储，多个网关实例共享同一个 Store 即可共享限流配额
+type Store interface {
+	// TokenBucket 令牌桶，每 period 生成 rate 个令牌，桶容量为 burst
+	TokenBucket(ctx context.Context, key string, rate, burst int64, period time.Duration) (*Result, error)
+	// SlidingWindow 滑动窗口，window 时间内最多 limit 次请求
+	SlidingWindow(ctx context.Context, key string, limit int64, window time.Duration) (*Result, error)
+}
+
+var (
+	defaultMemoryStore     *memoryStore
+	defaultMemoryStoreOnce sync.Once
+)
+
+// MemoryStore 返回进程内共享的内存存储
+func MemoryStore() Store {
+	defaultMemoryStoreOnce.Do(func() {
+		defaultMemoryStore = newMemoryStore(time.Minute)
+	})
+	return defaultMemoryStore
+}
+
+func newMemoryStore(gcInterval time.Duration) *memoryStore {
+	s := &memoryStore{
+		buckets: make(map[string]*bucket),
+		windows: make(map[string]*window),
+		now:     time.Now,
+	}
+	go s.gc(gcInterval)
+	return s
+}
+
+type memoryStore struct {
+	mux     sync.Mutex
+	buckets map[string]*bucket
+	windows map[string]*window
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	expires time.Time
+}
+
+type window struct {
+	start   time.Time
+	prev    int64
+	curr    int64
+	expires time.Time
+}
+
+func (s *memoryStore) TokenBucket(_ context.Context, key string, rate, burst int64, period time.Duration) (*Result, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := s.now()
+	perToken := period / time.Duration(rate)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	elapsed := now.Sub(b.last)
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+float64(elapsed)/float64(perToken))
+		b.last = now
+	}
+
+	r := &Result{Limit: burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	r.Remaining = int64(b.tokens)
+	r.Reset = time.Duration((float64(burst) - b.tokens) * float64(perToken))
+	b.expires = now.Add(r.Reset)
+	return r, nil
+}
+
+func (s *memoryStore) SlidingWindow(_ context.Context, key string, limit int64, size time.Duration) (*Result, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := s.now()
+	start := now.Truncate(size)
+	w, ok := s.windows[key]
+	if !ok {
+		w = &window{start: start}
+		s.windows[key] = w
+	}
+	switch {
+	case start.Equal(w.start):
+	case start.Sub(w.start) == size:
+		w.prev, w.curr, w.start = w.curr, 0, start
+	default:
+		w.prev, w.curr, w.start = 0, 0, start
+	}
+	w.expires = start.Add(2 * size)
+
+	r := slidingWindowResult(w.prev, w.curr, limit, now.Sub(start), size)
+	if r.Allowed {
+		w.curr++
+	}
+	return r, nil
+}
+
+// slidingWindowResult 用上一个窗口按时间比例加权估算当前滑动窗口内的请求数
+func slidingWindowResult(prev, curr, limit int64, elapsed, size time.Duration) *Result {
+	weight := 1 - float64(elapsed)/float64(size)
+	count := float64(prev)*weight + float64(curr)
+	r := &Result{Limit: limit, Reset: size - elapsed}
+	if count+1 <= float64(limit) {
+		r.Allowed = true
+		count++
+	} else if prev > 0 {
+		// 上一个窗口的权重衰减到可以放行一次请求需要的时间
+		need := (count + 1 - float64(limit)) / float64(prev)
+		r.RetryAfter = time.Duration(need * float64(size))
+		if r.RetryAfter > r.Reset {
+			r.RetryAfter = r.Reset
+		}
+	} else {
+		r.RetryAfter = r.Reset
+	}
+	r.Remaining = int64(math.Max(0, float64(limit)-count))
+	return r
+}
+
+// gc 定期清理已过期的计数
+func (s *memoryStore) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mux.Lock()
+		now := s.now()
+		for k, b := range s.buckets {
+			if now.After(b.expires) {
+				delete(s.buckets, k)
+			}
+		}
+		for k, w := range s.windows {
+			if now.After(w.expires) {
+				delete(s.windows, k)
+			}
+		}
+		s.mux.Unlock()
+	}
+}
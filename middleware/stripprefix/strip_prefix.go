@@ -11,6 +11,9 @@ const NAME = "stripPrefix"
 
 func init() {
 	middleware.Register(NAME, Factory)
+	config.RegisterArgs(NAME, map[string]config.ArgKind{
+		"call": config.ArgInt,
+	})
 }
 
 func Factory(c *config.Middleware) middleware.Middleware {
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mini-gateway/config"
+	"net/http"
+	"strings"
+)
+
+// 默认最多缓存 4MB 请求体用于重放
+const defaultMaxBufferSize = 4 << 20
+
+// needReplay 端点是否需要重放请求体，重试和流量镜像都需要
+func needReplay(endpoint *config.Endpoint) bool {
+	return endpoint.Retry != nil && endpoint.Retry.Attempts != 1 || endpoint.Mirror != nil
+}
+
+// grpcStream 长度未知的 grpc 请求体可能是客户端流，缓存会一直等到客户端结束发送
+func grpcStream(req *http.Request) bool {
+	if req.ContentLength != -1 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "application/grpc")
+}
+
+func maxBufferSize(endpoint *config.Endpoint) int64 {
+	if endpoint.MaxBufferSize > 0 {
+		return endpoint.MaxBufferSize
+	}
+	return defaultMaxBufferSize
+}
+
+// bufferBody 缓存请求体并设置 GetBody 以便重放，请求体超过 limit 时退化为流式转发且不可重放
+func bufferBody(req *http.Request, limit int64) error {
+	if req.ContentLength > limit {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		req.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+			closer: req.Body,
+		}
+		return nil
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	// 分块上传的请求体已完整读取，改为按长度转发
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	return nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *multiReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// shouldFlush 流式响应需要每次写入后立即刷新，比如 SSE、分块传输和 grpc 流
+func shouldFlush(res *http.Response) bool {
+	if res.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || strings.HasPrefix(mediaType, "application/grpc")
+}
+
+func copyResponse(rw http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(rw, body)
+		return err
+	}
+	rc := http.NewResponseController(rw)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
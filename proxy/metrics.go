@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mini-gateway/config"
+	"mini-gateway/metrics"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// instrument 记录端点的请求数、耗时、并发数及请求响应大小
+func instrument(endpoint *config.Endpoint, next http.Handler) http.Handler {
+	inFlight := metrics.RequestsInFlight.WithLabelValues(endpoint.ID)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		inFlight.Inc()
+		rw := &responseRecorder{ResponseWriter: w}
+		var body *countingBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer func() {
+			inFlight.Dec()
+			code := metrics.CodeClass(rw.status)
+			if rw.status == 0 {
+				code = metrics.CodeClass(http.StatusOK)
+			}
+			metrics.Requests.WithLabelValues(endpoint.ID, req.Method, code).Inc()
+			metrics.RequestDuration.WithLabelValues(endpoint.ID, req.Method, code).Observe(time.Since(start).Seconds())
+			reqSize := req.ContentLength
+			if body != nil && reqSize < 0 {
+				reqSize = body.n.Load()
+			}
+			if reqSize < 0 {
+				reqSize = 0
+			}
+			metrics.RequestSize.WithLabelValues(endpoint.ID, req.Method).Observe(float64(reqSize))
+			metrics.ResponseSize.WithLabelValues(endpoint.ID, req.Method, code).Observe(float64(rw.written))
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// responseRecorder 记录响应状态码和写入字节数
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	// 1xx 信息响应之后还会有最终响应
+	if r.status == 0 && code >= 200 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
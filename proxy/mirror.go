@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"mini-gateway/config"
+	"mini-gateway/metrics"
+	"mini-gateway/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// 镜像请求默认的超时时间
+	defaultMirrorTimeout = 5 * time.Second
+	// 每个端点同时进行的镜像请求数上限，超过时丢弃，避免上游变慢时占用过多资源
+	maxConcurrentMirrors = 1024
+)
+
+// newMirror 发给 next 的请求按比例复制一份异步发送到镜像
+func newMirror(ctx context.Context, p *Proxy, endpoint *config.Endpoint, next http.RoundTripper) (*mirror, error) {
+	c := endpoint.Mirror
+	m := &mirror{
+		next:       next,
+		endpointID: endpoint.ID,
+		target:     c.Endpoint,
+		percentage: 100,
+		timeout:    defaultMirrorTimeout,
+		sem:        make(chan struct{}, maxConcurrentMirrors),
+		lookup:     p.upstream,
+	}
+	if c.Percentage != nil {
+		m.percentage = *c.Percentage
+	}
+	if c.Timeout > 0 {
+		m.timeout = time.Duration(c.Timeout) * time.Millisecond
+	}
+	if len(c.Targets) > 0 {
+		tripper, err := p.factory(ctx, &config.Endpoint{
+			ID:          endpoint.ID + "-mirror",
+			Targets:     c.Targets,
+			Protocol:    endpoint.Protocol,
+			LoadBalance: endpoint.LoadBalance,
+			TLS:         endpoint.TLS,
+			Transport:   endpoint.Transport,
+		})
+		if err != nil {
+			return nil, err
+		}
+		m.tripper = tripper
+	}
+	return m, nil
+}
+
+type mirror struct {
+	next       http.RoundTripper
+	endpointID string
+	// target 镜像到的端点 id，为空时使用 tripper
+	target     string
+	tripper    http.RoundTripper
+	percentage float64
+	timeout    time.Duration
+	sem        chan struct{}
+	lookup     func(id string) (http.RoundTripper, bool)
+}
+
+func (m *mirror) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 协议升级的请求不镜像
+	if req.Header.Get("Upgrade") == "" {
+		m.send(req)
+	}
+	return m.next.RoundTrip(req)
+}
+
+// send 复制请求后异步发送，必须在原请求发出前调用，原请求发送时会修改 URL
+func (m *mirror) send(req *http.Request) {
+	if m.percentage < 100 && rand.Float64()*100 >= m.percentage {
+		return
+	}
+	result := func(r string) {
+		metrics.MirrorRequests.WithLabelValues(m.endpointID, r).Inc()
+	}
+	// 请求体超过缓存大小时无法复制
+	if req.Body != nil && req.GetBody == nil {
+		result("skipped")
+		return
+	}
+	tripper := m.tripper
+	if m.target != "" {
+		t, ok := m.lookup(m.target)
+		if !ok {
+			result("error")
+			slog.Warn("mirror endpoint %s not found,id:%s", m.target, m.endpointID)
+			return
+		}
+		tripper = t
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		result("dropped")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(detachedContext{req.Context()}, m.timeout)
+	mreq := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			<-m.sem
+			result("error")
+			return
+		}
+		mreq.Body = body
+	}
+	go func() {
+		defer func() {
+			cancel()
+			<-m.sem
+		}()
+		start := time.Now()
+		resp, err := tripper.RoundTrip(mreq)
+		metrics.MirrorDuration.WithLabelValues(m.endpointID).Observe(time.Since(start).Seconds())
+		if err != nil {
+			result("error")
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result(metrics.CodeClass(resp.StatusCode))
+	}()
+}
+
+// detachedContext 保留请求上下文中的值，但不随原请求结束而取消
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
@@ -1,14 +1,15 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/net/http/httpguts"
 	"io"
 	"mini-gateway/client"
+	"mini-gateway/clientip"
 	"mini-gateway/config"
+	"mini-gateway/metrics"
 	"mini-gateway/middleware"
 	"mini-gateway/reqcontext"
 	"mini-gateway/router"
@@ -19,8 +20,10 @@ import (
 	"net/http/httptrace"
 	"net/textproto"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,13 +38,17 @@ type Proxy struct {
 	router    router.Router
 	factory   client.Factory
 	mux       sync.Mutex
+	globalMs  []*config.Middleware
 	routeInfo map[string]*routeInfo
+	// upstreams 端点 id 到不含中间件的上游客户端，供流量镜像使用
+	upstreams atomic.Pointer[map[string]http.RoundTripper]
 }
 
 type routeInfo struct {
 	cancelCtx context.CancelFunc
 	route     *route.Route
 	endpoint  *config.Endpoint
+	upstream  http.RoundTripper
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -53,7 +60,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			slog.Error("%s", buf[:n])
 		}
 	}()
-	p.router.ServeHTTP(w, r)
+	ctx := reqcontext.WithClientIP(r.Context(), clientip.DefaultTrusted().ClientIP(r))
+	p.router.ServeHTTP(w, r.WithContext(ctx))
 }
 
 // UpdateEndpoints 重新生成所有端点，全局的中间件有更新必须调用此方法重新生成端点否则不生效。
@@ -62,31 +70,51 @@ func (p *Proxy) UpdateEndpoints(globalMs []*config.Middleware, es []*config.Endp
 	defer p.mux.Unlock()
 	rs := make([]*route.Route, 0)
 	ris := make(map[string]*routeInfo)
+	// 失败时取消已经生成的端点，停止其健康检查、服务发现等协程
+	defer func() {
+		if err != nil {
+			for _, info := range ris {
+				info.cancelCtx()
+			}
+		}
+	}()
 	for _, e := range es {
 		if _, ok := ris[e.ID]; ok {
 			return errors.New(fmt.Sprintf("endpoint id cannot be the same,id:%s", e.ID))
 		}
 		ctx, cancel := context.WithCancel(context.Background())
-		handler, err := p.buildEndpoints(ctx, globalMs, e)
+		handler, upstream, err := p.buildEndpoints(ctx, globalMs, e)
+		if err != nil {
+			cancel()
+			return err
+		}
+		r, err := route.NewRoute(e.ID, e.Priority, e.Predicates, handler)
 		if err != nil {
 			cancel()
 			return err
 		}
-		r := route.NewRoute(e.Predicates, handler)
 		ris[e.ID] = &routeInfo{
 			route:     r,
 			endpoint:  e,
 			cancelCtx: cancel,
+			upstream:  upstream,
 		}
 		rs = append(rs, r)
 	}
-	p.router.RegisterOrUpdateRoutes(rs)
+	if err := p.router.RegisterOrUpdateRoutes(rs); err != nil {
+		return err
+	}
 	// 通知所有ctx取消
-	for _, info := range p.routeInfo {
+	for id, info := range p.routeInfo {
 		info.cancelCtx()
+		if _, ok := ris[id]; !ok {
+			metrics.DeleteEndpoint(id)
+		}
 	}
 	// 替换
 	p.routeInfo = ris
+	p.globalMs = globalMs
+	p.refreshUpstreams()
 	return nil
 }
 
@@ -95,25 +123,41 @@ func (p *Proxy) UpdateEndpoint(globalMs []*config.Middleware, e *config.Endpoint
 	p.mux.Lock()
 	defer p.mux.Unlock()
 	ctx, cancel := context.WithCancel(context.Background())
-	handler, err := p.buildEndpoints(ctx, globalMs, e)
+	handler, upstream, err := p.buildEndpoints(ctx, globalMs, e)
 	if err != nil {
 		cancel()
 		return err
 	}
-	r := route.NewRoute(e.Predicates, handler)
-	rs := make([]*route.Route, 0)
-	for _, r := range p.routeInfo {
-		rs = append(rs, r.route)
+	r, err := route.NewRoute(e.ID, e.Priority, e.Predicates, handler)
+	if err != nil {
+		cancel()
+		return err
+	}
+	rs := []*route.Route{r}
+	for id, info := range p.routeInfo {
+		if id != e.ID {
+			rs = append(rs, info.route)
+		}
+	}
+	if err := p.router.RegisterOrUpdateRoutes(rs); err != nil {
+		cancel()
+		return err
 	}
-	p.router.RegisterOrUpdateRoutes(rs)
 	// 通知被替换的路由ctx取消
-	p.routeInfo[e.ID].cancelCtx()
+	if info, ok := p.routeInfo[e.ID]; ok {
+		info.cancelCtx()
+	}
+	if p.routeInfo == nil {
+		p.routeInfo = make(map[string]*routeInfo)
+	}
 	// 替换
 	p.routeInfo[e.ID] = &routeInfo{
 		cancelCtx: cancel,
 		route:     r,
 		endpoint:  e,
+		upstream:  upstream,
 	}
+	p.refreshUpstreams()
 	return nil
 }
 
@@ -127,29 +171,94 @@ func (p *Proxy) RemoveEndpoint(endpointID string) {
 	// 通知被删除的路由ctx取消
 	p.routeInfo[endpointID].cancelCtx()
 	delete(p.routeInfo, endpointID)
+	metrics.DeleteEndpoint(endpointID)
+	p.refreshUpstreams()
 	rs := make([]*route.Route, 0)
 	for _, r := range p.routeInfo {
 		rs = append(rs, r.route)
 	}
-	p.router.RegisterOrUpdateRoutes(rs)
+	// 删除路由不会产生新的冲突
+	if err := p.router.RegisterOrUpdateRoutes(rs); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// Endpoints 返回当前生效的端点配置，按 id 排序
+func (p *Proxy) Endpoints() []*config.Endpoint {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	es := make([]*config.Endpoint, 0, len(p.routeInfo))
+	for _, info := range p.routeInfo {
+		es = append(es, info.endpoint)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].ID < es[j].ID
+	})
+	return es
+}
+
+func (p *Proxy) Endpoint(endpointID string) (*config.Endpoint, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	info, ok := p.routeInfo[endpointID]
+	if !ok {
+		return nil, false
+	}
+	return info.endpoint, true
+}
+
+// Middlewares 返回当前生效的全局中间件配置
+func (p *Proxy) Middlewares() []*config.Middleware {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.globalMs
+}
+
+// refreshUpstreams 调用方需持有 p.mux
+func (p *Proxy) refreshUpstreams() {
+	upstreams := make(map[string]http.RoundTripper, len(p.routeInfo))
+	for id, info := range p.routeInfo {
+		upstreams[id] = info.upstream
+	}
+	p.upstreams.Store(&upstreams)
+}
+
+func (p *Proxy) upstream(endpointID string) (http.RoundTripper, bool) {
+	upstreams := p.upstreams.Load()
+	if upstreams == nil {
+		return nil, false
+	}
+	t, ok := (*upstreams)[endpointID]
+	return t, ok
 }
 
-func (p *Proxy) buildEndpoints(ctx context.Context, ms []*config.Middleware, endpoint *config.Endpoint) (http.Handler, error) {
+func (p *Proxy) buildEndpoints(ctx context.Context, ms []*config.Middleware, endpoint *config.Endpoint) (http.Handler, http.RoundTripper, error) {
 	factory, err := p.factory(ctx, endpoint)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	tripper, err := middleware.BuildMiddleware(endpoint.Middlewares, factory)
+	// 镜像经过中间件处理后的请求，与发给上游的请求一致
+	var upstream http.RoundTripper = factory
+	if endpoint.Mirror != nil {
+		m, err := newMirror(ctx, p, endpoint, factory)
+		if err != nil {
+			return nil, nil, err
+		}
+		upstream = m
+	}
+	tripper, err := middleware.BuildMiddleware(endpoint.Middlewares, upstream)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	tripper, err = middleware.BuildMiddleware(ms, tripper)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	replay := needReplay(endpoint)
+
 	// https://github.com/golang/go/blob/98617fd23fa799173c33741987d41ee64cbb2a4f/src/net/http/httputil/reverseproxy.go#L332
-	return http.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return instrument(endpoint, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		ctx := reqcontext.WithEndpoint(req.Context(), endpoint)
 		if endpoint.Timeout > 0 {
 			_ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(endpoint.Timeout))
@@ -194,20 +303,21 @@ func (p *Proxy) buildEndpoints(ctx context.Context, ms []*config.Middleware, end
 		}
 
 		if outReq.Body != nil {
-			body, err := io.ReadAll(outReq.Body)
-			if err != nil {
-				slog.Error(err.Error())
-				errorHandler(rw, req, err)
-				return
+			if endpoint.MaxBodySize > 0 {
+				if outReq.ContentLength > endpoint.MaxBodySize {
+					errorHandler(rw, req, &http.MaxBytesError{Limit: endpoint.MaxBodySize})
+					return
+				}
+				outReq.Body = http.MaxBytesReader(rw, outReq.Body, endpoint.MaxBodySize)
 			}
-
-			outReq.GetBody = func() (io.ReadCloser, error) {
-				reader := bytes.NewReader(body)
-				return io.NopCloser(reader), nil
+			// 只有需要重放请求体时才缓存，grpc 流式请求不缓存
+			if replay && !grpcStream(outReq) {
+				if err := bufferBody(outReq, maxBufferSize(endpoint)); err != nil {
+					slog.Error(err.Error())
+					errorHandler(rw, req, err)
+					return
+				}
 			}
-
-			reader := bytes.NewReader(body)
-			outReq.Body = io.NopCloser(reader)
 		}
 
 		trace := &httptrace.ClientTrace{
@@ -254,7 +364,7 @@ func (p *Proxy) buildEndpoints(ctx context.Context, ms []*config.Middleware, end
 		rw.WriteHeader(res.StatusCode)
 
 		if res.Body != nil {
-			_, err = io.Copy(rw, res.Body)
+			err = copyResponse(rw, res.Body, shouldFlush(res))
 			if err != nil {
 				defer res.Body.Close()
 				slog.Error(err.Error())
@@ -285,10 +395,18 @@ func (p *Proxy) buildEndpoints(ctx context.Context, ms []*config.Middleware, end
 			}
 		}
 
-	})), nil
+	})), factory, nil
 }
 
+// setXForwarded 直连地址是可信代理时保留其转发的头，否则丢弃客户端伪造的转发头
 func (p *Proxy) setXForwarded(req *http.Request) {
+	trusted := clientip.DefaultTrusted().IsTrusted(req)
+	if !trusted {
+		req.Header.Del("Forwarded")
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Proto")
+	}
 	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err == nil {
 		prior := req.Header["X-Forwarded-For"]
@@ -299,11 +417,15 @@ func (p *Proxy) setXForwarded(req *http.Request) {
 	} else {
 		req.Header.Del("X-Forwarded-For")
 	}
-	req.Header.Set("X-Forwarded-Host", req.Host)
-	if req.TLS == nil {
-		req.Header.Set("X-Forwarded-Proto", "http")
-	} else {
-		req.Header.Set("X-Forwarded-Proto", "https")
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		if req.TLS == nil {
+			req.Header.Set("X-Forwarded-Proto", "http")
+		} else {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
 	}
 }
 
@@ -477,7 +599,12 @@ func lower(b byte) byte {
 
 func errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
 	httpStatus := http.StatusBadGateway
+	var maxBytesErr *http.MaxBytesError
 	switch {
+	case errors.As(err, &maxBytesErr):
+		httpStatus = http.StatusRequestEntityTooLarge
+	case client.IsRequestBodyError(err):
+		httpStatus = http.StatusBadRequest
 	case errors.Is(err, context.Canceled):
 		httpStatus = 499
 	case errors.Is(err, context.DeadlineExceeded):
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mini-gateway/client"
+	"mini-gateway/config"
+	"mini-gateway/discovery"
+	_ "mini-gateway/loadbalance/leastrequest"
+	"mini-gateway/router"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoUpgrade 切换到 echo 协议后原样返回收到的数据
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	_ = brw.Flush()
+	_, _ = io.Copy(conn, brw)
+}
+
+// leastRequest 等 picker 返回 DoneFunc，包装后的响应体仍然要能用于协议升级
+func TestUpgradeThroughDonePicker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgrade))
+	defer backend.Close()
+
+	p := NewProxy(client.NewFactory(discovery.NewSchemeResolver()), router.NewDefaultRouter())
+	err := p.UpdateEndpoints(nil, []*config.Endpoint{{
+		ID:          "echo",
+		Targets:     []*config.Target{{Uri: backend.URL, Weight: 1}},
+		LoadBalance: "leastRequest",
+		Predicates:  &config.Predicates{Path: "/**", Method: "GET"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewServer(p)
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gateway.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected 101,got %d %s", resp.StatusCode, body)
+	}
+	_, _ = io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo ping,got %q %v", buf, err)
+	}
+}
+
+// watchResolver 记录每次 Watch 的 ctx
+type watchResolver struct {
+	mux  sync.Mutex
+	ctxs []context.Context
+}
+
+func (r *watchResolver) Resolve(context.Context, string) (*discovery.Result, error) {
+	return &discovery.Result{Nodes: []discovery.Node{discovery.NewNode("http://127.0.0.1:1", 1, nil)}}, nil
+}
+
+func (r *watchResolver) Watch(ctx context.Context, _ string, _ func(*discovery.Result)) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ctxs = append(r.ctxs, ctx)
+	return nil
+}
+
+// 更新失败时已经生成的端点的 ctx 都被取消
+func TestUpdateEndpointsCancelsBuiltEndpointsOnError(t *testing.T) {
+	r := &watchResolver{}
+	p := NewProxy(client.NewFactory(r), router.NewDefaultRouter())
+	endpoint := func(id, path string) *config.Endpoint {
+		return &config.Endpoint{ID: id, Discovery: "test://svc", Predicates: &config.Predicates{Path: path, Method: "GET"}}
+	}
+	cases := map[string][]*config.Endpoint{
+		"duplicate id":   {endpoint("a", "/a/**"), endpoint("b", "/b/**"), endpoint("a", "/c/**")},
+		"route conflict": {endpoint("a", "/a/**"), endpoint("b", "/a/**")},
+	}
+	for name, es := range cases {
+		r.mux.Lock()
+		r.ctxs = nil
+		r.mux.Unlock()
+		if err := p.UpdateEndpoints(nil, es); err == nil {
+			t.Fatalf("%s: expected update error", name)
+		}
+		r.mux.Lock()
+		if len(r.ctxs) < 2 {
+			t.Fatalf("%s: expected built endpoints to watch discovery,got %d", name, len(r.ctxs))
+		}
+		for i, ctx := range r.ctxs {
+			if ctx.Err() == nil {
+				t.Errorf("%s: endpoint %d was not cancelled", name, i)
+			}
+		}
+		r.mux.Unlock()
+	}
+}
+
+// 开启重试时长度未知的 grpc 请求体也不缓存，客户端流不需要等到发送结束
+func TestGrpcStreamBodyIsNotBuffered(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 4)
+		_, _ = io.ReadFull(r.Body, buf)
+		received <- string(buf)
+	}))
+	defer backend.Close()
+
+	p := NewProxy(client.NewFactory(discovery.NewSchemeResolver()), router.NewDefaultRouter())
+	err := p.UpdateEndpoints(nil, []*config.Endpoint{{
+		ID:         "stream",
+		Targets:    []*config.Target{{Uri: backend.URL, Weight: 1}},
+		Retry:      &config.Retry{Attempts: 3},
+		Predicates: &config.Predicates{Path: "/**", Method: "POST"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewServer(p)
+	defer gateway.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/svc/Method", pr)
+	req.Header.Set("Content-Type", "application/grpc")
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	_, _ = pw.Write([]byte("ping"))
+	select {
+	case got := <-received:
+		if got != "ping" {
+			t.Fatalf("expected ping,got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("grpc stream body was buffered until the client finished sending")
+	}
+}
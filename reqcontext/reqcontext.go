@@ -16,12 +16,29 @@ func Endpoint(ctx context.Context) (*config.Endpoint, bool) {
 	return endpoint, b
 }
 
+// WithTag 请求要求的节点标签，picker 按标签选择节点
+func WithTag(ctx context.Context, key, value string) context.Context {
+	old, _ := Tags(ctx)
+	tags := make(map[string]string, len(old)+1)
+	for k, v := range old {
+		tags[k] = v
+	}
+	tags[key] = value
+	return context.WithValue(ctx, contextKey("tags"), tags)
+}
+
+func Tags(ctx context.Context) (map[string]string, bool) {
+	tags, b := ctx.Value(contextKey("tags")).(map[string]string)
+	return tags, b
+}
+
 func WithColor(ctx context.Context, color string) context.Context {
-	return context.WithValue(ctx, contextKey("color"), color)
+	return WithTag(ctx, "color", color)
 }
 
 func Color(ctx context.Context) (string, bool) {
-	color, b := ctx.Value(contextKey("color")).(string)
+	tags, _ := Tags(ctx)
+	color, b := tags["color"]
 	return color, b
 }
 
@@ -33,3 +50,52 @@ func Params(ctx context.Context) (map[string]string, bool) {
 	params, b := ctx.Value(contextKey("params")).(map[string]string)
 	return params, b
 }
+
+func WithClaims(ctx context.Context, claims map[string]any) context.Context {
+	return context.WithValue(ctx, contextKey("claims"), claims)
+}
+
+func Claims(ctx context.Context) (map[string]any, bool) {
+	claims, b := ctx.Value(contextKey("claims")).(map[string]any)
+	return claims, b
+}
+
+// WithHashKey 一致性哈希 picker 使用的 key
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, contextKey("hashKey"), key)
+}
+
+func HashKey(ctx context.Context) (string, bool) {
+	key, b := ctx.Value(contextKey("hashKey")).(string)
+	return key, b
+}
+
+// WithTried 重试时已经尝试过的节点 uri，一致性哈希 picker 沿环或查找表跳过这些节点
+func WithTried(ctx context.Context, tried map[string]bool) context.Context {
+	return context.WithValue(ctx, contextKey("tried"), tried)
+}
+
+func Tried(ctx context.Context) (map[string]bool, bool) {
+	tried, b := ctx.Value(contextKey("tried")).(map[string]bool)
+	return tried, b
+}
+
+// WithConsumer 鉴权通过的调用方名称
+func WithConsumer(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, contextKey("consumer"), name)
+}
+
+func Consumer(ctx context.Context) (string, bool) {
+	name, b := ctx.Value(contextKey("consumer")).(string)
+	return name, b
+}
+
+// WithClientIP 按可信代理计算的客户端地址
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey("clientIP"), ip)
+}
+
+func ClientIP(ctx context.Context) (string, bool) {
+	ip, b := ctx.Value(contextKey("clientIP")).(string)
+	return ip, b
+}
@@ -0,0 +1,99 @@
+package retry
+
+import (
+	"mini-gateway/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var defaultBudget atomic.Pointer[Budget]
+
+func init() {
+	defaultBudget.Store(NewBudget(nil))
+}
+
+// InitBudget 替换全局重试预算
+func InitBudget(b *Budget) {
+	defaultBudget.Store(b)
+}
+
+func DefaultBudget() *Budget {
+	return defaultBudget.Load()
+}
+
+// NewBudget 创建重试预算，窗口内重试次数不能超过 请求数*ratio + minRetriesPerSecond*窗口秒数
+func NewBudget(c *config.RetryBudget) *Budget {
+	b := &Budget{
+		ratio:               0.2,
+		minRetriesPerSecond: 10,
+		window:              10 * time.Second,
+	}
+	if c != nil {
+		if c.Ratio > 0 {
+			b.ratio = c.Ratio
+		}
+		if c.MinRetriesPerSecond > 0 {
+			b.minRetriesPerSecond = c.MinRetriesPerSecond
+		}
+		if c.Window >= 1000 {
+			b.window = time.Duration(c.Window) * time.Millisecond
+		}
+	}
+	b.buckets = make([]bucket, int(b.window/time.Second))
+	return b
+}
+
+type Budget struct {
+	ratio               float64
+	minRetriesPerSecond int
+	window              time.Duration
+
+	mux     sync.Mutex
+	buckets []bucket
+}
+
+// bucket 记录一秒内的请求数和重试数
+type bucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// Deposit 记录一次原始请求
+func (b *Budget) Deposit() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.current(time.Now()).requests++
+}
+
+// Withdraw 尝试申请一次重试，预算不足时返回 false
+func (b *Budget) Withdraw() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	requests, retries := 0, 0
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bk := range b.buckets {
+		if bk.second >= oldest {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	allowed := float64(requests)*b.ratio + float64(b.minRetriesPerSecond*len(b.buckets))
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.current(now).retries++
+	return true
+}
+
+// current 返回当前秒对应的桶，调用方需持有锁
+func (b *Budget) current(now time.Time) *bucket {
+	second := now.Unix()
+	bk := &b.buckets[second%int64(len(b.buckets))]
+	if bk.second != second {
+		*bk = bucket{second: second}
+	}
+	return bk
+}
@@ -0,0 +1,154 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"mini-gateway/config"
+	"mini-gateway/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// OnConnectFailure 连接上游失败，请求没有发出
+	OnConnectFailure = "connect-failure"
+	// OnReset 连接被上游重置或提前关闭
+	OnReset = "reset"
+	// OnTimeout 单次尝试超时
+	OnTimeout = "timeout"
+)
+
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+func NewPolicy(c *config.Retry) *Policy {
+	p := &Policy{
+		attempts:     2,
+		retryOn:      make(map[string]bool),
+		statusCodes:  make(map[int]bool),
+		methods:      make(map[string]bool),
+		baseInterval: 25 * time.Millisecond,
+		maxInterval:  250 * time.Millisecond,
+	}
+	if c.Attempts > 0 {
+		p.attempts = c.Attempts
+	}
+	if c.PerTryTimeout > 0 {
+		p.perTryTimeout = time.Duration(c.PerTryTimeout) * time.Millisecond
+	}
+
+	retryOn := c.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{OnConnectFailure, OnReset}
+	}
+	for _, on := range retryOn {
+		on = strings.ToLower(strings.TrimSpace(on))
+		switch on {
+		case OnConnectFailure, OnReset, OnTimeout:
+			p.retryOn[on] = true
+		default:
+			slog.Warn("unknown retry condition %s is ignored", on)
+		}
+	}
+
+	statusCodes := c.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, code := range statusCodes {
+		p.statusCodes[code] = true
+	}
+
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = idempotentMethods
+	}
+	for _, m := range methods {
+		p.methods[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+
+	if c.BaseInterval > 0 {
+		p.baseInterval = time.Duration(c.BaseInterval) * time.Millisecond
+	}
+	if c.MaxInterval > 0 {
+		p.maxInterval = time.Duration(c.MaxInterval) * time.Millisecond
+	}
+	if p.maxInterval < p.baseInterval {
+		p.maxInterval = p.baseInterval
+	}
+	return p
+}
+
+type Policy struct {
+	attempts      int
+	perTryTimeout time.Duration
+	retryOn       map[string]bool
+	statusCodes   map[int]bool
+	methods       map[string]bool
+	baseInterval  time.Duration
+	maxInterval   time.Duration
+}
+
+// Attempts 最大尝试次数，包含首次请求
+func (p *Policy) Attempts() int {
+	return p.attempts
+}
+
+func (p *Policy) PerTryTimeout() time.Duration {
+	return p.perTryTimeout
+}
+
+func (p *Policy) AllowMethod(method string) bool {
+	return p.methods[method]
+}
+
+// ShouldRetry 判断单次尝试的结果是否可以重试，timedOut 表示单次尝试超时
+func (p *Policy) ShouldRetry(resp *http.Response, err error, timedOut bool) bool {
+	if err == nil {
+		return resp != nil && p.statusCodes[resp.StatusCode]
+	}
+	switch {
+	case timedOut:
+		return p.retryOn[OnTimeout]
+	case isConnectFailure(err):
+		return p.retryOn[OnConnectFailure]
+	case isReset(err):
+		return p.retryOn[OnReset]
+	}
+	return false
+}
+
+// Backoff 第 n 次重试前的等待时间，指数退避并加入随机抖动
+func (p *Policy) Backoff(retry int) time.Duration {
+	d := p.baseInterval
+	for i := 1; i < retry && d < p.maxInterval; i++ {
+		d *= 2
+	}
+	if d > p.maxInterval {
+		d = p.maxInterval
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func isConnectFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,249 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"mini-gateway/clientip"
+	"mini-gateway/config"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type matcher func(req *http.Request) bool
+
+// compilePredicates 将 method 和精确匹配的请求头以外的断言条件编译为 matcher
+func compilePredicates(p *config.Predicates) ([]matcher, error) {
+	ms := make([]matcher, 0)
+	for key, value := range p.Headers {
+		if _, ok := value.(string); ok {
+			continue
+		}
+		sm, err := compileStringMatch("header", key, value)
+		if err != nil {
+			return nil, err
+		}
+		key := key
+		ms = append(ms, func(req *http.Request) bool {
+			return sm.match(req.Header.Values(key))
+		})
+	}
+	for key, value := range p.Query {
+		sm, err := compileStringMatch("query", key, value)
+		if err != nil {
+			return nil, err
+		}
+		key := key
+		ms = append(ms, func(req *http.Request) bool {
+			return sm.match(req.URL.Query()[key])
+		})
+	}
+	for key, value := range p.Cookies {
+		sm, err := compileStringMatch("cookie", key, value)
+		if err != nil {
+			return nil, err
+		}
+		key := key
+		ms = append(ms, func(req *http.Request) bool {
+			c, err := req.Cookie(key)
+			if err != nil {
+				return sm.match(nil)
+			}
+			return sm.match([]string{c.Value})
+		})
+	}
+	if p.Host != "" {
+		hosts := splitHosts(p.Host)
+		ms = append(ms, func(req *http.Request) bool {
+			return matchHost(hosts, req.Host)
+		})
+	}
+	if p.Sni != "" {
+		hosts := splitHosts(p.Sni)
+		ms = append(ms, func(req *http.Request) bool {
+			return req.TLS != nil && matchHost(hosts, req.TLS.ServerName)
+		})
+	}
+	if p.RemoteAddr != "" {
+		prefixes, err := parsePrefixes(p.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, func(req *http.Request) bool {
+			return matchRemoteAddr(prefixes, clientip.Get(req))
+		})
+	}
+	if p.After != "" || p.Before != "" {
+		after, before, err := parseTimeWindow(p.After, p.Before)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, func(req *http.Request) bool {
+			now := time.Now()
+			return (after.IsZero() || !now.Before(after)) && (before.IsZero() || now.Before(before))
+		})
+	}
+	if p.Weight != nil {
+		if strings.TrimSpace(p.Weight.Group) == "" {
+			return nil, errors.New("weight predicate group cannot be empty")
+		}
+		if p.Weight.Weight < 0 {
+			return nil, errors.New("weight predicate weight cannot be negative")
+		}
+	}
+	return ms, nil
+}
+
+// stringMatch exact 和 regex 都为空时只检查是否存在
+type stringMatch struct {
+	exact   *string
+	regex   *regexp.Regexp
+	present bool
+}
+
+func compileStringMatch(kind, key string, value interface{}) (*stringMatch, error) {
+	sm := &stringMatch{present: true}
+	switch v := value.(type) {
+	case bool:
+		sm.present = v
+	case string:
+		sm.exact = &v
+	case map[string]interface{}:
+		for k, val := range v {
+			switch k {
+			case "exact":
+				s := fmt.Sprint(val)
+				sm.exact = &s
+			case "regex":
+				re, err := regexp.Compile(fmt.Sprint(val))
+				if err != nil {
+					return nil, fmt.Errorf("%s predicate %s regex is invalid,error:%s", kind, key, err.Error())
+				}
+				sm.regex = re
+			case "present":
+				b, ok := val.(bool)
+				if !ok {
+					return nil, fmt.Errorf("%s predicate %s present must be a boolean", kind, key)
+				}
+				sm.present = b
+			default:
+				return nil, fmt.Errorf("%s predicate %s has unknown field %s", kind, key, k)
+			}
+		}
+	case nil:
+	default:
+		s := fmt.Sprint(v)
+		sm.exact = &s
+	}
+	return sm, nil
+}
+
+func (m *stringMatch) match(values []string) bool {
+	if !m.present {
+		return len(values) == 0
+	}
+	if len(values) == 0 {
+		return false
+	}
+	if m.exact == nil && m.regex == nil {
+		return true
+	}
+	for _, v := range values {
+		if (m.exact == nil || v == *m.exact) && (m.regex == nil || m.regex.MatchString(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitHosts(s string) []string {
+	hosts := make([]string, 0)
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// matchHost *.example.com 匹配 example.com 的任意子域名，不匹配 example.com 本身
+func matchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		if p == host {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) && len(host) > len(p)-1 {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("remote address predicate %s is invalid,error:%s", v, err.Error())
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("remote address predicate %s is invalid,error:%s", v, err.Error())
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func matchRemoteAddr(prefixes []netip.Prefix, remoteAddr string) bool {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeWindow(after, before string) (time.Time, time.Time, error) {
+	var a, b time.Time
+	var err error
+	if after != "" {
+		if a, err = time.Parse(time.RFC3339, after); err != nil {
+			return a, b, fmt.Errorf("after predicate %s is invalid,error:%s", after, err.Error())
+		}
+	}
+	if before != "" {
+		if b, err = time.Parse(time.RFC3339, before); err != nil {
+			return a, b, fmt.Errorf("before predicate %s is invalid,error:%s", before, err.Error())
+		}
+	}
+	if !a.IsZero() && !b.IsZero() && !a.Before(b) {
+		return a, b, errors.New("after predicate must be earlier than before")
+	}
+	return a, b, nil
+}
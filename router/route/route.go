@@ -1,21 +1,45 @@
 package route
 
 import (
+	"encoding/json"
+	"fmt"
 	"mini-gateway/config"
+	"mini-gateway/router/trie"
 	"net/http"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
-func NewRoute(predicates *config.Predicates, handler http.Handler) *Route {
+func NewRoute(id string, priority int, predicates *config.Predicates, handler http.Handler) (*Route, error) {
+	matchers, err := compilePredicates(predicates)
+	if err != nil {
+		return nil, fmt.Errorf("%s,id:%s", err.Error(), id)
+	}
 	return &Route{
+		id:         id,
+		priority:   priority,
 		handler:    handler,
 		predicates: predicates,
-	}
+		matchers:   matchers,
+	}, nil
 }
 
 type Route struct {
-	handler    http.Handler
-	predicates *config.Predicates
+	id          string
+	priority    int
+	handler     http.Handler
+	predicates  *config.Predicates
+	matchers    []matcher
+	weightRange atomic.Pointer[[2]float64]
+}
+
+func (r *Route) ID() string {
+	return r.id
+}
+
+func (r *Route) Priority() int {
+	return r.priority
 }
 
 func (r *Route) Handler() http.Handler {
@@ -23,10 +47,36 @@ func (r *Route) Handler() http.Handler {
 }
 
 func (r *Route) Path() []string {
-	return strings.Split(r.predicates.Path, ",")
+	return trie.SplitPaths(r.predicates.Path)
+}
+
+// Signature 除路径外的断言条件，同一路径下签名相同的路由无法区分
+func (r *Route) Signature() string {
+	p := *r.predicates
+	p.Path = ""
+	ms := strings.Split(strings.ToUpper(strings.ReplaceAll(p.Method, " ", "")), ",")
+	sort.Strings(ms)
+	p.Method = strings.Join(ms, ",")
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// WeightGroup 权重断言的分组，没有配置时返回空
+func (r *Route) WeightGroup() (string, int) {
+	if r.predicates.Weight == nil {
+		return "", 0
+	}
+	return r.predicates.Weight.Group, r.predicates.Weight.Weight
 }
 
-func (r *Route) Match(req *http.Request) bool {
+// SetWeightRange 设置路由在分组中占的区间 [lo, hi)，由路由器按分组的总权重计算
+func (r *Route) SetWeightRange(lo, hi float64) {
+	r.weightRange.Store(&[2]float64{lo, hi})
+}
+
+// Match roll 为本次请求的 [0, 1) 随机数，同一请求的所有路由使用相同的值，
+// 这样同一分组中只有一个路由的权重断言会匹配
+func (r *Route) Match(req *http.Request, roll float64) bool {
 	if !r.matchMethod(req.Method) {
 		return false
 	}
@@ -35,6 +85,19 @@ func (r *Route) Match(req *http.Request) bool {
 		return false
 	}
 
+	for _, m := range r.matchers {
+		if !m(req) {
+			return false
+		}
+	}
+
+	if r.predicates.Weight != nil {
+		wr := r.weightRange.Load()
+		if wr == nil || roll < wr[0] || roll >= wr[1] {
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -56,8 +119,12 @@ func (r *Route) matchMethod(method string) bool {
 	return match
 }
 
+// matchHeader 精确匹配的请求头，其他形式的条件在 matchers 中
 func (r *Route) matchHeader(header http.Header) bool {
 	for key, value := range r.predicates.Headers {
+		if _, ok := value.(string); !ok {
+			continue
+		}
 		v := header.Get(key)
 		if v == "" || v != value {
 			return false
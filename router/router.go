@@ -1,22 +1,26 @@
 package router
 
 import (
+	"fmt"
+	"math/rand"
 	"mini-gateway/reqcontext"
 	"mini-gateway/router/route"
 	"mini-gateway/router/trie"
 	"mini-gateway/slog"
 	"net/http"
+	"sort"
+	"strings"
 	"sync/atomic"
 )
 
 type Router interface {
 	http.Handler
-	RegisterOrUpdateRoutes([]*route.Route)
+	RegisterOrUpdateRoutes([]*route.Route) error
 }
 
 type defaultRouter struct {
 	trie atomic.Value
-	//trie *trie.Trie[*route.Route]
+	//trie *trie.Trie[[]*route.Route]
 }
 
 func NewDefaultRouter() Router {
@@ -24,12 +28,25 @@ func NewDefaultRouter() Router {
 }
 
 func (r *defaultRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if params, re, b := r.trie.Load().(*trie.Trie[*route.Route]).Search(req.URL.Path); b {
-		if re.Match(req) {
-			if params != nil && len(params) > 0 {
+	t, _ := r.trie.Load().(*trie.Trie[[]*route.Route])
+	if t != nil {
+		var matched *route.Route
+		roll := rand.Float64()
+		// 同一路径下按优先级依次匹配，都不匹配时回溯到其他路径
+		params, _, b := t.SearchFunc(req.URL.Path, func(_ map[string]string, rs []*route.Route) bool {
+			for _, re := range rs {
+				if re.Match(req, roll) {
+					matched = re
+					return true
+				}
+			}
+			return false
+		})
+		if b {
+			if len(params) > 0 {
 				req = req.WithContext(reqcontext.WithParams(req.Context(), params))
 			}
-			re.Handler().ServeHTTP(w, req)
+			matched.Handler().ServeHTTP(w, req)
 			return
 		}
 	}
@@ -41,12 +58,83 @@ func (r *defaultRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (r *defaultRouter) RegisterOrUpdateRoutes(routes []*route.Route) {
-	t := trie.NewTrie[*route.Route]()
-	for _, r := range routes {
-		for _, path := range r.Path() {
-			t.Insert(path, r)
+// RegisterOrUpdateRoutes 同一路径下的路由按 priority 从大到小排序，相同时按 id 排序，
+// 路径和断言条件都相同的路由返回错误
+func (r *defaultRouter) RegisterOrUpdateRoutes(routes []*route.Route) error {
+	candidates := make(map[string][]*route.Route)
+	paths := make([]string, 0)
+	for _, re := range routes {
+		seen := make(map[string]bool)
+		for _, path := range re.Path() {
+			key := strings.Trim(strings.TrimSpace(path), "/")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := candidates[key]; !ok {
+				paths = append(paths, path)
+			}
+			candidates[key] = append(candidates[key], re)
+		}
+	}
+
+	t := trie.NewTrie[[]*route.Route]()
+	for _, path := range paths {
+		rs := candidates[strings.Trim(strings.TrimSpace(path), "/")]
+		sort.SliceStable(rs, func(i, j int) bool {
+			if rs[i].Priority() != rs[j].Priority() {
+				return rs[i].Priority() > rs[j].Priority()
+			}
+			return rs[i].ID() < rs[j].ID()
+		})
+		signatures := make(map[string]string)
+		for _, re := range rs {
+			// 同一分组的权重断言互斥，不会冲突
+			if group, _ := re.WeightGroup(); group != "" {
+				continue
+			}
+			// 断言条件相同时优先级低的路由永远不会匹配，同样视为冲突
+			sig := re.Signature()
+			if id, ok := signatures[sig]; ok {
+				return fmt.Errorf("route conflicts with %s on path %s and can never match,id:%s", id, strings.TrimSpace(path), re.ID())
+			}
+			signatures[sig] = re.ID()
+		}
+		if err := t.Insert(strings.TrimSpace(path), rs); err != nil {
+			return err
 		}
 	}
+	setWeightRanges(routes)
 	r.trie.Store(t)
+	return nil
+}
+
+// setWeightRanges 按分组的总权重计算每个路由的区间，同一分组按 id 排序保证结果稳定
+func setWeightRanges(routes []*route.Route) {
+	groups := make(map[string][]*route.Route)
+	for _, re := range routes {
+		if group, _ := re.WeightGroup(); group != "" {
+			groups[group] = append(groups[group], re)
+		}
+	}
+	for _, rs := range groups {
+		sort.Slice(rs, func(i, j int) bool {
+			return rs[i].ID() < rs[j].ID()
+		})
+		total := 0
+		for _, re := range rs {
+			_, w := re.WeightGroup()
+			total += w
+		}
+		sum := 0
+		for _, re := range rs {
+			_, w := re.WeightGroup()
+			if total == 0 {
+				re.SetWeightRange(0, 0)
+				continue
+			}
+			re.SetWeightRange(float64(sum)/float64(total), float64(sum+w)/float64(total))
+			sum += w
+		}
+	}
 }
@@ -1,85 +1,294 @@
 package trie
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
-type Trie[T comparable] struct {
+// 路径段的匹配优先级：静态 > 带约束的参数 > 参数 > 通配剩余路径
+//
+//	/users/list          静态段
+//	/users/{id:int}      带类型约束的参数，支持 int、uint、alpha、alnum、hex、uuid
+//	/users/{id:[0-9]+}   带正则约束的参数
+//	/users/{id}          参数
+//	/users/*             匹配任意一段，不记录参数
+//	/static/**           匹配剩余的全部路径，参数名为 **，必须是最后一段
+//	/static/{path:**}    同上，参数名为 path
+type Trie[T any] struct {
 	node *node[T]
 }
 
-type node[T comparable] struct {
+type kind int
+
+const (
+	kindStatic kind = iota
+	kindConstrained
+	kindParam
+	kindCatchAll
+)
+
+const catchAllKey = "**"
+
+var paramTypes = map[string]string{
+	"int":   `-?[0-9]+`,
+	"uint":  `[0-9]+`,
+	"alpha": `[a-zA-Z]+`,
+	"alnum": `[a-zA-Z0-9]+`,
+	"hex":   `[0-9a-fA-F]+`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+type node[T any] struct {
 	value    T
+	hasValue bool
 	path     string
-	wildCard bool
+	kind     kind
+	name     string
+	re       *regexp.Regexp
 	children map[string]*node[T]
+	// params 参数子节点，带约束的在前，同类按插入顺序
+	params   []*node[T]
+	catchAll *node[T]
 }
 
-func NewTrie[T comparable]() *Trie[T] {
+func NewTrie[T any]() *Trie[T] {
+	root, _ := newNode[T]("")
 	return &Trie[T]{
-		node: &node[T]{
-			children: make(map[string]*node[T]),
-		},
+		node: root,
 	}
 }
 
-func (t *Trie[T]) Insert(path string, value T) {
-	n := t.node
-	path = strings.Trim(path, "/")
-	for _, v := range strings.Split(path, "/") {
-		if n.children[v] == nil {
-			n.children[v] = &node[T]{
-				children: make(map[string]*node[T]),
-				path:     v,
+func newNode[T any](path string) (*node[T], error) {
+	n := &node[T]{
+		path:     path,
+		kind:     kindStatic,
+		children: make(map[string]*node[T]),
+	}
+	switch {
+	case path == catchAllKey:
+		n.kind = kindCatchAll
+		n.name = catchAllKey
+	case path == "*":
+		n.kind = kindParam
+	case strings.HasPrefix(path, "{") && strings.HasSuffix(path, "}"):
+		name, pattern, constrained := strings.Cut(path[1:len(path)-1], ":")
+		n.name = name
+		n.kind = kindParam
+		switch {
+		case !constrained:
+		case pattern == catchAllKey:
+			n.kind = kindCatchAll
+		default:
+			if p, ok := paramTypes[pattern]; ok {
+				pattern = p
 			}
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid path segment %s,error:%s", path, err.Error())
+			}
+			n.kind = kindConstrained
+			n.re = re
 		}
-		if v == "*" || strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}") {
-			n.wildCard = true
+	}
+	return n, nil
+}
+
+// SplitPaths 按逗号拆分多个路径，参数约束 {} 内的逗号不拆分，比如 {id:[0-9]{1,3}}
+func SplitPaths(s string) []string {
+	paths := make([]string, 0, 1)
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				paths = append(paths, s[start:i])
+				start = i + 1
+			}
 		}
-		n = n.children[v]
+	}
+	return append(paths, s[start:])
+}
+
+func split(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// ValidatePath 检查路径中的约束参数是否合法，通配剩余路径必须是最后一段
+func ValidatePath(path string) error {
+	segments := split(path)
+	for i, v := range segments {
+		n, err := newNode[struct{}](v)
+		if err != nil {
+			return err
+		}
+		if n.kind == kindCatchAll && i != len(segments)-1 {
+			return fmt.Errorf("catch-all segment %s must be the last segment,path:%s", v, path)
+		}
+	}
+	return nil
+}
+
+// Insert 插入路径，通配剩余路径不是最后一段时返回错误
+func (t *Trie[T]) Insert(path string, value T) error {
+	if err := ValidatePath(path); err != nil {
+		return err
+	}
+	n := t.node
+	for _, v := range split(path) {
+		c, err := n.child(v)
+		if err != nil {
+			return err
+		}
+		n = c
 	}
 	n.value = value
+	n.hasValue = true
+	return nil
+}
+
+// child 返回路径段对应的子节点，不存在时创建
+func (n *node[T]) child(path string) (*node[T], error) {
+	if c, ok := n.children[path]; ok {
+		return c, nil
+	}
+	c, err := newNode[T](path)
+	if err != nil {
+		return nil, err
+	}
+	switch c.kind {
+	case kindCatchAll:
+		if n.catchAll != nil {
+			return nil, fmt.Errorf("catch-all segment %s conflicts with %s", path, n.catchAll.path)
+		}
+		n.catchAll = c
+	case kindConstrained:
+		i := 0
+		for i < len(n.params) && n.params[i].kind == kindConstrained {
+			i++
+		}
+		n.params = append(n.params[:i], append([]*node[T]{c}, n.params[i:]...)...)
+	case kindParam:
+		n.params = append(n.params, c)
+	}
+	n.children[path] = c
+	return c, nil
 }
 
 func (t *Trie[T]) Search(path string) (map[string]string, T, bool) {
+	return t.SearchFunc(path, nil)
+}
+
+// SearchFunc 按优先级查找匹配的路径，accept 返回 false 时回溯继续查找其他分支
+func (t *Trie[T]) SearchFunc(path string, accept func(params map[string]string, value T) bool) (map[string]string, T, bool) {
 	var zero T
-	n := t.node
-	path = strings.Trim(path, "/")
 	params := make(map[string]string)
-	for _, v := range strings.Split(path, "/") {
-		if n.wildCard {
-			for k := range n.children {
-				if strings.HasPrefix(k, "{") && strings.HasSuffix(k, "}") {
-					key := k[1 : len(k)-1]
-					params[key] = v
-				}
-				v = k
+	n := t.node.search(split(path), params, accept)
+	if n == nil {
+		return nil, zero, false
+	}
+	return params, n.value, true
+}
+
+func (n *node[T]) search(segments []string, params map[string]string, accept func(map[string]string, T) bool) *node[T] {
+	if len(segments) == 0 {
+		if n.hasValue && (accept == nil || accept(params, n.value)) {
+			return n
+		}
+		// 通配剩余路径也可以匹配空路径
+		if n.catchAll != nil {
+			return n.catchAll.matchCatchAll(nil, params, accept)
+		}
+		return nil
+	}
+
+	seg := segments[0]
+	if c, ok := n.children[seg]; ok && c.kind == kindStatic {
+		if found := c.search(segments[1:], params, accept); found != nil {
+			return found
+		}
+	}
+	for _, c := range n.params {
+		if c.re != nil && !c.re.MatchString(seg) {
+			continue
+		}
+		if c.name != "" {
+			prev, existed := params[c.name]
+			params[c.name] = seg
+			if found := c.search(segments[1:], params, accept); found != nil {
+				return found
 			}
+			if existed {
+				params[c.name] = prev
+			} else {
+				delete(params, c.name)
+			}
+			continue
 		}
-		if n.children[v] == nil {
-			return nil, zero, false
+		if found := c.search(segments[1:], params, accept); found != nil {
+			return found
 		}
-		n = n.children[v]
 	}
+	if n.catchAll != nil {
+		return n.catchAll.matchCatchAll(segments, params, accept)
+	}
+	return nil
+}
 
-	if len(n.children) == 0 {
-		return params, n.value, true
+func (n *node[T]) matchCatchAll(segments []string, params map[string]string, accept func(map[string]string, T) bool) *node[T] {
+	if !n.hasValue {
+		return nil
+	}
+	prev, existed := params[n.name]
+	params[n.name] = strings.Join(segments, "/")
+	if accept == nil || accept(params, n.value) {
+		return n
+	}
+	if existed {
+		params[n.name] = prev
+	} else {
+		delete(params, n.name)
 	}
-	return nil, zero, false
+	return nil
 }
 
 func (t *Trie[T]) Delete(path string) {
-	path = strings.Trim(path, "/")
 	nodes := make([]*node[T], 0)
 	n := t.node
 	nodes = append(nodes, n)
-	for _, v := range strings.Split(path, "/") {
+	for _, v := range split(path) {
 		n = n.children[v]
+		if n == nil {
+			return
+		}
 		nodes = append(nodes, n)
 	}
+	var zero T
+	n.value = zero
+	n.hasValue = false
 	for i := len(nodes) - 1; i > 0; i-- {
-		if len(nodes[i].children) == 0 {
-			delete(nodes[i-1].children, nodes[i].path)
+		if len(nodes[i].children) > 0 || nodes[i].hasValue {
+			break
+		}
+		nodes[i-1].remove(nodes[i])
+	}
+}
+
+func (n *node[T]) remove(c *node[T]) {
+	delete(n.children, c.path)
+	if n.catchAll == c {
+		n.catchAll = nil
+	}
+	for i, p := range n.params {
+		if p == c {
+			n.params = append(n.params[:i], n.params[i+1:]...)
+			break
 		}
 	}
 }
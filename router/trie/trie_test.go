@@ -0,0 +1,80 @@
+package trie
+
+import (
+	"testing"
+)
+
+func newTestTrie(t *testing.T, paths ...string) *Trie[string] {
+	tr := NewTrie[string]()
+	for _, p := range paths {
+		if err := tr.Insert(p, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tr
+}
+
+// 静态 > 带约束的参数 > 参数 > 通配剩余路径
+func TestSearchPrecedence(t *testing.T) {
+	tr := newTestTrie(t, "/users/list", "/users/{id:int}", "/users/{name}", "/users/**")
+	cases := map[string]string{
+		"/users/list":  "/users/list",
+		"/users/42":    "/users/{id:int}",
+		"/users/alice": "/users/{name}",
+		"/users/a/b":   "/users/**",
+		"/users":       "/users/**",
+	}
+	for path, want := range cases {
+		if _, got, ok := tr.Search(path); !ok || got != want {
+			t.Errorf("Search(%s) = %s,%v,expected %s", path, got, ok, want)
+		}
+	}
+	params, _, _ := tr.Search("/users/42")
+	if params["id"] != "42" {
+		t.Errorf("expected id 42,got %v", params)
+	}
+	params, _, _ = tr.Search("/users/a/b")
+	if params["**"] != "a/b" {
+		t.Errorf("expected ** a/b,got %v", params)
+	}
+}
+
+// 优先级高的分支后续段不匹配或被 accept 拒绝时回溯到其他分支
+func TestSearchBacktracking(t *testing.T) {
+	tr := newTestTrie(t, "/a/static/x", "/a/{p}/y", "/a/**")
+	if _, got, _ := tr.Search("/a/static/y"); got != "/a/{p}/y" {
+		t.Errorf("expected /a/{p}/y,got %s", got)
+	}
+	if _, got, _ := tr.Search("/a/static/z"); got != "/a/**" {
+		t.Errorf("expected /a/**,got %s", got)
+	}
+	params, got, ok := tr.SearchFunc("/a/b/y", func(_ map[string]string, value string) bool {
+		return value != "/a/{p}/y"
+	})
+	if !ok || got != "/a/**" {
+		t.Fatalf("expected /a/** after rejecting /a/{p}/y,got %s", got)
+	}
+	if _, ok := params["p"]; ok || params["**"] != "b/y" {
+		t.Errorf("params of rejected branch should be removed,got %v", params)
+	}
+}
+
+func TestInsertRejectsCatchAllBeforeLastSegment(t *testing.T) {
+	for _, p := range []string{"/static/**/foo", "/public/{path:**}/health"} {
+		if err := ValidatePath(p); err == nil {
+			t.Errorf("ValidatePath(%s) should fail", p)
+		}
+		tr := NewTrie[string]()
+		if err := tr.Insert(p, p); err == nil {
+			t.Errorf("Insert(%s) should fail", p)
+		}
+		if len(tr.node.children) != 0 {
+			t.Errorf("rejected path %s should not be inserted", p)
+		}
+	}
+	for _, p := range []string{"/static/**", "/static/{path:**}", "/a/*/b"} {
+		if err := ValidatePath(p); err != nil {
+			t.Errorf("ValidatePath(%s) = %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mini-gateway/config"
+	"mini-gateway/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func newCertManager(cs []*config.Certificate) (*certManager, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("tls certificates cannot be empty")
+	}
+	m := &certManager{
+		entries: make([]*certEntry, 0, len(cs)),
+		stop:    make(chan struct{}),
+	}
+	for _, c := range cs {
+		e := &certEntry{certFile: c.CertFile, keyFile: c.KeyFile}
+		if err := e.load(); err != nil {
+			return nil, err
+		}
+		m.entries = append(m.entries, e)
+	}
+	m.index()
+	return m, nil
+}
+
+// certManager 按 SNI 选择证书，并定期检查证书文件是否有变化
+type certManager struct {
+	mux     sync.RWMutex
+	entries []*certEntry
+	names   map[string]*tls.Certificate
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type certEntry struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func (e *certEntry) load() error {
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate %s failed,error:%s", e.certFile, err.Error())
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	modTime, err := e.lastModified()
+	if err != nil {
+		return err
+	}
+	e.cert = &cert
+	e.modTime = modTime
+	return nil
+}
+
+func (e *certEntry) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(e.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(e.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// index 建立域名到证书的索引，先配置的证书优先，调用方需持有写锁或处于初始化阶段
+func (m *certManager) index() {
+	names := make(map[string]*tls.Certificate)
+	for _, e := range m.entries {
+		ns := e.cert.Leaf.DNSNames
+		if len(ns) == 0 && e.cert.Leaf.Subject.CommonName != "" {
+			ns = []string{e.cert.Leaf.Subject.CommonName}
+		}
+		for _, n := range ns {
+			n = strings.ToLower(n)
+			if _, ok := names[n]; !ok {
+				names[n] = e.cert
+			}
+		}
+	}
+	m.names = names
+}
+
+func (m *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := m.names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := m.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	// 没有匹配的证书时使用第一个证书
+	return m.entries[0].cert, nil
+}
+
+func (m *certManager) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.reload()
+	}
+}
+
+func (m *certManager) reload() {
+	changed := false
+	for _, e := range m.entries {
+		modTime, err := e.lastModified()
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		if modTime.Equal(e.modTime) {
+			continue
+		}
+		reloaded := &certEntry{certFile: e.certFile, keyFile: e.keyFile}
+		// 证书和私钥可能没有同时写完，失败后等下次检查
+		if err := reloaded.load(); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		m.mux.Lock()
+		e.cert = reloaded.cert
+		e.modTime = reloaded.modTime
+		m.mux.Unlock()
+		changed = true
+		slog.Info("tls certificate %s has been reloaded", e.certFile)
+	}
+	if changed {
+		m.mux.Lock()
+		m.index()
+		m.mux.Unlock()
+	}
+}
+
+func (m *certManager) Close() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func buildTLSConfig(c *config.TLS, m *certManager) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(c.MinVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls min version %s", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if len(c.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, s := range tls.InsecureCipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown tls cipher suite %s", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	if len(c.Alpn) > 0 {
+		cfg.NextProtos = c.Alpn
+	}
+	return cfg, nil
+}
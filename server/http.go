@@ -2,17 +2,48 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"mini-gateway/config"
 	"net"
 	"net/http"
+	"time"
 )
 
-func NewHttpServer(proxy http.Handler) *HttpServer {
-	return &HttpServer{handler: proxy}
+// 证书文件变化检查间隔
+const certWatchInterval = 5 * time.Second
+
+type Option func(s *HttpServer)
+
+// WithTLS 启用 TLS，证书在 Run 时加载
+func WithTLS(c *config.TLS) Option {
+	return func(s *HttpServer) {
+		s.tls = c
+	}
+}
+
+// WithH2C 明文端口支持 HTTP/2，grpc 客户端可以直接连接网关
+func WithH2C() Option {
+	return func(s *HttpServer) {
+		s.h2c = true
+	}
+}
+
+func NewHttpServer(proxy http.Handler, opts ...Option) *HttpServer {
+	s := &HttpServer{handler: proxy}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 type HttpServer struct {
 	handler http.Handler
 	h1s     *http.Server
+	tls     *config.TLS
+	h2c     bool
+	certs   *certManager
 }
 
 func (s *HttpServer) Run(l net.Listener) error {
@@ -23,9 +54,49 @@ func (s *HttpServer) run(l net.Listener) error {
 	s.h1s = &http.Server{
 		Handler: s.handler,
 	}
-	return s.h1s.Serve(l)
+	if s.tls == nil {
+		if s.h2c {
+			s.h1s.Handler = h2c.NewHandler(s.handler, &http2.Server{})
+		}
+		return s.h1s.Serve(l)
+	}
+
+	certs, err := newCertManager(s.tls.Certificates)
+	if err != nil {
+		return err
+	}
+	cfg, err := buildTLSConfig(s.tls, certs)
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	go certs.watch(certWatchInterval)
+	defer certs.Close()
+
+	s.h1s.TLSConfig = cfg
+	if containsProto(cfg.NextProtos, http2.NextProtoTLS) {
+		if err := http2.ConfigureServer(s.h1s, &http2.Server{}); err != nil {
+			return err
+		}
+	} else {
+		// 不在 alpn 中声明 h2 时禁用 HTTP/2
+		s.h1s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return s.h1s.ServeTLS(l, "", "")
 }
 
 func (s *HttpServer) Shutdown(ctx context.Context) error {
+	if s.certs != nil {
+		s.certs.Close()
+	}
 	return s.h1s.Shutdown(ctx)
 }
+
+func containsProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}